@@ -0,0 +1,73 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package admin provides administrative interfaces for inspecting and
+// controlling the queue workers.
+package admin
+
+import (
+	"context"
+
+	frontierV1 "github.com/nlnwa/veidemann-api/go/frontier/v1"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/worker"
+)
+
+// ErrUnknownWorker is returned when a worker is not found
+var ErrUnknownWorker = worker.ErrUnknownWorker
+
+// WorkerStatus is the status of a worker
+type WorkerStatus = worker.Status
+
+// Controller gives access to the status and control of workers
+type Controller interface {
+	// Workers returns the status of all workers
+	Workers() []WorkerStatus
+	// Pause pauses the named worker
+	Pause(name string) error
+	// Resume resumes the named worker
+	Resume(name string) error
+	// Trigger makes the named worker run an iteration as soon as possible, even if paused
+	Trigger(name string) error
+}
+
+// QueueInspector gives access to the queues
+type QueueInspector interface {
+	// QueueLengths returns the length of each queue by queue name
+	QueueLengths(ctx context.Context) (map[string]int64, error)
+	// PeekQueue returns up to count items from the head of the named queue
+	PeekQueue(ctx context.Context, name string, count int) ([]database.QueueItem, error)
+}
+
+// Takedowns handles takedown requests
+type Takedowns interface {
+	// Takedown queues the queued uris matching request for removal and records the request
+	Takedown(ctx context.Context, request database.TakedownRequest) (database.TakedownRecord, error)
+	// TakedownStatus verifies and returns the record of a takedown
+	TakedownStatus(ctx context.Context, id string) (database.TakedownRecord, error)
+}
+
+// QueuePositions estimates queue positions
+type QueuePositions interface {
+	// QueuePosition estimates the position in the frontier of the queued uris of a seed or crawl execution
+	QueuePosition(ctx context.Context, request database.QueuePositionRequest) (database.QueuePosition, error)
+}
+
+// Snapshotter takes snapshots of job execution state
+type Snapshotter interface {
+	// JobExecutionSnapshot returns the current job execution stats
+	JobExecutionSnapshot(ctx context.Context) ([]*frontierV1.JobExecutionStatus, error)
+}
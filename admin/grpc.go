@@ -0,0 +1,188 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// grpcServiceName is the full name of the admin gRPC service
+const grpcServiceName = "veidemann.frontier.queueworkers.v1.Admin"
+
+// grpcServer implements the admin gRPC service.
+//
+// The service is defined using only well known protobuf types:
+//
+//	service Admin {
+//	  // GetStatus returns worker status and queue lengths.
+//	  rpc GetStatus(google.protobuf.Empty) returns (google.protobuf.Struct);
+//	  // PauseWorker pauses the named worker.
+//	  rpc PauseWorker(google.protobuf.StringValue) returns (google.protobuf.Empty);
+//	  // ResumeWorker resumes the named worker.
+//	  rpc ResumeWorker(google.protobuf.StringValue) returns (google.protobuf.Empty);
+//	}
+type grpcServer struct {
+	controller Controller
+	queues     QueueInspector
+}
+
+// NewGrpcServer returns a gRPC server with the admin service registered, requiring calls to carry
+// token as a bearer token in their authorization metadata like the admin HTTP API
+func NewGrpcServer(token string, controller Controller, queues QueueInspector) (*grpc.Server, error) {
+	if token == "" {
+		return nil, errors.New("admin grpc service requires a token")
+	}
+	s := grpc.NewServer(grpc.UnaryInterceptor(authenticateUnary(token)))
+	RegisterGrpcService(s, controller, queues)
+	return s, nil
+}
+
+// authenticateUnary returns an interceptor requiring calls to carry the given bearer token
+func authenticateUnary(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		var auth string
+		if values := md.Get("authorization"); len(values) > 0 {
+			auth = values[0]
+		}
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "unauthorized")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// RegisterGrpcService registers the admin service with a gRPC server
+func RegisterGrpcService(s *grpc.Server, controller Controller, queues QueueInspector) {
+	s.RegisterService(&grpcServiceDesc, &grpcServer{
+		controller: controller,
+		queues:     queues,
+	})
+}
+
+func (s *grpcServer) GetStatus(ctx context.Context, _ *emptypb.Empty) (*structpb.Struct, error) {
+	lengths, err := s.queues.QueueLengths(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to get queue lengths: %v", err)
+	}
+	return toStruct(map[string]interface{}{
+		"workers": s.controller.Workers(),
+		"queues":  lengths,
+	})
+}
+
+func (s *grpcServer) PauseWorker(_ context.Context, name *wrapperspb.StringValue) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, toStatus(s.controller.Pause(name.GetValue()))
+}
+
+func (s *grpcServer) ResumeWorker(_ context.Context, name *wrapperspb.StringValue) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, toStatus(s.controller.Resume(name.GetValue()))
+}
+
+// toStruct converts v to a protobuf struct by way of its JSON representation
+func toStruct(v interface{}) (*structpb.Struct, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s := new(structpb.Struct)
+	if err := s.UnmarshalJSON(b); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return s, nil
+}
+
+// toStatus converts an error to a gRPC status error
+func toStatus(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrUnknownWorker):
+		return status.Error(codes.NotFound, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetStatus",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(emptypb.Empty)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(*grpcServer).GetStatus(ctx, req.(*emptypb.Empty))
+				}
+				if interceptor == nil {
+					return handler(ctx, in)
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/GetStatus"}, handler)
+			},
+		},
+		{
+			MethodName: "PauseWorker",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(wrapperspb.StringValue)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(*grpcServer).PauseWorker(ctx, req.(*wrapperspb.StringValue))
+				}
+				if interceptor == nil {
+					return handler(ctx, in)
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/PauseWorker"}, handler)
+			},
+		},
+		{
+			MethodName: "ResumeWorker",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(wrapperspb.StringValue)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(*grpcServer).ResumeWorker(ctx, req.(*wrapperspb.StringValue))
+				}
+				if interceptor == nil {
+					return handler(ctx, in)
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/ResumeWorker"}, handler)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
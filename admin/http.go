@@ -0,0 +1,336 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	frontierV1 "github.com/nlnwa/veidemann-api/go/frontier/v1"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultPeekCount is the number of items returned when peeking a queue if not specified
+const defaultPeekCount = 10
+
+// maxPeekCount is the max number of items returned when peeking a queue
+const maxPeekCount = 1000
+
+// HttpOptions configures the admin HTTP API
+type HttpOptions struct {
+	// Port to listen on
+	Port int
+	// Token is the bearer token required to access the API
+	Token string
+	// SnapshotDir is the directory job execution snapshots are written to
+	SnapshotDir string
+}
+
+// NewHttpServer returns a http server exposing the admin API.
+//
+// Every request must be authenticated with the configured token as a bearer token.
+//
+//	GET  /api/v1/workers                   status of all workers
+//	POST /api/v1/workers/{name}/pause      pause a worker
+//	POST /api/v1/workers/{name}/resume     resume a worker
+//	POST /api/v1/workers/{name}/trigger    trigger an iteration of a worker
+//	GET  /api/v1/queues                    length of all queues
+//	GET  /api/v1/queues/{name}?count=N     peek at the first N items of a queue
+//	GET  /api/v1/snapshots/job-executions  download a snapshot of job execution stats
+//	POST /api/v1/snapshots/job-executions  write a snapshot of job execution stats to the snapshot dir
+//	POST /api/v1/takedowns                 queue the queued uris of a seed or matching a uri pattern for removal
+//	GET  /api/v1/takedowns/{id}            verify and get the record of a takedown
+//
+// Snapshots are streams of size delimited veidemann.api.frontier.v1.JobExecutionStatus messages.
+//
+// Takedowns are requested with a JSON encoded database.TakedownRequest and return a JSON
+// encoded database.TakedownRecord which serves as proof of removal.
+func NewHttpServer(opts HttpOptions, controller Controller, queues QueueInspector, snapshots Snapshotter, takedowns Takedowns) (*http.Server, error) {
+	if opts.Token == "" {
+		return nil, errors.New("admin http api requires a token")
+	}
+	a := &httpApi{
+		controller:  controller,
+		queues:      queues,
+		snapshots:   snapshots,
+		snapshotDir: opts.SnapshotDir,
+		takedowns:   takedowns,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/workers", a.workers)
+	mux.HandleFunc("/api/v1/workers/", a.worker)
+	mux.HandleFunc("/api/v1/queues", a.queueLengths)
+	mux.HandleFunc("/api/v1/queues/", a.peekQueue)
+	mux.HandleFunc("/api/v1/snapshots/job-executions", a.jobExecutionSnapshot)
+	mux.HandleFunc("/api/v1/takedowns", a.takedown)
+	mux.HandleFunc("/api/v1/takedowns/", a.takedownStatus)
+	return &http.Server{
+		Addr:        fmt.Sprintf(":%d", opts.Port),
+		Handler:     authenticate(opts.Token, mux),
+		BaseContext: loggerContext,
+	}, nil
+}
+
+// NewQueuePositionServer returns a http server exposing the read-only queue position estimates,
+// which requires no token so that it can be offered to operators without admin rights.
+//
+//	GET  /api/v1/queue-position?seedId=ID  estimate the queue position of a seed (or executionId=ID of a crawl execution)
+//
+// Queue positions are returned as a JSON encoded database.QueuePosition.
+func NewQueuePositionServer(port int, positions QueuePositions) *http.Server {
+	a := &httpApi{
+		positions: positions,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/queue-position", a.queuePosition)
+	return &http.Server{
+		Addr:        fmt.Sprintf(":%d", port),
+		Handler:     mux,
+		BaseContext: loggerContext,
+	}
+}
+
+// loggerContext returns the base context of requests, which carries the logger so that the
+// database operations they do can log
+func loggerContext(net.Listener) context.Context {
+	return log.Logger.WithContext(context.Background())
+}
+
+// authenticate wraps handler requiring requests to carry the given bearer token
+func authenticate(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+type httpApi struct {
+	controller  Controller
+	queues      QueueInspector
+	snapshots   Snapshotter
+	snapshotDir string
+	takedowns   Takedowns
+	positions   QueuePositions
+}
+
+func (a *httpApi) workers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJson(w, a.controller.Workers())
+}
+
+func (a *httpApi) worker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/workers/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name, action := parts[0], parts[1]
+
+	var err error
+	switch action {
+	case "pause":
+		err = a.controller.Pause(name)
+	case "resume":
+		err = a.controller.Resume(name)
+	case "trigger":
+		err = a.controller.Trigger(name)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, ErrUnknownWorker) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *httpApi) queueLengths(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lengths, err := a.queues.QueueLengths(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, lengths)
+}
+
+func (a *httpApi) peekQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/api/v1/queues/")
+	count := defaultPeekCount
+	if c := r.URL.Query().Get("count"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n <= 0 || n > maxPeekCount {
+			http.Error(w, fmt.Sprintf("count must be a number between 1 and %d", maxPeekCount), http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+	items, err := a.queues.PeekQueue(r.Context(), name, count)
+	if errors.Is(err, database.ErrUnknownQueue) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, items)
+}
+
+func (a *httpApi) jobExecutionSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot, err := a.snapshots.JobExecutionSnapshot(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="job-executions.pb"`)
+		_ = database.WriteDelimited(w, snapshot)
+		return
+	}
+
+	path := filepath.Join(a.snapshotDir, fmt.Sprintf("job-executions-%s.pb", time.Now().UTC().Format("20060102T150405Z")))
+	if err := writeSnapshotFile(path, snapshot); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"path":  path,
+		"count": len(snapshot),
+	})
+}
+
+func (a *httpApi) takedown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request database.TakedownRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	record, err := a.takedowns.Takedown(r.Context(), request)
+	if errors.Is(err, database.ErrInvalidTakedown) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJsonStatus(w, http.StatusCreated, record)
+}
+
+func (a *httpApi) takedownStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/takedowns/")
+	record, err := a.takedowns.TakedownStatus(r.Context(), id)
+	if errors.Is(err, database.ErrUnknownTakedown) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, record)
+}
+
+func (a *httpApi) queuePosition(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	position, err := a.positions.QueuePosition(r.Context(), database.QueuePositionRequest{
+		SeedId:      r.URL.Query().Get("seedId"),
+		ExecutionId: r.URL.Query().Get("executionId"),
+	})
+	if errors.Is(err, database.ErrInvalidQueuePositionRequest) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJson(w, position)
+}
+
+// writeSnapshotFile writes snapshot to a new file at path
+func writeSnapshotFile(path string, snapshot []*frontierV1.JobExecutionStatus) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := database.WriteDelimited(f, snapshot); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	writeJsonStatus(w, http.StatusOK, v)
+}
+
+// writeJsonStatus writes v as JSON with the given status code
+func writeJsonStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
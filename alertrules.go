@@ -0,0 +1,64 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/worker"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// alertRulesCommand is the name of the command writing Prometheus alerting and recording rules
+const alertRulesCommand = "alert-rules"
+
+// writeAlertRules writes a Prometheus rule file for the enabled workers and the configured
+// thresholds to path, or to stdout if path is "-".
+func writeAlertRules(path string, workers []worker.Worker, schedules map[string]*worker.Schedule) error {
+	objective := viper.GetFloat64("alert-rules-objective")
+	if objective <= 0 || objective >= 1 {
+		return fmt.Errorf("invalid alert-rules-objective, must be between 0 and 1: %g", objective)
+	}
+	opts := metrics.RulesOptions{
+		Objective:      objective,
+		MaxFailures:    viper.GetInt("worker-max-failures"),
+		CircuitBreaker: viper.GetInt("db-breaker-threshold") > 0,
+	}
+	for _, w := range workers {
+		rw := metrics.RuleWorker{Name: w.Name()}
+		if schedules[w.Name()] == nil {
+			rw.Interval = w.Interval()
+		}
+		opts.Workers = append(opts.Workers, rw)
+		if w.Name() == "frontier-lag" {
+			opts.MaxFrontierLag = viper.GetDuration("alert-rules-max-frontier-lag")
+		}
+	}
+
+	b, err := yaml.Marshal(metrics.Rules(opts))
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/worker"
+	"github.com/rs/zerolog/log"
+)
+
+// anomalyOptions configures anomaly detection
+type anomalyOptions struct {
+	// smoothing is the weight of the latest sample in the moving mean and variance
+	smoothing float64
+	// threshold is the number of standard deviations from the mean a sample must be to be anomalous
+	threshold float64
+	// warmup is the number of samples of a series observed before anomalies are flagged
+	warmup int
+}
+
+// ewma is an exponentially weighted moving mean and variance of a series
+type ewma struct {
+	mean     float64
+	variance float64
+	samples  int
+}
+
+// observe adds x to the series and returns its score, i.e. its distance from the mean
+// before x was added in standard deviations
+func (e *ewma) observe(x float64, smoothing float64) float64 {
+	e.samples++
+	if e.samples == 1 {
+		e.mean = x
+		return 0
+	}
+	diff := x - e.mean
+	var score float64
+	if std := math.Sqrt(e.variance); std > 0 {
+		score = diff / std
+	}
+	incr := smoothing * diff
+	e.mean += incr
+	e.variance = (1 - smoothing) * (e.variance + diff*incr)
+	return score
+}
+
+// anomalyDetector flags abnormal spikes and drops in queue lengths and worker throughput
+type anomalyDetector struct {
+	opts anomalyOptions
+	// processed returns the total number of items processed by each worker
+	processed func() map[string]int64
+
+	series        map[string]*ewma
+	lastSample    time.Time
+	lastProcessed map[string]int64
+}
+
+// anomalyWorker returns a worker that samples queue lengths and worker throughput and
+// flags samples deviating abnormally from their exponentially weighted moving average.
+func anomalyWorker(db database.Database, processed func() map[string]int64, opts anomalyOptions) worker.Func {
+	a := &anomalyDetector{
+		opts:      opts,
+		processed: processed,
+		series:    make(map[string]*ewma),
+	}
+	return func(ctx context.Context) (int, error) {
+		lengths, err := db.QueueLengths(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get queue lengths: %w", err)
+		}
+		a.observe(ctx, lengths, time.Now())
+		return 0, nil
+	}
+}
+
+func (a *anomalyDetector) observe(ctx context.Context, lengths map[string]int64, now time.Time) {
+	for queue, length := range lengths {
+		a.check(ctx, "queue_length:"+queue, float64(length))
+	}
+
+	processed := a.processed()
+	if !a.lastSample.IsZero() {
+		if elapsed := now.Sub(a.lastSample).Seconds(); elapsed > 0 {
+			for name, total := range processed {
+				a.check(ctx, "throughput:"+name, float64(total-a.lastProcessed[name])/elapsed)
+			}
+		}
+	}
+	a.lastSample = now
+	a.lastProcessed = processed
+}
+
+// check adds x to the named series and flags it if anomalous
+func (a *anomalyDetector) check(ctx context.Context, name string, x float64) {
+	e, ok := a.series[name]
+	if !ok {
+		e = &ewma{}
+		a.series[name] = e
+	}
+	score := e.observe(x, a.opts.smoothing)
+	if e.samples <= a.opts.warmup {
+		return
+	}
+	metrics.AnomalyScore.WithLabelValues(name).Set(score)
+	if math.Abs(score) < a.opts.threshold {
+		return
+	}
+	direction := "spike"
+	if score < 0 {
+		direction = "drop"
+	}
+	metrics.Anomalies.WithLabelValues(name, direction).Inc()
+	log.Ctx(ctx).Warn().
+		Str("series", name).
+		Str("direction", direction).
+		Float64("value", x).
+		Float64("mean", e.mean).
+		Float64("score", score).
+		Msg("Anomaly detected")
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/worker"
+	"github.com/rs/zerolog/log"
+)
+
+// burstOptions configures when burst mode is entered and left
+type burstOptions struct {
+	// removeUriThreshold is the REMURI queue length at which burst mode is entered
+	removeUriThreshold int64
+	// timeoutThreshold is the timeout queue length at which burst mode is entered
+	timeoutThreshold int64
+}
+
+// burstWorker returns a worker that activates burst mode when a backlog reaches its
+// threshold and deactivates it when all backlogs have fallen below half their threshold.
+func burstWorker(db database.Database, burst *worker.Burst, opts burstOptions) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		sample, err := db.LagSample(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to sample backlog: %w", err)
+		}
+		above := func(length int64, threshold int64, fraction int64) bool {
+			return threshold > 0 && length*fraction >= threshold
+		}
+
+		active := burst.Active()
+		if !active {
+			active = above(sample.RemoveUriQueueLength, opts.removeUriThreshold, 1) ||
+				above(sample.TimeoutQueueLength, opts.timeoutThreshold, 1)
+		} else {
+			active = above(sample.RemoveUriQueueLength, opts.removeUriThreshold, 2) ||
+				above(sample.TimeoutQueueLength, opts.timeoutThreshold, 2)
+		}
+
+		if burst.Set(active) {
+			mode := "steady"
+			if active {
+				mode = "burst"
+			}
+			metrics.BurstTransitions.WithLabelValues(mode).Inc()
+			log.Ctx(ctx).Info().
+				Int64("removeUriQueueLength", sample.RemoveUriQueueLength).
+				Int64("timeoutQueueLength", sample.TimeoutQueueLength).
+				Msgf("Entering %s mode", mode)
+		}
+		if active {
+			metrics.BurstMode.Set(1)
+		} else {
+			metrics.BurstMode.Set(0)
+		}
+		return 0, nil
+	}
+}
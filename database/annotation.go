@@ -0,0 +1,100 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// redisEnqueueSourceSuffix is the suffix of the companion hash of a queue
+// recording which component enqueued each item and when.
+//
+// The hash is keyed by queue item and each value is either a JSON encoded
+// EnqueueSource or just the name of the component.
+const redisEnqueueSourceSuffix = ":source"
+
+// maxLoggedEnqueueSources is the max number of enqueue sources logged per failure
+const maxLoggedEnqueueSources = 10
+
+// EnqueueSource records which component enqueued a queue item and when
+type EnqueueSource struct {
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+}
+
+// enqueueSources returns the enqueue sources of the given items in queue. Items without a source are omitted.
+func (d *database) enqueueSources(ctx context.Context, queue string, items []string) (map[string]EnqueueSource, error) {
+	values, err := d.redis.HMGet(ctx, queue+redisEnqueueSourceSuffix, items...).Result()
+	if err != nil {
+		return nil, err
+	}
+	sources := make(map[string]EnqueueSource)
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var source EnqueueSource
+		if err := json.Unmarshal([]byte(s), &source); err != nil {
+			source = EnqueueSource{Source: s}
+		}
+		sources[items[i]] = source
+	}
+	return sources, nil
+}
+
+// logEnqueueSources logs the enqueue sources of items in queue that failed to be processed
+func (d *database) logEnqueueSources(ctx context.Context, queue string, items []string, cause error) {
+	if !d.annotations || len(items) == 0 {
+		return
+	}
+	if len(items) > maxLoggedEnqueueSources {
+		items = items[:maxLoggedEnqueueSources]
+	}
+	sources, err := d.enqueueSources(ctx, queue, items)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("queue", queue).Msg("Failed to get enqueue sources")
+		return
+	}
+	for _, item := range items {
+		source, ok := sources[item]
+		if !ok {
+			continue
+		}
+		log.Ctx(ctx).Warn().
+			AnErr("cause", cause).
+			Str("queue", queue).
+			Str("item", item).
+			Str("enqueuedBy", source.Source).
+			Time("enqueuedAt", source.Time).
+			Msg("Failed to process queue item")
+	}
+}
+
+// forgetEnqueueSources deletes the enqueue sources of items in queue that have been processed
+func (d *database) forgetEnqueueSources(ctx context.Context, queue string, items []string) {
+	if !d.annotations || len(items) == 0 {
+		return
+	}
+	if err := d.redis.HDel(ctx, queue+redisEnqueueSourceSuffix, items...).Err(); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("queue", queue).Msg("Failed to delete enqueue sources")
+	}
+}
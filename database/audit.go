@@ -0,0 +1,116 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/logger"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// audit operations
+const (
+	AuditOperationDeleteQueuedUris      = "delete-queued-uris"
+	AuditOperationTimeoutCrawlExecution = "timeout-crawl-execution"
+	AuditOperationUpdateJobExecution    = "update-job-execution"
+)
+
+// audit sinks
+const (
+	AuditSinkNone      = "none"
+	AuditSinkLog       = "log"
+	AuditSinkRethinkDb = "rethinkdb"
+)
+
+// AuditRecord describes a state changing operation performed by a worker
+type AuditRecord struct {
+	Operation string    `rethinkdb:"operation"`
+	Timestamp time.Time `rethinkdb:"timestamp"`
+	Count     int       `rethinkdb:"count"`
+	Ids       []string  `rethinkdb:"ids"`
+}
+
+// Auditor records state changing operations
+type Auditor interface {
+	Audit(ctx context.Context, record AuditRecord) error
+}
+
+// NewAuditor returns an Auditor writing to the named sink
+func NewAuditor(sink string, conn *RethinkDbConnection, table string) (Auditor, error) {
+	switch sink {
+	case AuditSinkNone, "":
+		return noopAuditor{}, nil
+	case AuditSinkLog:
+		return logAuditor{logger: zlog.With().Str("component", "audit").Logger()}, nil
+	case AuditSinkRethinkDb:
+		return &rethinkDbAuditor{conn: conn, table: table}, nil
+	default:
+		return nil, fmt.Errorf("unknown audit sink: %s", sink)
+	}
+}
+
+type noopAuditor struct{}
+
+func (noopAuditor) Audit(context.Context, AuditRecord) error {
+	return nil
+}
+
+// logAuditor writes audit records to the log
+type logAuditor struct {
+	logger zerolog.Logger
+}
+
+func (a logAuditor) Audit(ctx context.Context, record AuditRecord) error {
+	log := a.logger.Hook(logger.TraceHook(ctx))
+	log.Info().
+		Str("operation", record.Operation).
+		Time("timestamp", record.Timestamp).
+		Int("count", record.Count).
+		Strs("ids", record.Ids).
+		Msg("Audit")
+	return nil
+}
+
+// rethinkDbAuditor writes audit records to a RethinkDB table
+type rethinkDbAuditor struct {
+	conn  *RethinkDbConnection
+	table string
+}
+
+func (a *rethinkDbAuditor) Audit(ctx context.Context, record AuditRecord) error {
+	term := r.Table(a.table).Insert(record)
+	_, err := a.conn.execWrite(ctx, "insert-audit-record", &term, 1)
+	return err
+}
+
+// audit records a state changing operation, logging a warning if the record could not be written
+func (d *database) audit(ctx context.Context, operation string, count int, ids ...string) {
+	record := AuditRecord{
+		Operation: operation,
+		Timestamp: d.clock.Now().UTC(),
+		Count:     count,
+		Ids:       ids,
+	}
+	if err := d.auditor.Audit(ctx, record); err != nil {
+		zlog.Ctx(ctx).Warn().Err(err).Str("component", "audit").Str("operation", operation).Msg("Failed to write audit record")
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/clock"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// recordingAuditor keeps the audit records written
+type recordingAuditor struct {
+	records []AuditRecord
+}
+
+func (a *recordingAuditor) Audit(_ context.Context, record AuditRecord) error {
+	a.records = append(a.records, record)
+	return nil
+}
+
+// TestAuditRemovedQueuedUris checks that only the queued uris deleted from RethinkDB are audited
+func TestAuditRemovedQueuedUris(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 3, 1, 10, 30, 0, 0, time.UTC)
+	client, _ := newTestScript(t)
+	conn := NewMockConnection()
+	mock := conn.GetMock()
+	auditor := &recordingAuditor{}
+	db, err := NewDatabase(ctx, client, conn.RethinkDbConnection, Options{Auditor: auditor, Clock: clock.NewFake(now)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RPush(ctx, redisRemoveUriQueue, "u1", "u2").Err(); err != nil {
+		t.Fatal(err)
+	}
+	// u2 was already gone
+	mock.On(r.Table(rethinkDbTableUriQueue).GetAll(r.Args([]string{"u1", "u2"})).Delete(r.DeleteOpts{ReturnChanges: true})).
+		Return([]interface{}{map[string]interface{}{
+			"deleted": 1,
+			"skipped": 1,
+			"changes": []interface{}{map[string]interface{}{"old_val": map[string]interface{}{"id": "u1"}, "new_val": nil}},
+		}}, nil)
+
+	removed, err := db.RemoveFromUriQueue(ctx)
+	if err != nil || removed != 1 {
+		t.Fatalf("RemoveFromUriQueue() = %d, %v, want 1, nil", removed, err)
+	}
+	mock.AssertExpectations(t)
+	if len(auditor.records) != 1 {
+		t.Fatalf("got %d audit records, want 1", len(auditor.records))
+	}
+	record := auditor.records[0]
+	if record.Operation != AuditOperationDeleteQueuedUris || record.Count != 1 || !equalStrings(record.Ids, []string{"u1"}) {
+		t.Errorf("audit record = %+v, want 1 deleted queued uri u1", record)
+	}
+	if !record.Timestamp.Equal(now) {
+		t.Errorf("audit record timestamp = %v, want %v", record.Timestamp, now)
+	}
+}
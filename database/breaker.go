@@ -0,0 +1,137 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrCircuitOpen is returned when a RethinkDB operation is rejected because the circuit breaker is open
+var ErrCircuitOpen = errors.New("rethinkdb circuit breaker is open")
+
+// circuit breaker states, exported as the value of the circuit state metric
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+// circuitBreaker trips after consecutive failed RethinkDB operations and rejects operations
+// until a cooldown has passed, then lets a single probe through (half-open) to decide whether
+// to close or trip again. This avoids hammering a recovering database with retries.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// allow returns true if an operation may be executed
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(circuitHalfOpen)
+		b.probing = true
+		return true
+	case circuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record records the result of an operation that was allowed
+func (b *circuitBreaker) record(err error) {
+	if b == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		if b.state != circuitClosed {
+			log.Info().Str("component", "rethinkdb").Msg("Circuit breaker closed")
+			b.setState(circuitClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		if b.state != circuitOpen {
+			log.Warn().Str("component", "rethinkdb").Err(err).Int("failures", b.failures).Dur("cooldown", b.cooldown).Msg("Circuit breaker opened")
+		}
+		b.openedAt = time.Now()
+		b.setState(circuitOpen)
+	}
+}
+
+// setState sets the state of the breaker. Must be called with b.mu held.
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	metrics.RethinkDbCircuitState.Set(float64(state))
+}
+
+// available returns false if the circuit breaker is open, in which case DB-dependent work should be skipped
+func (b *circuitBreaker) available() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != circuitOpen || time.Since(b.openedAt) >= b.cooldown
+}
+
+// skip reports whether a DB-dependent operation should be skipped because the circuit breaker is open,
+// logging and counting skipped operations
+func (c *RethinkDbConnection) skip(ctx context.Context, operation string) bool {
+	if c.breaker.available() {
+		return false
+	}
+	metrics.RethinkDbCircuitSkips.WithLabelValues(operation).Inc()
+	log.Ctx(ctx).Debug().Str("operation", operation).Msg("Skipping operation while RethinkDB circuit breaker is open")
+	return true
+}
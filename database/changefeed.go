@@ -0,0 +1,108 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// crawlExecutionChange is a change of a crawl execution reported by a changefeed
+type crawlExecutionChange struct {
+	New struct {
+		Id           string `rethinkdb:"id"`
+		DesiredState string `rethinkdb:"desiredState"`
+	} `rethinkdb:"new_val"`
+}
+
+// WatchCrawlExecutions follows the desiredState transitions of crawl executions for the duration
+// of listen and removes the crawl executions that have ended or are being aborted from the
+// running queue, which spares them from being timed out. Returns the number of crawl executions
+// removed.
+//
+// Changes made between calls are missed, in which case the crawl executions are left to be
+// timed out, which leaves them alone if they have ended.
+func (d *database) WatchCrawlExecutions(ctx context.Context, listen time.Duration) (int, error) {
+	if d.rethinkDB.skip(ctx, "watch-crawl-executions") {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, listen)
+	defer cancel()
+
+	term := r.Table(rethinkDbTableCrawlExecutions).Changes().Filter(func(change r.Term) r.Term {
+		old := change.Field("old_val").Default(map[string]interface{}{})
+		desiredState := change.Field("new_val").Field("desiredState").Default("")
+		aborted := desiredState.Ne(old.Field("desiredState").Default("")).
+			And(desiredState.Match("^ABORTED_").Ne(nil))
+		ended := change.Field("new_val").HasFields("endTime").
+			And(old.HasFields("endTime").Not())
+		return change.Field("new_val").Ne(nil).And(aborted.Or(ended))
+	})
+	cursor, err := d.rethinkDB.execChanges(ctx, "watch-crawl-executions", &term)
+	if err != nil {
+		return 0, fmt.Errorf("failed to watch crawl executions: %w", err)
+	}
+	defer func() {
+		_ = cursor.Close()
+	}()
+
+	count := 0
+	var change crawlExecutionChange
+	for cursor.Next(&change) {
+		n, err := d.removeRunningCrawlExecution(ctx, change.New.Id)
+		count += n
+		if err != nil {
+			return count, err
+		}
+		if n > 0 {
+			log.Ctx(ctx).Debug().Str("ceid", change.New.Id).Str("desiredState", change.New.DesiredState).
+				Msg("Removed crawl execution from running queue")
+		}
+	}
+	if err := cursor.Err(); err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, r.ErrQueryTimeout) {
+		return count, fmt.Errorf("failed to watch crawl executions: %w", err)
+	}
+	return count, nil
+}
+
+// removeRunningCrawlExecution removes a crawl execution from the running queue of every key layout
+func (d *database) removeRunningCrawlExecution(ctx context.Context, ceid string) (int, error) {
+	removed := 0
+	for _, k := range d.layouts {
+		if !k.owns(k.crawlExecutionRunningQueue) {
+			continue
+		}
+		if d.dryRun {
+			d.wouldDo(ctx, "remove-running-crawl-execution", k.crawlExecutionRunningQueue, 1)
+			continue
+		}
+		n, err := d.redis.ZRem(ctx, k.crawlExecutionRunningQueue, ceid).Result()
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove %s from %s: %w", ceid, k.crawlExecutionRunningQueue, err)
+		}
+		if n > 0 {
+			dequeued(k.crawlExecutionRunningQueue, DequeueReasonProcessed, int(n))
+		}
+		removed += int(n)
+	}
+	return removed, nil
+}
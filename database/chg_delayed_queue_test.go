@@ -0,0 +1,214 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/clock"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/lua"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	testFromQueue = "from{chg}"
+	testToQueue   = "to{chg}"
+)
+
+type zMember struct {
+	member string
+	score  float64
+}
+
+func TestChgDelayedQueueScript(t *testing.T) {
+	const now = 1000
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		from      []zMember // members added to the from queue, in order
+		to        []string  // items already present in the to queue
+		wantMoved int
+		wantFrom  []string
+		wantTo    []string
+	}{
+		{
+			name:      "empty queue",
+			wantMoved: 0,
+		},
+		{
+			name:      "all members due",
+			from:      []zMember{{"a", 1}, {"b", 2}, {"c", now - 1}},
+			wantMoved: 3,
+			wantTo:    []string{"a", "b", "c"},
+		},
+		{
+			name:      "score equal to current time is moved",
+			from:      []zMember{{"a", now}},
+			wantMoved: 1,
+			wantTo:    []string{"a"},
+		},
+		{
+			name:      "score after current time is not moved",
+			from:      []zMember{{"a", now + 1}},
+			wantMoved: 0,
+			wantFrom:  []string{"a"},
+		},
+		{
+			name:      "only due members are moved in score order",
+			from:      []zMember{{"late", now + 1}, {"b", 20}, {"a", 10}},
+			wantMoved: 2,
+			wantFrom:  []string{"late"},
+			wantTo:    []string{"a", "b"},
+		},
+		{
+			name:      "duplicate member uses latest score",
+			from:      []zMember{{"a", 1}, {"a", now + 1}},
+			wantMoved: 0,
+			wantFrom:  []string{"a"},
+		},
+		{
+			name:      "moved members are appended to existing items",
+			from:      []zMember{{"a", 1}},
+			to:        []string{"a", "x"},
+			wantMoved: 1,
+			wantTo:    []string{"a", "x", "a"},
+		},
+	}
+
+	// the non-atomic implementations must move the same members as the script
+	implementations := map[string]func(client *redis.Client, script *redis.Script) (int, error){
+		"script": func(client *redis.Client, script *redis.Script) (int, error) {
+			return script.Run(ctx, client, []string{testFromQueue, testToQueue}, now).Int()
+		},
+		"fallback": func(client *redis.Client, _ *redis.Script) (int, error) {
+			return moveDue(ctx, client, testFromQueue, testToQueue, now)
+		},
+		"across-slots": func(client *redis.Client, _ *redis.Script) (int, error) {
+			return moveDueAcrossSlots(ctx, client, testFromQueue, testToQueue, now)
+		},
+	}
+
+	for impl, move := range implementations {
+		for _, tt := range tests {
+			t.Run(impl+"/"+tt.name, func(t *testing.T) {
+				client, script := newTestScript(t)
+
+				for _, m := range tt.from {
+					if err := client.ZAdd(ctx, testFromQueue, redis.Z{Score: m.score, Member: m.member}).Err(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				for _, item := range tt.to {
+					if err := client.RPush(ctx, testToQueue, item).Err(); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				moved, err := move(client, script)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if moved != tt.wantMoved {
+					t.Errorf("moved = %d, want %d", moved, tt.wantMoved)
+				}
+
+				from, err := client.ZRange(ctx, testFromQueue, 0, -1).Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !equalStrings(from, tt.wantFrom) {
+					t.Errorf("from queue = %v, want %v", from, tt.wantFrom)
+				}
+
+				to, err := client.LRange(ctx, testToQueue, 0, -1).Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !equalStrings(to, tt.wantTo) {
+					t.Errorf("to queue = %v, want %v", to, tt.wantTo)
+				}
+			})
+		}
+	}
+}
+
+// newTestScript starts a miniredis server and loads the chg delayed queue script into it.
+func newTestScript(t *testing.T) (*redis.Client, *redis.Script) {
+	t.Helper()
+
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	script, err := loadRedisScript(context.Background(), client, lua.Scripts, redisChgDelayedQueueScriptName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, script
+}
+
+// equalStrings reports whether a and b hold the same strings in the same order, treating nil and empty as equal.
+func equalStrings(a, b []string) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestMoveWaitToReadyFakeClock(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestScript(t)
+	now := time.Unix(1000, 0)
+	fake := clock.NewFake(now)
+	db, err := NewDatabase(ctx, client, nil, Options{ScriptPath: filepath.Join("..", "lua"), Clock: fake})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	due := float64(now.Add(time.Second).UnixNano() / int64(time.Millisecond))
+	if err := client.ZAdd(ctx, redisWaitQueue, redis.Z{Score: due, Member: "chg"}).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if moved, err := db.MoveWaitToReady(ctx); err != nil || moved != 0 {
+		t.Fatalf("MoveWaitToReady() before due = %d, %v, want 0, nil", moved, err)
+	}
+	fake.Advance(time.Second)
+	if moved, err := db.MoveWaitToReady(ctx); err != nil || moved != 1 {
+		t.Fatalf("MoveWaitToReady() when due = %d, %v, want 1, nil", moved, err)
+	}
+	ready, err := client.LRange(ctx, redisReadyQueue, 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(ready, []string{"chg"}) {
+		t.Errorf("ready queue = %v, want [chg]", ready)
+	}
+}
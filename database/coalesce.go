@@ -0,0 +1,181 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// pendingWrite is a write waiting to be flushed by a writeCoalescer
+type pendingWrite struct {
+	ctx    context.Context
+	name   string
+	term   r.Term
+	result chan writeResult
+}
+
+type writeResult struct {
+	writeResponse r.WriteResponse
+	err           error
+}
+
+// writeCoalescer batches small writes submitted by different workers within a window
+// into a single RethinkDB query, trading latency for fewer round trips.
+type writeCoalescer struct {
+	conn     *RethinkDbConnection
+	window   time.Duration
+	maxBatch int
+
+	mu      sync.Mutex
+	pending []*pendingWrite
+	timer   *time.Timer
+}
+
+func newWriteCoalescer(conn *RethinkDbConnection, window time.Duration, maxBatch int) *writeCoalescer {
+	return &writeCoalescer{
+		conn:     conn,
+		window:   window,
+		maxBatch: maxBatch,
+	}
+}
+
+// write submits term to the current batch and waits until the batch has been flushed or ctx
+// is done. A write whose ctx is done before its batch is flushed is dropped from the batch.
+func (c *writeCoalescer) write(ctx context.Context, term r.Term, name string) (r.WriteResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return r.WriteResponse{}, err
+	}
+	w := &pendingWrite{
+		ctx:    ctx,
+		name:   name,
+		term:   term,
+		result: make(chan writeResult, 1),
+	}
+
+	c.mu.Lock()
+	c.pending = append(c.pending, w)
+	if len(c.pending) >= c.maxBatch {
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		batch := c.take()
+		c.mu.Unlock()
+		go c.flush(batch)
+	} else {
+		if len(c.pending) == 1 {
+			c.timer = time.AfterFunc(c.window, func() {
+				c.mu.Lock()
+				batch := c.take()
+				c.mu.Unlock()
+				c.flush(batch)
+			})
+		}
+		c.mu.Unlock()
+	}
+
+	select {
+	case result := <-w.result:
+		return result.writeResponse, result.err
+	case <-ctx.Done():
+		return r.WriteResponse{}, ctx.Err()
+	}
+}
+
+// take returns the pending writes and starts a new batch. Must be called with c.mu held.
+func (c *writeCoalescer) take() []*pendingWrite {
+	batch := c.pending
+	c.pending = nil
+	c.timer = nil
+	return batch
+}
+
+// flush executes a batch of writes as one query and hands each write its own response
+func (c *writeCoalescer) flush(batch []*pendingWrite) {
+	live := batch[:0]
+	for _, w := range batch {
+		if err := w.ctx.Err(); err != nil {
+			w.result <- writeResult{err: err}
+			continue
+		}
+		live = append(live, w)
+	}
+	batch = live
+	if len(batch) == 0 {
+		return
+	}
+	if len(batch) == 1 {
+		w := batch[0]
+		wr, err := c.conn.execWrite(w.ctx, w.name, &w.term, 1)
+		w.result <- writeResult{writeResponse: wr, err: err}
+		return
+	}
+
+	terms := make([]r.Term, len(batch))
+	for i, w := range batch {
+		terms[i] = w.term
+	}
+	ctx, cancel := batchContext(batch)
+	defer cancel()
+	responses, err := c.conn.execWriteBatch(ctx, "coalesced-write", terms)
+	for i, w := range batch {
+		if err != nil {
+			w.result <- writeResult{err: err}
+			continue
+		}
+		wr := responses[i]
+		var writeErr error
+		if wr.Errors > 0 {
+			writeErr = errors.New(wr.FirstError)
+		}
+		w.result <- writeResult{writeResponse: wr, err: writeErr}
+	}
+}
+
+// batchContext returns the context a batch of writes is executed with. It carries the logger of
+// the first write, has the earliest deadline of the writes and is cancelled when every write is.
+func batchContext(batch []*pendingWrite) (context.Context, context.CancelFunc) {
+	ctx := log.Ctx(batch[0].ctx).WithContext(context.Background())
+	var deadline time.Time
+	for _, w := range batch {
+		if d, ok := w.ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+			deadline = d
+		}
+	}
+	var cancel context.CancelFunc
+	if deadline.IsZero() {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+	go func() {
+		for _, w := range batch {
+			select {
+			case <-w.ctx.Done():
+			case <-ctx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
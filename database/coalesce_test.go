@@ -0,0 +1,53 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBatchContext(t *testing.T) {
+	now := time.Now()
+	early, cancelEarly := context.WithDeadline(context.Background(), now.Add(time.Minute))
+	defer cancelEarly()
+	late, cancelLate := context.WithDeadline(context.Background(), now.Add(time.Hour))
+	defer cancelLate()
+	none, cancelNone := context.WithCancel(context.Background())
+	defer cancelNone()
+
+	ctx, cancel := batchContext([]*pendingWrite{{ctx: late}, {ctx: none}, {ctx: early}})
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || !deadline.Equal(now.Add(time.Minute)) {
+		t.Errorf("batch deadline = %v, %v, want %v", deadline, ok, now.Add(time.Minute))
+	}
+
+	cancelEarly()
+	cancelNone()
+	select {
+	case <-ctx.Done():
+		t.Fatal("batch cancelled while a write is still waiting")
+	case <-time.After(10 * time.Millisecond):
+	}
+	cancelLate()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("batch not cancelled when every write is cancelled")
+	}
+}
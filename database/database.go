@@ -18,25 +18,68 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"path/filepath"
+	"io/fs"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-redis/redis"
 	frontierV1 "github.com/nlnwa/veidemann-api/go/frontier/v1"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/clock"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/lua"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/reconciler"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
 	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
 )
 
 // Database is an abstraction layer between the business layer and database implementation details
 type Database interface {
 	UpdateJobExecutions(ctx context.Context) (int, error)
+	ExpireJobExecutions(ctx context.Context, ttl time.Duration) (int, error)
+	SyncTables(ctx context.Context) (int, error)
 	RemoveFromUriQueue(ctx context.Context) (int, error)
-	MoveWaitToReady() (int, error)
-	MoveBusyToTimeout() (int, error)
-	MoveRunningToTimeout() (int, error)
+	RecoverRemoveUriQueue(ctx context.Context) (int, error)
+	WaitForRemoveUriQueue(ctx context.Context, timeout time.Duration) (bool, error)
+	MoveWaitToReady(ctx context.Context) (int, error)
+	MoveBusyToTimeout(ctx context.Context) (int, error)
+	MoveRunningToTimeout(ctx context.Context) (int, error)
 	TimeoutCrawlExecutions(ctx context.Context) (int, error)
+	WatchCrawlExecutions(ctx context.Context, listen time.Duration) (int, error)
+	ReadyQueueLength(ctx context.Context) (int64, error)
+	QueueLengths(ctx context.Context) (map[string]int64, error)
+	PeekQueue(ctx context.Context, name string, count int) ([]QueueItem, error)
+	LagSample(ctx context.Context) (LagSample, error)
+	JobExecutionSnapshot(ctx context.Context) ([]*frontierV1.JobExecutionStatus, error)
+	ScriptShas() map[string]string
+	Takedown(ctx context.Context, request TakedownRequest) (TakedownRecord, error)
+	TakedownStatus(ctx context.Context, id string) (TakedownRecord, error)
+	QueuePosition(ctx context.Context, request QueuePositionRequest) (QueuePosition, error)
+	CrawlHostGroupStates(ctx context.Context, id string) ([]CrawlHostGroupState, error)
+	EndedRunningCrawlExecutions() reconciler.Reconciler
+}
+
+// LagSample holds the queue state used to compute frontier queue lag
+type LagSample struct {
+	// OldestWaitDeadline is when the first crawl host group in the wait queue is due, zero if the wait queue is empty
+	OldestWaitDeadline time.Time
+	// TimeoutQueueLength is the number of crawl host groups and crawl executions waiting to be timed out
+	TimeoutQueueLength int64
+	// RemoveUriQueueLength is the number of queued uris waiting to be removed
+	RemoveUriQueueLength int64
+}
+
+// ErrUnknownQueue is returned when a queue is not found
+var ErrUnknownQueue = errors.New("unknown queue")
+
+// QueueItem is an item in a queue. Items in delayed queues have a score
+// which is the time in milliseconds since epoch when they are due.
+type QueueItem struct {
+	Value string  `json:"value"`
+	Score float64 `json:"score,omitempty"`
 }
 
 // rethinkdb constants
@@ -50,7 +93,10 @@ const (
 const (
 	redisChgDelayedQueueScriptName = "chg_delayed_queue.lua"
 
-	redisRemoveUriQueue     = "REMURI"
+	redisRemoveUriQueue = "REMURI"
+	// redisRemoveUriHighQueue is a high priority lane of the REMURI queue for interactive deletions
+	// (e.g. by operators or takedown requests) that must not queue behind bulk crawl teardown
+	redisRemoveUriHighQueue = "REMURI_HIGH"
 	redisJobExecutionPrefix = "JEID:"
 
 	redisWaitQueue    = "chg_wait{chg}"
@@ -60,48 +106,523 @@ const (
 
 	redisCrawlExecutionRunningQueue = "ceid_running"
 	redisCrawlExecutionTimeoutQueue = "ceid_timeout"
+
+	// redisCrawlExecutionAbortedStream is a stream of events about aborted crawl executions
+	redisCrawlExecutionAbortedStream = "ceid_aborted"
+	// redisCrawlExecutionAbortedStreamMaxLen is the approximate max length of the aborted crawl execution stream
+	redisCrawlExecutionAbortedStreamMaxLen = 10000
 )
 
+// crawlExecutionTimeoutBatchSize is the max number of crawl executions popped from the timeout queue and
+// updated per query
+const crawlExecutionTimeoutBatchSize = 100
+
+// RemoveUriQueueBatchSize is the max number of uri ids removed per pass over the REMURI queue
+// unless another batch size is set on the context (see WithBatchSize)
+const RemoveUriQueueBatchSize = 10000
+
+// MaxRemoveUriQueueBatchSize is the max number of uri ids removed per pass over the REMURI queue, which
+// is the RethinkDB array size limit since the uri ids of a batch are deleted in a single query
+const MaxRemoveUriQueueBatchSize = 100000
+
+// Options configures a Database
+type Options struct {
+	// ScriptPath is the path to a directory holding redis lua scripts that override the
+	// bundled ones (optional)
+	ScriptPath string
+	// Owner identifies this instance in the keys of its in-flight lists (see RecoverRemoveUriQueue)
+	Owner string
+	// Auditor records state changing operations (optional)
+	Auditor Auditor
+	// Replication configures checking of redis replication after queue operations
+	Replication ReplicationOptions
+	// KeyMapping configures remapping of redis key names
+	KeyMapping KeyMappingOptions
+	// KeyPrefix is prepended to the names of the queue and JEID keys, after any key mapping, so
+	// that several environments can share a redis
+	KeyPrefix string
+	// JobExecutionCache enables client side caching of the JEID hashes so that only job
+	// execution stats that have changed are written to RethinkDB (not supported in cluster mode)
+	JobExecutionCache bool
+	// ChgShards is the number of shards chg_wait{chg0}..chg_wait{chgN-1} etc. the crawl host
+	// group queues are spread over (0 for the unsharded queues)
+	ChgShards int
+	// EnqueueSources enables reading the companion hashes recording the enqueue source of queue items
+	EnqueueSources bool
+	// TakedownTable is the RethinkDB table takedown records are stored in
+	TakedownTable string
+	// JobThrottle configures fair removal of queued uris across job executions
+	JobThrottle JobThrottleOptions
+	// RemoveUriStream configures consuming the remove queue as a Redis Stream
+	RemoveUriStream RemoveUriStreamOptions
+	// ScriptVerification is how a mismatch between the redis lua scripts and the scripts bundled at
+	// build time is handled, available values are none, warn and enforce
+	ScriptVerification string
+	// ScriptEval runs the delayed queue script with EVAL instead of loading it with SCRIPT LOAD and
+	// running it with EVALSHA, for redis services that don't permit SCRIPT commands. It is enabled
+	// automatically if loading the script is denied.
+	ScriptEval bool
+	// ScriptFallback configures falling back to a non-atomic implementation of the delayed queue script
+	ScriptFallback ScriptFallbackOptions
+	// LMPop pops the crawl execution timeout queues of all key layouts with a single LMPOP, which
+	// requires Redis 7, instead of one LPOP per queue. In a cluster only queues sharing a hash tag
+	// are popped together.
+	LMPop bool
+	// DryRun makes queue operations compute what they would do without writing to Redis or RethinkDB
+	DryRun bool
+	// Clock tells when delayed queue items are due (defaults to the wall clock)
+	Clock clock.Clock
+}
+
 type database struct {
 	// rethinkdb
 	rethinkDB *RethinkDbConnection
 	// redis
-	redis      *redis.Client
+	redis      redis.UniversalClient
 	moveScript *redis.Script
+	// scriptEval runs moveScript with EVAL (see Options.ScriptEval)
+	scriptEval bool
+	// moveFallback replaces moveScript while it can't be run (nil if disabled)
+	moveFallback *scriptFallback
+	layouts      []keys
+	// chgLayouts are the layouts of the sharded crawl host group queues
+	chgLayouts []keys
+	// annotations enables use of enqueue source annotations
+	annotations bool
+	// audit
+	auditor Auditor
+	// replication
+	replication *replicationChecker
+	// takedowns
+	takedownTable string
+	// jobThrottle configures fair removal of queued uris across job executions
+	jobThrottle JobThrottleOptions
+	// removeUriStream configures consuming the remove stream
+	removeUriStream RemoveUriStreamOptions
+	// streamGroups holds the names of the streams whose consumer group is known to exist
+	streamGroups sync.Map
+	// jobExecutionCache tracks changes to the JEID hashes (nil if disabled)
+	jobExecutionCache *jobExecutionCache
+	// owner identifies this instance in the keys of its in-flight lists
+	owner string
+	// lmpop pops several crawl execution timeout queues with one command (see Options.LMPop)
+	lmpop bool
+	// dryRun disables writes (see wouldDo)
+	dryRun bool
+	clock  clock.Clock
 }
 
-func NewDatabase(redisClient *redis.Client, conn *RethinkDbConnection, scriptPath string) (Database, error) {
-	moveScript, err := loadRedisScript(redisClient, filepath.Join(scriptPath, redisChgDelayedQueueScriptName))
+func NewDatabase(ctx context.Context, redisClient redis.UniversalClient, conn *RethinkDbConnection, opts Options) (Database, error) {
+	var scripts fs.FS = lua.Scripts
+	if opts.ScriptPath != "" {
+		scripts = os.DirFS(opts.ScriptPath)
+	}
+	scriptEval := opts.ScriptEval
+	var moveScript *redis.Script
+	var err error
+	if !scriptEval {
+		moveScript, err = loadRedisScript(ctx, redisClient, scripts, redisChgDelayedQueueScriptName)
+		if isScriptCommandDenied(err) {
+			log.Warn().Err(err).Str("component", "redis").Msg("Not permitted to load redis lua scripts, running them with EVAL")
+			scriptEval = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if scriptEval {
+		moveScript, err = readRedisScript(scripts, redisChgDelayedQueueScriptName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := verifyScript(opts.ScriptVerification, redisChgDelayedQueueScriptName, moveScript); err != nil {
+		return nil, err
+	}
+
+	auditor := opts.Auditor
+	if auditor == nil {
+		auditor = noopAuditor{}
+	}
+
+	replication, err := newReplicationChecker(redisClient, opts.Replication)
 	if err != nil {
 		return nil, err
 	}
 
+	layouts, err := keyLayouts(opts.KeyMapping, opts.KeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var jobExecutionCache *jobExecutionCache
+	if opts.JobExecutionCache && !opts.DryRun {
+		var prefixes []string
+		seen := make(map[string]bool)
+		for _, k := range layouts {
+			if !seen[k.jobExecutionPrefix] {
+				seen[k.jobExecutionPrefix] = true
+				prefixes = append(prefixes, k.jobExecutionPrefix)
+			}
+		}
+		jobExecutionCache, err = newJobExecutionCache(ctx, redisClient, prefixes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &database{
-		redis:      redisClient,
-		rethinkDB:  conn,
-		moveScript: moveScript,
+		redis:        redisClient,
+		rethinkDB:    conn,
+		moveScript:   moveScript,
+		scriptEval:   scriptEval,
+		moveFallback: newScriptFallback(opts.ScriptFallback),
+		layouts:      layouts,
+		chgLayouts:   chgShardLayouts(layouts, opts.ChgShards),
+		annotations:  opts.EnqueueSources,
+		auditor:      auditor,
+		replication:  replication,
+
+		takedownTable:     opts.TakedownTable,
+		jobThrottle:       opts.JobThrottle,
+		removeUriStream:   opts.RemoveUriStream,
+		jobExecutionCache: jobExecutionCache,
+		owner:             opts.Owner,
+		lmpop:             opts.LMPop,
+		dryRun:            opts.DryRun,
+		clock:             clock.OrReal(opts.Clock),
 	}, nil
 }
 
-func (d *database) moveChg(fromQueue string, toQueue string) (int, error) {
-	return d.moveScript.Run(d.redis, []string{fromQueue, toQueue}, time.Now().UTC().UnixNano()/int64(time.Millisecond)).Int()
+// ScriptShas returns the SHA1 digest of each redis lua script by script name
+func (d *database) ScriptShas() map[string]string {
+	return map[string]string{
+		redisChgDelayedQueueScriptName: d.moveScript.Hash(),
+	}
+}
+
+// moveChg runs the delayed queue script unless ctx is done. The non-atomic fallback is run
+// instead while the script can't be run, if enabled, and queues in different slots of a
+// cluster are moved between without atomicity.
+func (d *database) moveChg(ctx context.Context, fromQueue string, toQueue string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	now := d.clock.Now().UTC().UnixNano() / int64(time.Millisecond)
+	if d.dryRun {
+		due, err := d.redis.ZCount(ctx, fromQueue, "0", strconv.FormatInt(now, 10)).Result()
+		d.wouldDo(ctx, "move-chg", fromQueue, int(due))
+		return 0, err
+	}
+	var moved int
+	var err error
+	switch {
+	case isCluster(d.redis) && !sameSlot(fromQueue, toQueue):
+		// the script and transactions can't span the slots of both queues
+		moved, err = moveDueAcrossSlots(ctx, d.redis, fromQueue, toQueue, now)
+	case d.moveFallback.degraded():
+		moved, err = moveDue(ctx, d.redis, fromQueue, toQueue, now)
+	default:
+		if d.scriptEval {
+			moved, err = d.moveScript.Eval(ctx, d.redis, []string{fromQueue, toQueue}, now).Int()
+		} else {
+			moved, err = d.moveScript.Run(ctx, d.redis, []string{fromQueue, toQueue}, now).Int()
+		}
+		if d.moveFallback.record(err) {
+			moved, err = moveDue(ctx, d.redis, fromQueue, toQueue, now)
+		}
+	}
+	if err == nil && moved > 0 {
+		dequeued(fromQueue, DequeueReasonProcessed, moved)
+		d.replication.check(ctx, "move-"+fromQueue)
+	}
+	return moved, err
+}
+
+// forEachLayout calls fn with each key layout until ctx is done and returns the sum of the counts returned
+func (d *database) forEachLayout(ctx context.Context, fn func(k keys) (int, error)) (int, error) {
+	return forEachKeys(ctx, d.layouts, fn)
+}
+
+// forEachChgLayout calls fn for each key layout of the crawl host group queues (see ChgShards)
+func (d *database) forEachChgLayout(ctx context.Context, fn func(k keys) (int, error)) (int, error) {
+	return forEachKeys(ctx, d.chgLayouts, fn)
+}
+
+func forEachKeys(ctx context.Context, layouts []keys, fn func(k keys) (int, error)) (int, error) {
+	count := 0
+	for _, k := range layouts {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		n, err := fn(k)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
 }
 
-func (d *database) MoveWaitToReady() (int, error) {
-	return d.moveChg(redisWaitQueue, redisReadyQueue)
+func (d *database) MoveWaitToReady(ctx context.Context) (int, error) {
+	return d.forEachChgLayout(ctx, func(k keys) (int, error) {
+		if !k.owns(k.waitQueue) {
+			return 0, nil
+		}
+		return d.moveChg(ctx, k.waitQueue, k.readyQueue)
+	})
 }
 
-func (d *database) MoveBusyToTimeout() (int, error) {
-	return d.moveChg(redisBusyQueue, redisTimeoutQueue)
+func (d *database) MoveBusyToTimeout(ctx context.Context) (int, error) {
+	return d.forEachChgLayout(ctx, func(k keys) (int, error) {
+		if !k.owns(k.busyQueue) {
+			return 0, nil
+		}
+		return d.moveChg(ctx, k.busyQueue, k.timeoutQueue)
+	})
 }
 
-func (d *database) MoveRunningToTimeout() (int, error) {
-	return d.moveChg(redisCrawlExecutionRunningQueue, redisCrawlExecutionTimeoutQueue)
+func (d *database) MoveRunningToTimeout(ctx context.Context) (int, error) {
+	return d.forEachLayout(ctx, func(k keys) (int, error) {
+		if !k.owns(k.crawlExecutionRunningQueue) {
+			return 0, nil
+		}
+		return d.moveChg(ctx, k.crawlExecutionRunningQueue, k.crawlExecutionTimeoutQueue)
+	})
+}
+
+func (d *database) ReadyQueueLength(ctx context.Context) (int64, error) {
+	var length int64
+	for _, k := range d.chgLayouts {
+		if !k.owns(k.readyQueue) {
+			continue
+		}
+		n, err := d.redis.LLen(ctx, k.readyQueue).Result()
+		if err != nil {
+			return length, err
+		}
+		length += n
+	}
+	return length, nil
 }
 
+// QueueLengths returns the length of every queue by key name
+func (d *database) QueueLengths(ctx context.Context) (map[string]int64, error) {
+	pipe := d.redis.Pipeline()
+	cmds := make(map[string]*redis.IntCmd)
+	for _, k := range d.chgLayouts {
+		for _, list := range []string{k.readyQueue, k.timeoutQueue} {
+			cmds[list] = pipe.LLen(ctx, list)
+		}
+		for _, zset := range []string{k.waitQueue, k.busyQueue} {
+			cmds[zset] = pipe.ZCard(ctx, zset)
+		}
+	}
+	for _, k := range d.layouts {
+		for _, list := range []string{k.removeUriHighQueue, k.removeUriQueue, k.crawlExecutionTimeoutQueue} {
+			cmds[list] = pipe.LLen(ctx, list)
+		}
+		cmds[k.crawlExecutionRunningQueue] = pipe.ZCard(ctx, k.crawlExecutionRunningQueue)
+		if d.removeUriStream.Enabled {
+			cmds[k.removeUriStream] = pipe.XLen(ctx, k.removeUriStream)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	lengths := make(map[string]int64, len(cmds))
+	for name, cmd := range cmds {
+		lengths[name] = cmd.Val()
+	}
+	return lengths, nil
+}
+
+// PeekQueue returns up to count items from the head of the named queue
+func (d *database) PeekQueue(ctx context.Context, name string, count int) ([]QueueItem, error) {
+	rc := d.redis
+	// the layouts of the crawl host group queues hold the names of the other queues as well
+	for _, k := range d.chgLayouts {
+		switch name {
+		case k.removeUriHighQueue, k.removeUriQueue, k.readyQueue, k.timeoutQueue, k.crawlExecutionTimeoutQueue:
+			values, err := rc.LRange(ctx, name, 0, int64(count-1)).Result()
+			if err != nil {
+				return nil, err
+			}
+			items := make([]QueueItem, 0, len(values))
+			for _, value := range values {
+				items = append(items, QueueItem{Value: value})
+			}
+			return items, nil
+		case k.waitQueue, k.busyQueue, k.crawlExecutionRunningQueue:
+			zs, err := rc.ZRangeWithScores(ctx, name, 0, int64(count-1)).Result()
+			if err != nil {
+				return nil, err
+			}
+			items := make([]QueueItem, 0, len(zs))
+			for _, z := range zs {
+				items = append(items, QueueItem{Value: fmt.Sprint(z.Member), Score: z.Score})
+			}
+			return items, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownQueue, name)
+}
+
+// LagSample samples the queue state used to compute frontier queue lag
+func (d *database) LagSample(ctx context.Context) (LagSample, error) {
+	var sample LagSample
+	// llen returns the length of queue if k owns it, and zero otherwise
+	llen := func(pipe redis.Pipeliner, k keys, queue string) *redis.IntCmd {
+		if !k.owns(queue) {
+			return redis.NewIntResult(0, nil)
+		}
+		return pipe.LLen(ctx, queue)
+	}
+	for _, k := range d.chgLayouts {
+		pipe := d.redis.Pipeline()
+		oldest := pipe.ZRangeWithScores(ctx, k.waitQueue, 0, 0)
+		chgTimeouts := llen(pipe, k, k.timeoutQueue)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return sample, err
+		}
+		if zs := oldest.Val(); len(zs) > 0 {
+			deadline := time.Unix(0, int64(zs[0].Score)*int64(time.Millisecond))
+			if sample.OldestWaitDeadline.IsZero() || deadline.Before(sample.OldestWaitDeadline) {
+				sample.OldestWaitDeadline = deadline
+			}
+		}
+		sample.TimeoutQueueLength += chgTimeouts.Val()
+	}
+	for _, k := range d.layouts {
+		pipe := d.redis.Pipeline()
+		ceidTimeouts := llen(pipe, k, k.crawlExecutionTimeoutQueue)
+		remUris := llen(pipe, k, k.removeUriQueue)
+		remUrisHigh := llen(pipe, k, k.removeUriHighQueue)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return sample, err
+		}
+		sample.TimeoutQueueLength += ceidTimeouts.Val()
+		sample.RemoveUriQueueLength += remUris.Val() + remUrisHigh.Val()
+	}
+	return sample, nil
+}
+
+// RemoveFromUriQueue removes queued uris in the high priority lane of the REMURI queue before
+// those in the normal lane and, if enabled, the remove stream. The other lanes are not
+// consumed while the high priority lane has a full batch.
 func (d *database) RemoveFromUriQueue(ctx context.Context) (int, error) {
-	// Get up to 10000 uriIds from redis REMURI queue
-	uriIds, err := d.redis.LRange(redisRemoveUriQueue, 0, 9999).Result()
+	if d.rethinkDB.skip(ctx, "remove-from-uri-queue") {
+		return 0, nil
+	}
+	return d.forEachLayout(ctx, func(k keys) (int, error) {
+		removed := 0
+		if k.owns(k.removeUriHighQueue) {
+			n, err := d.removeFromUriQueue(ctx, k.removeUriHighQueue)
+			removed += n
+			if err != nil || removed >= batchSizeFromContext(ctx) {
+				return removed, err
+			}
+		}
+		if k.owns(k.removeUriQueue) {
+			n, err := d.removeFromUriQueue(ctx, k.removeUriQueue)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		}
+		if !d.removeUriStream.Enabled || !k.owns(k.removeUriStream) {
+			return removed, nil
+		}
+		n, err := d.removeFromUriStream(ctx, k.removeUriStream)
+		return removed + n, err
+	})
+}
+
+// removeUriWaitSlice is how long WaitForRemoveUriQueue blocks on one remove queue at a time
+const removeUriWaitSlice = time.Second
+
+// WaitForRemoveUriQueue blocks until there are queued uris to be removed or timeout and reports
+// whether there are queued uris to be removed.
+//
+// The normal lane of the first key layout is blocked on with BLMOVE from its head onto its head,
+// which leaves the list unchanged, for removeUriWaitSlice at a time. The other lanes and layouts
+// are checked between the slices, so uris queued there are noticed within a slice.
+func (d *database) WaitForRemoveUriQueue(ctx context.Context, timeout time.Duration) (bool, error) {
+	var queues []string
+	for _, k := range d.layouts {
+		for _, queue := range []string{k.removeUriHighQueue, k.removeUriQueue} {
+			if k.owns(queue) {
+				queues = append(queues, queue)
+			}
+		}
+	}
+	blockOn := d.layouts[0].removeUriQueue
+	deadline := time.Now().Add(timeout)
+	for {
+		queued, err := d.anyQueued(ctx, queues)
+		if err != nil || queued {
+			return queued, err
+		}
+		if !time.Now().Before(deadline) {
+			return false, nil
+		}
+		err = d.redis.BLMove(ctx, blockOn, blockOn, "LEFT", "LEFT", removeUriWaitSlice).Err()
+		if err == nil {
+			return true, nil
+		} else if err != redis.Nil {
+			return false, err
+		}
+	}
+}
+
+// anyQueued reports whether any of the given lists are non-empty
+func (d *database) anyQueued(ctx context.Context, lists []string) (bool, error) {
+	pipe := d.redis.Pipeline()
+	lengths := make([]*redis.IntCmd, len(lists))
+	for i, list := range lists {
+		lengths[i] = pipe.LLen(ctx, list)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	for _, n := range lengths {
+		if n.Val() > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeBatch returns a batch of uri ids from the remove queue. The queue is read ahead to
+// select a batch that is fair across job executions and that only holds uri ids belonging
+// to the partition of ctx.
+func (d *database) removeBatch(ctx context.Context, queue string) ([]string, error) {
+	p := partitionFromContext(ctx)
+	size := batchSizeFromContext(ctx)
+	uriIds, err := d.redis.LRange(ctx, queue, 0, int64(d.removeWindow(ctx)-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	uriIds = p.filter(uriIds)
+	if d.jobThrottle.Enabled && len(uriIds) > 0 {
+		return d.fairBatch(ctx, queue, uriIds)
+	}
+	if len(uriIds) > size {
+		uriIds = uriIds[:size]
+	}
+	return uriIds, nil
+}
+
+// removeWindow returns the number of items at the head of the remove queue a batch is selected from
+func (d *database) removeWindow(ctx context.Context) int {
+	window := batchSizeFromContext(ctx) * partitionFromContext(ctx).count
+	if d.jobThrottle.Enabled && d.jobThrottle.Lookahead > 1 {
+		window *= d.jobThrottle.Lookahead
+	}
+	return window
+}
+
+func (d *database) removeFromUriQueue(ctx context.Context, queue string) (int, error) {
+	uriIds, err := d.removeBatch(ctx, queue)
 	if err != nil {
 		return 0, fmt.Errorf("failed to get list of uriIds to be removed: %w", err)
 	}
@@ -109,94 +630,250 @@ func (d *database) RemoveFromUriQueue(ctx context.Context) (int, error) {
 		return 0, nil
 	}
 
-	// Delete from rethinkdb table uri_queue
-	removed, err := removeQueuedUris(d.rethinkDB, ctx, uriIds)
+	if deferred, err := d.deferUriQueueRemoval(ctx, len(uriIds)); err != nil || deferred {
+		return 0, err
+	}
+
+	if d.dryRun {
+		d.wouldDo(ctx, "delete-queued-uris", queue, len(uriIds))
+		return 0, nil
+	}
+
+	// Move to an in-flight list before deleting from rethinkdb table uri_queue so that the batch is
+	// recovered if the process dies before it is processed
+	f := newInflight(ctx, queue, d.owner)
+	uriIds, err = f.claim(ctx, d.redis, d.clock.Now(), d.removeWindow(ctx), uriIds)
 	if err != nil {
+		return 0, fmt.Errorf("failed to move queued uri ids from %s to in-flight list: %w", queue, err)
+	}
+	if len(uriIds) == 0 {
+		return 0, nil
+	}
+
+	removed, err := d.removeQueuedUris(ctx, uriIds)
+	if err != nil {
+		d.logEnqueueSources(ctx, queue, uriIds, err)
+		if _, abortErr := f.abort(ctx, d.redis); abortErr != nil {
+			return removed, fmt.Errorf("removed %d of %d queued uris: %v: %w: failed to return in-flight uri ids to %s (recovered at restart)", removed, len(uriIds), err, abortErr, queue)
+		}
 		return removed, fmt.Errorf("removed %d of %d queued uris: %w", removed, len(uriIds), err)
 	}
 
-	if err := deleteFromRemoveQueue(d.redis, uriIds); err != nil {
-		return removed, fmt.Errorf("failed to remove some queued uri ids from REMURI: %w", err)
+	countRemoveQueueDequeued(queue, uriIds, removed, len(uriIds))
+	if err := f.done(ctx, d.redis); err != nil {
+		return removed, fmt.Errorf("failed to discard in-flight list of %s: %w", queue, err)
 	}
+	d.forgetEnqueueSources(ctx, queue, uriIds)
+	d.forgetJobExecutions(ctx, queue, uriIds)
+	d.replication.check(ctx, "delete-from-remove-queue")
 	return removed, nil
 }
 
-func removeQueuedUris(rethinkDB *RethinkDbConnection, ctx context.Context, uriIds []string) (int, error) {
-	term := r.Table(rethinkDbTableUriQueue).GetAll(r.Args(uriIds)).Delete(
-		r.DeleteOpts{
-			Durability: "soft",
-		})
-	wr, err := rethinkDB.execWrite(ctx, "delete-queued-uris", &term)
+// deferUriQueueRemoval returns true if the removal of n queued uris should be deferred because
+// the uri queue table is rebalancing
+func (d *database) deferUriQueueRemoval(ctx context.Context, n int) (bool, error) {
+	if !d.rethinkDB.rebalanceGuard {
+		return false, nil
+	}
+	if ready, err := d.rethinkDB.tableReady(ctx, rethinkDbTableUriQueue); err != nil {
+		return false, fmt.Errorf("failed to get status of table %s: %w", rethinkDbTableUriQueue, err)
+	} else if !ready {
+		log.Ctx(ctx).Info().Str("table", rethinkDbTableUriQueue).Msgf("Deferring removal of %d queued uris while table is rebalancing", n)
+		return true, nil
+	}
+	return false, nil
+}
+
+// removeQueuedUris deletes the queued uris of uriIds from RethinkDB and audits the ids of the
+// queued uris deleted, which are only returned by the delete if auditing is enabled
+func (d *database) removeQueuedUris(ctx context.Context, uriIds []string) (int, error) {
+	term := r.Table(rethinkDbTableUriQueue).GetAll(r.Args(uriIds))
+	_, noop := d.auditor.(noopAuditor)
+	if !noop {
+		term = term.Delete(r.DeleteOpts{ReturnChanges: true})
+	} else {
+		term = term.Delete()
+	}
+	wr, err := d.rethinkDB.execWrite(ctx, "delete-queued-uris", &term, len(uriIds))
+	if !noop && wr.Deleted > 0 {
+		deleted := make([]string, 0, wr.Deleted)
+		for _, change := range wr.Changes {
+			if doc, ok := change.OldValue.(map[string]interface{}); ok {
+				if id, ok := doc["id"].(string); ok {
+					deleted = append(deleted, id)
+				}
+			}
+		}
+		d.audit(ctx, AuditOperationDeleteQueuedUris, wr.Deleted, deleted...)
+	}
 	return wr.Deleted, err
 }
 
-func deleteFromRemoveQueue(redis *redis.Client, uriIds []string) error {
-	pipe := redis.Pipeline()
+// countRemoveQueueDequeued counts the deleted items of the remove queue by reason given the
+// batch of uriIds and the number of queued uris removed from RethinkDB
+func countRemoveQueueDequeued(queue string, uriIds []string, removed int, deleted int) {
+	unique := make(map[string]struct{}, len(uriIds))
 	for _, uriId := range uriIds {
-		pipe.LRem(redisRemoveUriQueue, 1, uriId)
+		unique[uriId] = struct{}{}
 	}
-	_, err := pipe.Exec()
-	return err
+	duplicates := len(uriIds) - len(unique)
+	if duplicates > deleted-removed {
+		duplicates = deleted - removed
+	}
+	dequeued(queue, DequeueReasonProcessed, removed)
+	dequeued(queue, DequeueReasonDuplicate, duplicates)
+	dequeued(queue, DequeueReasonEvictedMissingDoc, deleted-removed-duplicates)
 }
 
 func (d *database) UpdateJobExecutions(ctx context.Context) (int, error) {
-	jess, err := getJobExecutionStatuses(d.redis)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get job executions: %w", err)
+	if d.rethinkDB.skip(ctx, "update-job-executions") {
+		return 0, nil
+	}
+	return d.forEachLayout(ctx, func(k keys) (int, error) {
+		if !k.owns(k.jobExecutionPrefix) {
+			return 0, nil
+		}
+		return d.updateJobExecutions(ctx, k)
+	})
+}
+
+func (d *database) updateJobExecutions(ctx context.Context, k keys) (int, error) {
+	if d.dryRun {
+		n := 0
+		err := forEachJobExecutionStatus(ctx, d.redis, k.jobExecutionPrefix, nil, func(map[string]interface{}) error {
+			n++
+			return nil
+		})
+		d.wouldDo(ctx, "update-job-executions", k.jobExecutionPrefix, n)
+		return 0, err
+	}
+	var skip func(key string) bool
+	if d.jobExecutionCache != nil {
+		if err := d.jobExecutionCache.sync(ctx); err != nil {
+			return 0, fmt.Errorf("failed to sync job execution cache: %w", err)
+		}
+		skip = func(key string) bool { return !d.jobExecutionCache.stale(key) }
 	}
 	count := 0
-	for _, jes := range jess {
+	var updateErr error
+	err := forEachJobExecutionStatus(ctx, d.redis, k.jobExecutionPrefix, skip, func(jes map[string]interface{}) error {
 		replaced, err := updateJobExecution(d.rethinkDB, ctx, jes)
 		if err != nil {
-			return replaced, fmt.Errorf("failed to update job execution status: %w", err)
+			if d.jobExecutionCache != nil {
+				d.jobExecutionCache.invalidate(k.jobExecutionPrefix + jes["id"].(string))
+			}
+			updateErr = err
+			return err
+		}
+		if replaced > 0 {
+			d.audit(ctx, AuditOperationUpdateJobExecution, replaced, jes["id"].(string))
 		}
 		count += replaced
+		return nil
+	})
+	if updateErr != nil {
+		return count, fmt.Errorf("failed to update job execution status: %w", updateErr)
+	}
+	if err != nil {
+		if d.jobExecutionCache != nil {
+			// keys recorded as read may have failed to be read
+			d.jobExecutionCache.invalidateAll()
+		}
+		return count, fmt.Errorf("failed to get job executions: %w", err)
 	}
 	return count, nil
 }
 
-func getJobExecutionStatuses(redis *redis.Client) ([]map[string]interface{}, error) {
-	// Get all keys prefixed with "JEID:"
-	var jobExecutionKeys []string
-	err := redis.Keys(redisJobExecutionPrefix + "*").ScanSlice(&jobExecutionKeys)
-	if err != nil {
-		return nil, err
-	}
+// jobExecutionScanCount is the number of JEID keys fetched per batch when iterating job execution stats
+const jobExecutionScanCount = 100
 
-	var jobExecutionStatuses []map[string]interface{}
-	for _, key := range jobExecutionKeys {
-		if exists, err := redis.Exists(key).Result(); err != nil {
-			return nil, err
-		} else if exists == 0 {
-			continue
-		}
-		jeMap, err := redis.HGetAll(key).Result()
-		if err != nil {
-			return nil, err
+// forEachJobExecutionStatus calls fn with the stats of each job execution in redis.
+//
+// Keys are scanned and their stats fetched in pipelined batches, and each batch is handed to
+// fn before the next is fetched, so that only the key names are kept in memory across batches.
+// SCAN may return a key more than once, so keys already seen are skipped, as are keys for which
+// skip returns true (if not nil).
+func forEachJobExecutionStatus(ctx context.Context, client redis.UniversalClient, prefix string, skip func(key string) bool, fn func(jes map[string]interface{}) error) error {
+	return forEachMaster(ctx, client, func(node redis.UniversalClient) error {
+		seen := make(map[string]struct{})
+		var cursor uint64
+		for {
+			scanned, next, err := node.Scan(ctx, cursor, prefix+"*", jobExecutionScanCount).Result()
+			if err != nil {
+				return err
+			}
+			keys := scanned[:0]
+			for _, key := range scanned {
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				if skip != nil && skip(key) {
+					continue
+				}
+				keys = append(keys, key)
+			}
+
+			if len(keys) > 0 {
+				pipe := node.Pipeline()
+				cmds := make([]*redis.MapStringStringCmd, len(keys))
+				for i, key := range keys {
+					cmds[i] = pipe.HGetAll(ctx, key)
+				}
+				if _, err := pipe.Exec(ctx); err != nil {
+					return err
+				}
+				for i, key := range keys {
+					jeMap := cmds[i].Val()
+					// key was deleted after it was scanned
+					if len(jeMap) == 0 {
+						continue
+					}
+					if err := fn(toJobExecutionStats(strings.TrimPrefix(key, prefix), jeMap)); err != nil {
+						return err
+					}
+				}
+			}
+
+			if next == 0 {
+				return nil
+			}
+			cursor = next
 		}
+	})
+}
 
-		m := make(map[string]interface{})
+// toJobExecutionStats converts the hash of a JEID key to job execution stats
+func toJobExecutionStats(id string, jeMap map[string]string) map[string]interface{} {
+	m := make(map[string]interface{})
 
-		m["id"] = strings.TrimPrefix(key, redisJobExecutionPrefix)
+	m["id"] = id
 
-		var executionsState []map[string]int64
-		for k, v := range jeMap {
-			_, ok := frontierV1.CrawlExecutionStatus_State_value[k]
-			c, err := strconv.ParseInt(v, 10, 64)
-			if err != nil {
-				continue
-			}
-			if !ok {
-				m[k] = c
-			} else {
-				executionsState = append(executionsState, map[string]int64{k: c})
-			}
+	var executionsState []map[string]int64
+	for k, v := range jeMap {
+		_, ok := frontierV1.CrawlExecutionStatus_State_value[k]
+		c, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		if !ok {
+			m[k] = c
+		} else {
+			executionsState = append(executionsState, map[string]int64{k: c})
 		}
-		m["executionsState"] = executionsState
-		jobExecutionStatuses = append(jobExecutionStatuses, m)
 	}
+	m["executionsState"] = executionsState
+	return m
+}
 
-	return jobExecutionStatuses, nil
+// jobExecutionTerminalStates are the states of job executions that have ended
+var jobExecutionTerminalStates = []string{
+	"FINISHED",
+	"ABORTED_TIMEOUT",
+	"ABORTED_SIZE",
+	"ABORTED_MANUAL",
+	"FAILED",
+	"DIED",
 }
 
 func updateJobExecution(rethinkDB *RethinkDbConnection, ctx context.Context, jes map[string]interface{}) (int, error) {
@@ -204,56 +881,255 @@ func updateJobExecution(rethinkDB *RethinkDbConnection, ctx context.Context, jes
 		Get(jes["id"]).
 		Update(func(doc r.Term) interface{} {
 			// only update if jes is active
-			return r.Branch(r.Expr([]string{
-				"FINISHED",
-				"ABORTED_TIMEOUT",
-				"ABORTED_SIZE",
-				"ABORTED_MANUAL",
-				"FAILED",
-				"DIED",
-			}).Contains(doc.Field("state")),
+			return r.Branch(r.Expr(jobExecutionTerminalStates).Contains(doc.Field("state")),
 				nil,
 				jes,
 			)
 		})
-	wr, err := rethinkDB.execWrite(ctx, "update-job-execution-status", &term)
+	wr, err := rethinkDB.execSmallWrite(ctx, "update-job-execution-status", &term)
 	return wr.Replaced, err
 }
 
 func (d *database) TimeoutCrawlExecutions(ctx context.Context) (int, error) {
+	if d.rethinkDB.skip(ctx, "timeout-crawl-executions") {
+		return 0, nil
+	}
+	count := 0
+	for _, layouts := range d.crawlExecutionTimeoutGroups() {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		n, err := d.timeoutCrawlExecutions(ctx, layouts)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// crawlExecutionTimeoutGroups returns the layouts owning a crawl execution timeout queue grouped
+// by the queues popped together, which is every queue by itself unless LMPOP is enabled
+func (d *database) crawlExecutionTimeoutGroups() [][]keys {
+	var groups [][]keys
+next:
+	for _, k := range d.layouts {
+		if !k.owns(k.crawlExecutionTimeoutQueue) {
+			continue
+		}
+		if d.lmpop {
+			for i, group := range groups {
+				if !isCluster(d.redis) || sameSlot(group[0].crawlExecutionTimeoutQueue, k.crawlExecutionTimeoutQueue) {
+					groups[i] = append(group, k)
+					continue next
+				}
+			}
+		}
+		groups = append(groups, []keys{k})
+	}
+	return groups
+}
+
+// popCrawlExecutionTimeouts pops a batch of crawl executions from the first of the crawl
+// execution timeout queues of layouts that isn't empty and returns the layout of the queue
+func (d *database) popCrawlExecutionTimeouts(ctx context.Context, layouts []keys) (keys, []string, error) {
+	if len(layouts) == 1 {
+		ceids, err := d.redis.LPopCount(ctx, layouts[0].crawlExecutionTimeoutQueue, crawlExecutionTimeoutBatchSize).Result()
+		return layouts[0], ceids, err
+	}
+	queues := make([]string, len(layouts))
+	for i, k := range layouts {
+		queues[i] = k.crawlExecutionTimeoutQueue
+	}
+	queue, ceids, err := d.redis.LMPop(ctx, "LEFT", crawlExecutionTimeoutBatchSize, queues...).Result()
+	if err != nil {
+		return keys{}, nil, err
+	}
+	for _, k := range layouts {
+		if k.crawlExecutionTimeoutQueue == queue {
+			return k, ceids, nil
+		}
+	}
+	return keys{}, nil, fmt.Errorf("popped unknown crawl execution timeout queue: %s", queue)
+}
+
+func (d *database) timeoutCrawlExecutions(ctx context.Context, layouts []keys) (int, error) {
+	if d.dryRun {
+		for _, k := range layouts {
+			n, err := d.redis.LLen(ctx, k.crawlExecutionTimeoutQueue).Result()
+			if err != nil {
+				return 0, err
+			}
+			d.wouldDo(ctx, "timeout-crawl-executions", k.crawlExecutionTimeoutQueue, int(n))
+		}
+		return 0, nil
+	}
 	count := 0
 	for {
-		ceid, err := d.redis.LPop(redisCrawlExecutionTimeoutQueue).Result()
+		k, ceids, err := d.popCrawlExecutionTimeouts(ctx, layouts)
 		if err == redis.Nil {
 			break
 		} else if err != nil {
-			return count, fmt.Errorf("get timed out crawl execution: %w", err)
+			return count, fmt.Errorf("get timed out crawl executions: %w", err)
 		}
 
-		replaced, err := setCrawlExecutionStateAbortedTimeout(d.rethinkDB, ctx, ceid)
+		tokensKey := timeoutTokensKey(k.crawlExecutionTimeoutQueue)
+		tokens, err := d.timeoutTokens(ctx, tokensKey, ceids)
 		if err != nil {
-			// put ceid back in timout queue to recover
-			_, rollbackErr := d.redis.RPush(redisCrawlExecutionTimeoutQueue, ceid).Result()
+			if rollbackErr := d.redis.RPush(ctx, k.crawlExecutionTimeoutQueue, toValues(ceids)...).Err(); rollbackErr != nil {
+				return count, fmt.Errorf("%v:  %w: failed to recover ceids %v (must be inserted into timeout queue manually):", err, rollbackErr, ceids)
+			}
+			return count, fmt.Errorf("failed to get idempotency tokens of timed out crawl executions: %w", err)
+		}
+
+		replaced, skipped, err := setCrawlExecutionsStateAbortedTimeout(d.rethinkDB, ctx, ceids, tokens)
+		if err != nil {
+			d.logEnqueueSources(ctx, k.crawlExecutionTimeoutQueue, ceids, err)
+			// put ceids back in timout queue to recover, keeping their tokens so that a retry of
+			// a write that was applied in spite of the error isn't applied again
+			fields := make(map[string]interface{}, len(tokens))
+			for ceid, token := range tokens {
+				fields[ceid] = token
+			}
+			rollbackErr := d.redis.HSet(ctx, tokensKey, fields).Err()
+			if rollbackErr == nil {
+				rollbackErr = d.redis.RPush(ctx, k.crawlExecutionTimeoutQueue, toValues(ceids)...).Err()
+			}
 			if rollbackErr != nil {
-				return count, fmt.Errorf("%v:  %w: failed to recover ceid %s (must be inserted into timeout queue manually):", err, rollbackErr, ceid)
+				return count, fmt.Errorf("%v:  %w: failed to recover ceids %v (must be inserted into timeout queue manually):", err, rollbackErr, ceids)
 			}
 			break
 		}
-		count += replaced
+		if err := d.redis.HDel(ctx, tokensKey, ceids...).Err(); err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("component", "redis").Msg("Failed to delete idempotency tokens of timed out crawl executions")
+		}
+		d.forgetEnqueueSources(ctx, k.crawlExecutionTimeoutQueue, ceids)
+		for i, ceid := range ceids {
+			if skipped[i] > 0 {
+				dequeued(k.crawlExecutionTimeoutQueue, DequeueReasonEvictedMissingDoc, 1)
+			} else {
+				dequeued(k.crawlExecutionTimeoutQueue, DequeueReasonProcessed, 1)
+			}
+			if replaced[i] > 0 {
+				d.audit(ctx, AuditOperationTimeoutCrawlExecution, replaced[i], ceid)
+				if err := d.addCrawlExecutionAbortedEvent(ctx, k.crawlExecutionAbortedStream, ceid, frontierV1.CrawlExecutionStatus_ABORTED_TIMEOUT.String()); err != nil {
+					log.Ctx(ctx).Warn().Err(err).Str("component", "redis").Str("ceid", ceid).Msg("Failed to add crawl execution aborted event")
+				}
+			}
+			count += replaced[i]
+		}
+		// a short batch only empties the queue popped, which is the last one unless LMPOP is used
+		if len(layouts) == 1 && len(ceids) < crawlExecutionTimeoutBatchSize {
+			break
+		}
+	}
+	if count > 0 {
+		d.replication.check(ctx, "pop-crawl-execution-timeout-queue")
 	}
 	return count, nil
 }
 
-func setCrawlExecutionStateAbortedTimeout(rethinkDB *RethinkDbConnection, ctx context.Context, crawlExecutionId string) (int, error) {
-	term := r.Table(rethinkDbTableCrawlExecutions).Get(crawlExecutionId).Update(
-		func(doc r.Term) interface{} {
-			return r.Branch(
-				doc.HasFields("endTime"),
-				nil,
-				map[string]string{
-					"desiredState": frontierV1.CrawlExecutionStatus_ABORTED_TIMEOUT.String(),
-				})
-		})
-	wr, err := rethinkDB.execWrite(ctx, "set-crawl-execution-state-aborted-timeout", &term)
-	return wr.Replaced, err
+// timeoutTokensKey returns the key of the hash holding the idempotency tokens of the crawl
+// executions put back in queue after a failed timeout, which shares the hash tag of queue
+func timeoutTokensKey(queue string) string {
+	if hashTag(queue) != queue {
+		return queue + ":tokens"
+	}
+	return "{" + queue + "}:tokens"
+}
+
+// timeoutTokens returns the idempotency token of each crawl execution, which is the token of a
+// previous attempt if it failed or else a new token shared by the batch
+func (d *database) timeoutTokens(ctx context.Context, key string, ceids []string) (map[string]string, error) {
+	stored, err := d.redis.HMGet(ctx, key, ceids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	token := newIdempotencyToken()
+	tokens := make(map[string]string, len(ceids))
+	for i, ceid := range ceids {
+		if t, ok := stored[i].(string); ok && t != "" {
+			tokens[ceid] = t
+		} else {
+			tokens[ceid] = token
+		}
+	}
+	return tokens, nil
+}
+
+// toValues returns items as command arguments
+func toValues(items []string) []interface{} {
+	values := make([]interface{}, len(items))
+	for i, item := range items {
+		values[i] = item
+	}
+	return values
+}
+
+// addCrawlExecutionAbortedEvent appends an event about an aborted crawl execution to the aborted crawl execution stream.
+func (d *database) addCrawlExecutionAbortedEvent(ctx context.Context, stream string, ceid string, reason string) error {
+	return d.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: redisCrawlExecutionAbortedStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"ceid":      ceid,
+			"timestamp": d.clock.Now().UTC().Format(time.RFC3339Nano),
+			"reason":    reason,
+		},
+	}).Err()
+}
+
+// setCrawlExecutionsStateAbortedTimeout sets the desired state of the crawl executions that have not ended
+// to aborted timeout in a single query and returns the number of documents replaced and skipped because
+// they don't exist for each crawl execution.
+//
+// The updates are marked with the idempotency token of each crawl execution so that a retry of an
+// update that was already applied is counted as replaced, which ensures its side effects are
+// applied exactly once.
+func setCrawlExecutionsStateAbortedTimeout(rethinkDB *RethinkDbConnection, ctx context.Context, crawlExecutionIds []string, tokens map[string]string) ([]int, []int, error) {
+	terms := make([]r.Term, len(crawlExecutionIds))
+	for i, id := range crawlExecutionIds {
+		token := tokens[id]
+		terms[i] = r.Table(rethinkDbTableCrawlExecutions).Get(id).Update(
+			func(doc r.Term) interface{} {
+				return r.Branch(
+					doc.HasFields("endTime"),
+					nil,
+					doc.Field(crawlExecutionTimeoutTokenField).Default("").Eq(token),
+					nil,
+					map[string]string{
+						"desiredState":                  frontierV1.CrawlExecutionStatus_ABORTED_TIMEOUT.String(),
+						crawlExecutionTimeoutTokenField: token,
+					})
+			})
+	}
+	wrs, err := rethinkDB.execWriteBatch(ctx, "set-crawl-execution-state-aborted-timeout", terms)
+	if err != nil {
+		return nil, nil, err
+	}
+	replaced := make([]int, len(crawlExecutionIds))
+	skipped := make([]int, len(crawlExecutionIds))
+	unchanged := make(map[string]string)
+	for i, wr := range wrs {
+		replaced[i] = wr.Replaced
+		skipped[i] = wr.Skipped
+		if wr.Unchanged > 0 {
+			unchanged[crawlExecutionIds[i]] = tokens[crawlExecutionIds[i]]
+		}
+	}
+	if len(unchanged) == 0 {
+		return replaced, skipped, nil
+	}
+	// unchanged either because the crawl execution has ended or because a retry found the update applied
+	applied, err := withIdempotencyTokens(rethinkDB, ctx, rethinkDbTableCrawlExecutions, crawlExecutionTimeoutTokenField, unchanged)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, id := range crawlExecutionIds {
+		if applied[id] {
+			replaced[i] = 1
+		}
+	}
+	return replaced, skipped, nil
 }
@@ -0,0 +1,38 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+)
+
+// Reasons items leave a queue
+const (
+	// DequeueReasonProcessed is an item that was acted upon, e.g. moved to another queue or written to RethinkDB
+	DequeueReasonProcessed = "processed"
+	// DequeueReasonEvictedMissingDoc is an item referring to a document that no longer exists in RethinkDB
+	DequeueReasonEvictedMissingDoc = "evicted-missing-doc"
+	// DequeueReasonDuplicate is an item removed along with an identical item in the same batch
+	DequeueReasonDuplicate = "duplicate"
+)
+
+// dequeued counts n items leaving queue for reason
+func dequeued(queue string, reason string, n int) {
+	if n > 0 {
+		metrics.QueueItemsDequeued.WithLabelValues(queue, reason).Add(float64(n))
+	}
+}
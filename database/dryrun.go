@@ -0,0 +1,38 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+// In dry-run mode queue operations read the queues and compute what they would do, but
+// perform no writes to Redis or RethinkDB. What they would do is logged and counted by
+// operation, and they report that nothing was processed so that workers keep polling at
+// their regular interval instead of spinning on the unchanged queues.
+
+// wouldDo logs and counts n items an operation would have processed if not in dry-run mode
+func (d *database) wouldDo(ctx context.Context, operation string, queue string, n int) {
+	if n <= 0 {
+		return
+	}
+	metrics.DryRunItems.WithLabelValues(operation).Add(float64(n))
+	log.Ctx(ctx).Info().Str("operation", operation).Str("queue", queue).Int("items", n).Msg("Dry run: skipping writes")
+}
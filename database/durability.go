@@ -0,0 +1,99 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// Write durabilities of RethinkDB
+const (
+	// DurabilitySoft acknowledges writes when they are in memory on the server
+	DurabilitySoft = "soft"
+	// DurabilityHard acknowledges writes when they are committed to disk
+	DurabilityHard = "hard"
+)
+
+// checkDurability returns an error if durability is not a known write durability
+func checkDurability(durability string) error {
+	switch durability {
+	case DurabilitySoft, DurabilityHard:
+		return nil
+	default:
+		return fmt.Errorf("unknown write durability: %s", durability)
+	}
+}
+
+// ParseWriteDurability parses the write durability of operations on the form
+// "operation=hard,operation2=soft", where operation is the name of a write operation,
+// e.g. set-crawl-execution-state-aborted-timeout
+func ParseWriteDurability(s string) (map[string]string, error) {
+	durability := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		operation, value, ok := strings.Cut(pair, "=")
+		if !ok || operation == "" {
+			return nil, fmt.Errorf("invalid write durability: %s", pair)
+		}
+		if err := checkDurability(value); err != nil {
+			return nil, err
+		}
+		durability[operation] = value
+	}
+	return durability, nil
+}
+
+// durability returns the write durability of the named write operation
+func (c *RethinkDbConnection) durability(name string) string {
+	if durability, ok := c.durabilities[name]; ok {
+		return durability
+	}
+	return c.defaultDurability
+}
+
+// syncedTables are the tables written by the workers, which are flushed to disk by SyncTables
+var syncedTables = []string{rethinkDbTableUriQueue, rethinkDbTableCrawlExecutions, rethinkDbTableJobExecutions}
+
+// SyncTables flushes the soft durability writes of the tables written by the workers to disk,
+// which bounds the writes lost if RethinkDB crashes, and returns the number of tables synced
+func (d *database) SyncTables(ctx context.Context) (int, error) {
+	if d.rethinkDB.skip(ctx, "sync-tables") {
+		return 0, nil
+	}
+	synced := 0
+	for _, table := range syncedTables {
+		if d.dryRun {
+			d.wouldDo(ctx, "sync-table", table, 1)
+			continue
+		}
+		term := r.Table(table).Sync()
+		cursor, err := d.rethinkDB.execRead(ctx, "sync-table", &term, 1)
+		if err != nil {
+			return synced, fmt.Errorf("failed to sync table %s: %w", table, err)
+		}
+		_ = cursor.Close()
+		synced++
+	}
+	return synced, nil
+}
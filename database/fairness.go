@@ -0,0 +1,91 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+)
+
+// redisJobExecutionSuffix is the suffix of the companion hash of a remove queue
+// mapping each queued uri id to the id of the job execution it belongs to.
+const redisJobExecutionSuffix = ":jeid"
+
+// JobThrottleOptions configures fair removal of queued uris across job executions
+type JobThrottleOptions struct {
+	// Enabled enables per job execution removal throttling
+	Enabled bool
+	// MaxPerJob is the max number of queued uris of a single job execution removed per pass (0 for no limit)
+	MaxPerJob int
+	// Lookahead is how many batches of the remove queue are considered when selecting a fair batch
+	Lookahead int
+}
+
+// fairBatch selects a batch of the uri ids read ahead in the remove queue where job executions
+// take turns, so that one enormous job execution doesn't starve removal for smaller ones.
+func (d *database) fairBatch(ctx context.Context, queue string, uriIds []string) ([]string, error) {
+	values, err := d.redis.HMGet(ctx, queue+redisJobExecutionSuffix, uriIds...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// group by job execution in order of first appearance
+	var jobs []string
+	byJob := make(map[string][]string)
+	for i, value := range values {
+		jeid, _ := value.(string)
+		if _, ok := byJob[jeid]; !ok {
+			jobs = append(jobs, jeid)
+		}
+		byJob[jeid] = append(byJob[jeid], uriIds[i])
+	}
+
+	// take turns until the batch is full or every job has reached its limit
+	size := batchSizeFromContext(ctx)
+	batch := make([]string, 0, size)
+	for round := 0; len(batch) < size; round++ {
+		if d.jobThrottle.MaxPerJob > 0 && round >= d.jobThrottle.MaxPerJob {
+			break
+		}
+		added := false
+		for _, jeid := range jobs {
+			if ids := byJob[jeid]; round < len(ids) {
+				batch = append(batch, ids[round])
+				added = true
+				if len(batch) == size {
+					break
+				}
+			}
+		}
+		if !added {
+			break
+		}
+	}
+	log.Ctx(ctx).Trace().Str("queue", queue).Int("jobs", len(jobs)).Int("batch", len(batch)).Msg("Selected fair removal batch")
+	return batch, nil
+}
+
+// forgetJobExecutions deletes the job execution of uri ids that have been removed
+func (d *database) forgetJobExecutions(ctx context.Context, queue string, uriIds []string) {
+	if !d.jobThrottle.Enabled || len(uriIds) == 0 {
+		return
+	}
+	if err := d.redis.HDel(ctx, queue+redisJobExecutionSuffix, uriIds...).Err(); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("queue", queue).Msg("Failed to delete job executions of removed uris")
+	}
+}
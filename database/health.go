@@ -0,0 +1,69 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// CheckHealth runs a cheap query every interval until ctx is done and reconnects when it fails,
+// so that a dead session is replaced before a worker depends on it
+func (c *RethinkDbConnection) CheckHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	healthy := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := c.ping(ctx)
+		if err == nil {
+			if !healthy {
+				c.logger.Info().Msg("RethinkDB connection is healthy")
+			}
+			healthy = true
+			metrics.RethinkDbConnected.Set(1)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		healthy = false
+		metrics.RethinkDbConnected.Set(0)
+		c.logger.Warn().Err(err).Msg("RethinkDB health check failed, reconnecting")
+		if err := c.Connect(); err != nil {
+			c.logger.Warn().Err(err).Msg("Failed to reconnect database")
+		}
+	}
+}
+
+// ping runs a query that is answered by the server without reading any table
+func (c *RethinkDbConnection) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.queryTimeout)
+	defer cancel()
+	cursor, err := r.Expr(1).Run(c.session, r.RunOpts{Context: ctx})
+	if err != nil {
+		return err
+	}
+	return cursor.Close()
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisHeartbeatPrefix is the key prefix of worker heartbeat keys
+const redisHeartbeatPrefix = "frontier:qw:heartbeat:"
+
+// Heartbeat maintains a heartbeat key with a TTL per worker so that other
+// components can detect a dead queue worker instance
+type Heartbeat struct {
+	redis    redis.UniversalClient
+	ttl      time.Duration
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// NewHeartbeat returns a Heartbeat that sets heartbeat keys at most every interval with the given ttl
+func NewHeartbeat(redisClient redis.UniversalClient, interval time.Duration, ttl time.Duration) *Heartbeat {
+	return &Heartbeat{
+		redis:    redisClient,
+		ttl:      ttl,
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// Beat sets the heartbeat key of worker unless it was set less than interval ago
+func (h *Heartbeat) Beat(ctx context.Context, worker string) error {
+	if h.ttl <= 0 {
+		return nil
+	}
+	now := time.Now()
+
+	h.mu.Lock()
+	if now.Sub(h.last[worker]) < h.interval {
+		h.mu.Unlock()
+		return nil
+	}
+	h.last[worker] = now
+	h.mu.Unlock()
+
+	return h.redis.Set(ctx, redisHeartbeatPrefix+worker, now.UTC().Format(time.RFC3339Nano), h.ttl).Err()
+}
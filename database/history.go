@@ -0,0 +1,110 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisHistoryPrefix is the key prefix of the lists holding worker run history
+const redisHistoryPrefix = "frontier:qw:history:"
+
+// IterationSummary summarizes a single worker iteration
+type IterationSummary struct {
+	Worker    string        `json:"worker"`
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration"`
+	Processed int           `json:"processed"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// History persists the last iteration summaries of each worker in redis so
+// that they survive restarts
+type History struct {
+	redis redis.UniversalClient
+	size  int
+}
+
+// NewHistory returns a History keeping the last size iteration summaries per worker
+func NewHistory(redisClient redis.UniversalClient, size int) *History {
+	return &History{
+		redis: redisClient,
+		size:  size,
+	}
+}
+
+// Record adds an iteration summary to the history of its worker, discarding the oldest summaries
+func (h *History) Record(ctx context.Context, summary IterationSummary) error {
+	if h.size <= 0 {
+		return nil
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	key := redisHistoryPrefix + summary.Worker
+	pipe := h.redis.TxPipeline()
+	pipe.LPush(ctx, key, b)
+	pipe.LTrim(ctx, key, 0, int64(h.size-1))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Workers returns the names of all workers with a history
+func (h *History) Workers(ctx context.Context) ([]string, error) {
+	var workers []string
+	err := forEachMaster(ctx, h.redis, func(node redis.UniversalClient) error {
+		var cursor uint64
+		for {
+			keys, next, err := node.Scan(ctx, cursor, redisHistoryPrefix+"*", 100).Result()
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				workers = append(workers, strings.TrimPrefix(key, redisHistoryPrefix))
+			}
+			if next == 0 {
+				return nil
+			}
+			cursor = next
+		}
+	})
+	return workers, err
+}
+
+// List returns the history of a worker, most recent iteration first
+func (h *History) List(ctx context.Context, worker string) ([]IterationSummary, error) {
+	values, err := h.redis.LRange(ctx, redisHistoryPrefix+worker, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]IterationSummary, 0, len(values))
+	for _, value := range values {
+		var summary IterationSummary
+		if err := json.Unmarshal([]byte(value), &summary); err != nil {
+			return nil, fmt.Errorf("invalid iteration summary of %s: %w", worker, err)
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// Updates with side effects are marked with an idempotency token stored in a field of the
+// document. A write that is retried after an ambiguous failure (e.g. a timeout after the write
+// was applied) carries the same token, which lets the retry detect that the update was already
+// applied instead of applying it, or its side effects, twice.
+
+// crawlExecutionTimeoutTokenField holds the token of the last timeout applied to a crawl execution
+const crawlExecutionTimeoutTokenField = "lastTimeoutToken"
+
+// newIdempotencyToken returns a random token identifying an update and its retries
+var newIdempotencyToken = func() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withIdempotencyTokens returns the set of ids of the documents in table that carry the token of
+// their id in field
+func withIdempotencyTokens(rethinkDB *RethinkDbConnection, ctx context.Context, table string, field string, tokens map[string]string) (map[string]bool, error) {
+	ids := make([]string, 0, len(tokens))
+	for id := range tokens {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	term := r.Table(table).GetAll(r.Args(ids)).Pluck("id", field)
+	var docs []map[string]interface{}
+	if err := rethinkDB.execReadAll(ctx, "get-idempotency-token", &term, len(ids), &docs); err != nil {
+		return nil, err
+	}
+	m := make(map[string]bool, len(docs))
+	for _, doc := range docs {
+		id, _ := doc["id"].(string)
+		if token, ok := doc[field].(string); ok && token != "" && token == tokens[id] {
+			m[id] = true
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// idSetPageSize is the number of ids read and added per round trip when filling an id set
+const idSetPageSize = 1000
+
+// idSetTtl is how long an id set is kept after it was last written or read, which cleans up
+// the sets left behind by a pass that didn't finish
+const idSetTtl = 10 * time.Minute
+
+// idSet is a temporary set of ids held in Redis, which lets a reconciler compare large id sets
+// without pulling them into memory. Sets are combined by Redis and read back a page at a time.
+//
+// The sets combined must be created with the same prefix, which carries a hash tag keeping them
+// on the same node of a cluster.
+type idSet struct {
+	redis  redis.UniversalClient
+	prefix string
+	key    string
+}
+
+// idSetKeyPrefix returns the prefix of the id sets derived from key
+func idSetKeyPrefix(key string) string {
+	if hashTag(key) != key {
+		return key + ":idset"
+	}
+	return "{" + key + "}:idset"
+}
+
+// newIdSet returns an empty id set with the given key prefix
+func newIdSet(client redis.UniversalClient, prefix string) idSet {
+	return idSet{redis: client, prefix: prefix, key: prefix + ":" + newIdempotencyToken()}
+}
+
+// add adds ids to the set
+func (s idSet) add(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	pipe := s.redis.Pipeline()
+	pipe.SAdd(ctx, s.key, toValues(ids)...)
+	pipe.Expire(ctx, s.key, idSetTtl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// addList adds the items of a list to the set a page at a time
+func (s idSet) addList(ctx context.Context, list string) error {
+	for start := int64(0); ; start += idSetPageSize {
+		ids, err := s.redis.LRange(ctx, list, start, start+idSetPageSize-1).Result()
+		if err != nil {
+			return err
+		}
+		if err := s.add(ctx, ids...); err != nil {
+			return err
+		}
+		if len(ids) < idSetPageSize {
+			return nil
+		}
+	}
+}
+
+// addSortedSet adds the members of a sorted set to the set a page at a time
+func (s idSet) addSortedSet(ctx context.Context, zset string) error {
+	for start := int64(0); ; start += idSetPageSize {
+		ids, err := s.redis.ZRange(ctx, zset, start, start+idSetPageSize-1).Result()
+		if err != nil {
+			return err
+		}
+		if err := s.add(ctx, ids...); err != nil {
+			return err
+		}
+		if len(ids) < idSetPageSize {
+			return nil
+		}
+	}
+}
+
+// diff returns a new set holding the ids of s that are not in other
+func (s idSet) diff(ctx context.Context, other idSet) (idSet, error) {
+	dst := newIdSet(s.redis, s.prefix)
+	pipe := s.redis.TxPipeline()
+	pipe.SDiffStore(ctx, dst.key, s.key, other.key)
+	pipe.Expire(ctx, dst.key, idSetTtl)
+	_, err := pipe.Exec(ctx)
+	return dst, err
+}
+
+// page returns about limit ids of the set starting at the scan cursor together with the cursor
+// of the next page, 0 meaning there are no more pages. Reading a page keeps the set from expiring.
+func (s idSet) page(ctx context.Context, cursor uint64, limit int) ([]string, uint64, error) {
+	pipe := s.redis.Pipeline()
+	scan := pipe.SScan(ctx, s.key, cursor, "", int64(limit))
+	pipe.Expire(ctx, s.key, idSetTtl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, 0, err
+	}
+	return scan.Result()
+}
+
+// delete deletes the set
+func (s idSet) delete(ctx context.Context) error {
+	return s.redis.Del(ctx, s.key).Err()
+}
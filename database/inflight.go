@@ -0,0 +1,192 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// inflightStaleAfter is how long an in-flight list of another instance may exist before it is
+// considered orphaned and recovered
+const inflightStaleAfter = 15 * time.Minute
+
+// inflightClaimScript moves the given uri ids that are still in the window at the head of the
+// remove queue they were read from to an in-flight list and returns the ids moved. The in-flight
+// list is registered in an index by the time it was claimed so that it can be recovered if the
+// instance dies before processing it. Uri ids left in the in-flight list by a batch that failed
+// to be returned are returned first.
+//
+// The batch is not necessarily at the head of the queue (see removeBatch), so the window is read
+// and trimmed off the queue and the ids not in the batch are pushed back in their order.
+var inflightClaimScript = redis.NewScript(`
+local left = redis.call('LRANGE', KEYS[2], 0, -1)
+for i = #left, 1, -1 do
+    redis.call('LPUSH', KEYS[1], left[i])
+end
+redis.call('DEL', KEYS[2])
+local window = redis.call('LRANGE', KEYS[1], 0, #left + tonumber(ARGV[2]) - 1)
+local wanted = {}
+for i = 3, #ARGV do
+    wanted[ARGV[i]] = (wanted[ARGV[i]] or 0) + 1
+end
+local moved = {}
+local kept = {}
+for _, id in ipairs(window) do
+    if (wanted[id] or 0) > 0 then
+        wanted[id] = wanted[id] - 1
+        moved[#moved + 1] = id
+    else
+        kept[#kept + 1] = id
+    end
+end
+if #moved > 0 then
+    redis.call('LTRIM', KEYS[1], #window, -1)
+    for i = #kept, 1, -1 do
+        redis.call('LPUSH', KEYS[1], kept[i])
+    end
+    for _, id in ipairs(moved) do
+        redis.call('RPUSH', KEYS[2], id)
+    end
+    redis.call('ZADD', KEYS[3], ARGV[1], KEYS[2])
+end
+return moved
+`)
+
+// inflightReturnScript moves the uri ids of an in-flight list back to the head of the remove
+// queue in their original order and returns the number of ids moved.
+var inflightReturnScript = redis.NewScript(`
+local items = redis.call('LRANGE', KEYS[2], 0, -1)
+for i = #items, 1, -1 do
+    redis.call('LPUSH', KEYS[1], items[i])
+end
+redis.call('DEL', KEYS[2])
+redis.call('ZREM', KEYS[3], KEYS[2])
+return #items
+`)
+
+// inflight is the in-flight list of a batch of uri ids being removed from a remove queue.
+//
+// The list and its index share the hash tag of the queue so that they are served by the
+// same node of a cluster.
+type inflight struct {
+	queue string
+	list  string
+	index string
+}
+
+// inflightKeyPrefix returns the prefix of the in-flight keys of queue
+func inflightKeyPrefix(queue string) string {
+	if hashTag(queue) != queue {
+		return queue + ":inflight"
+	}
+	return "{" + queue + "}:inflight"
+}
+
+// newInflight returns the in-flight list of owner for queue in the partition of ctx
+func newInflight(ctx context.Context, queue string, owner string) inflight {
+	prefix := inflightKeyPrefix(queue)
+	return inflight{
+		queue: queue,
+		list:  prefix + ":" + owner + ":" + strconv.Itoa(partitionFromContext(ctx).index),
+		index: prefix,
+	}
+}
+
+// claim moves uriIds found among the first window items of the queue to the in-flight list and
+// returns the uri ids moved, which excludes those already removed from the queue by another consumer
+func (f inflight) claim(ctx context.Context, client redis.UniversalClient, now time.Time, window int, uriIds []string) ([]string, error) {
+	args := make([]interface{}, 0, len(uriIds)+2)
+	args = append(args, now.UnixMilli(), window)
+	for _, uriId := range uriIds {
+		args = append(args, uriId)
+	}
+	return inflightClaimScript.Run(ctx, client, []string{f.queue, f.list, f.index}, args...).StringSlice()
+}
+
+// done discards the in-flight list after its uri ids have been processed
+func (f inflight) done(ctx context.Context, client redis.UniversalClient) error {
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, f.list)
+		pipe.ZRem(ctx, f.index, f.list)
+		return nil
+	})
+	return err
+}
+
+// abort moves the uri ids of the in-flight list back to the queue
+func (f inflight) abort(ctx context.Context, client redis.UniversalClient) (int, error) {
+	return inflightReturnScript.Run(ctx, client, []string{f.queue, f.list, f.index}).Int()
+}
+
+// RecoverRemoveUriQueue moves the uri ids of orphaned in-flight lists back to the remove queues
+// and returns the number of uri ids recovered.
+//
+// The in-flight lists of this instance are orphaned at startup, as are those of other
+// instances that were claimed longer than inflightStaleAfter ago.
+func (d *database) RecoverRemoveUriQueue(ctx context.Context) (int, error) {
+	if d.dryRun {
+		return 0, nil
+	}
+	return d.forEachLayout(ctx, func(k keys) (int, error) {
+		recovered := 0
+		for _, queue := range []string{k.removeUriHighQueue, k.removeUriQueue} {
+			if !k.owns(queue) {
+				continue
+			}
+			n, err := d.recoverInflight(ctx, queue)
+			recovered += n
+			if err != nil {
+				return recovered, fmt.Errorf("failed to recover in-flight uri ids of %s: %w", queue, err)
+			}
+		}
+		return recovered, nil
+	})
+}
+
+func (d *database) recoverInflight(ctx context.Context, queue string) (int, error) {
+	index := inflightKeyPrefix(queue)
+	own := index + ":" + d.owner + ":"
+	staleBefore := d.clock.Now().Add(-inflightStaleAfter).UnixMilli()
+
+	lists, err := d.redis.ZRangeWithScores(ctx, index, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	recovered := 0
+	for _, z := range lists {
+		list := z.Member.(string)
+		if !strings.HasPrefix(list, own) && int64(z.Score) >= staleBefore {
+			continue
+		}
+		n, err := inflight{queue: queue, list: list, index: index}.abort(ctx, d.redis)
+		if err != nil {
+			return recovered, err
+		}
+		if n > 0 {
+			log.Ctx(ctx).Warn().Str("queue", queue).Str("list", list).Msgf("Recovered %d in-flight uri ids", n)
+		}
+		recovered += n
+	}
+	return recovered, nil
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/clock"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestInflightClaim(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1000, 0)
+
+	tests := []struct {
+		name      string
+		queue     []string // items in the remove queue
+		left      []string // items left in the in-flight list by an earlier batch
+		window    int
+		uriIds    []string
+		wantMoved []string
+		wantQueue []string
+	}{
+		{
+			name:      "batch at the head of the queue",
+			queue:     []string{"a", "b", "c", "d"},
+			window:    2,
+			uriIds:    []string{"a", "b"},
+			wantMoved: []string{"a", "b"},
+			wantQueue: []string{"c", "d"},
+		},
+		{
+			name:      "items not in the batch keep their order",
+			queue:     []string{"a", "b", "c", "d", "e"},
+			window:    4,
+			uriIds:    []string{"b", "d"},
+			wantMoved: []string{"b", "d"},
+			wantQueue: []string{"a", "c", "e"},
+		},
+		{
+			name:      "ids removed by another consumer are skipped",
+			queue:     []string{"a", "c"},
+			window:    3,
+			uriIds:    []string{"a", "b"},
+			wantMoved: []string{"a"},
+			wantQueue: []string{"c"},
+		},
+		{
+			name:      "ids beyond the window are not claimed",
+			queue:     []string{"a", "b", "c"},
+			window:    1,
+			uriIds:    []string{"a", "c"},
+			wantMoved: []string{"a"},
+			wantQueue: []string{"b", "c"},
+		},
+		{
+			name:      "first occurrence of a duplicate is claimed",
+			queue:     []string{"a", "b", "a"},
+			window:    3,
+			uriIds:    []string{"a"},
+			wantMoved: []string{"a"},
+			wantQueue: []string{"b", "a"},
+		},
+		{
+			name:      "items left in the in-flight list are returned first",
+			queue:     []string{"a", "b"},
+			left:      []string{"x", "y"},
+			window:    2,
+			uriIds:    []string{"x"},
+			wantMoved: []string{"x"},
+			wantQueue: []string{"y", "a", "b"},
+		},
+		{
+			name:      "nothing claimed",
+			queue:     []string{"a"},
+			window:    1,
+			uriIds:    []string{"z"},
+			wantQueue: []string{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newTestScript(t)
+			f := newInflight(ctx, redisRemoveUriQueue, "me")
+			if len(tt.queue) > 0 {
+				if err := client.RPush(ctx, f.queue, toValues(tt.queue)...).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(tt.left) > 0 {
+				if err := client.RPush(ctx, f.list, toValues(tt.left)...).Err(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			moved, err := f.claim(ctx, client, now, tt.window, tt.uriIds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalStrings(moved, tt.wantMoved) {
+				t.Errorf("claim() = %v, want %v", moved, tt.wantMoved)
+			}
+			if queue, _ := client.LRange(ctx, f.queue, 0, -1).Result(); !equalStrings(queue, tt.wantQueue) {
+				t.Errorf("queue = %v, want %v", queue, tt.wantQueue)
+			}
+			if list, _ := client.LRange(ctx, f.list, 0, -1).Result(); !equalStrings(list, tt.wantMoved) {
+				t.Errorf("in-flight list = %v, want %v", list, tt.wantMoved)
+			}
+			score, err := client.ZScore(ctx, f.index, f.list).Result()
+			if len(tt.wantMoved) == 0 {
+				if err != redis.Nil {
+					t.Errorf("in-flight list registered without claimed ids: %v, %v", score, err)
+				}
+			} else if err != nil || score != float64(now.UnixMilli()) {
+				t.Errorf("in-flight list registered at %v, %v, want %v", score, err, now.UnixMilli())
+			}
+		})
+	}
+}
+
+func TestRecoverRemoveUriQueue(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(10000, 0)
+	client, _ := newTestScript(t)
+	db, err := NewDatabase(ctx, client, nil, Options{Owner: "me", Clock: clock.NewFake(now)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index := inflightKeyPrefix(redisRemoveUriQueue)
+	lists := []struct {
+		owner     string
+		claimedAt time.Time
+		items     []string
+	}{
+		{"me", now, []string{"a", "b"}},
+		{"stale", now.Add(-inflightStaleAfter - time.Second), []string{"c"}},
+		{"fresh", now.Add(-time.Minute), []string{"d"}},
+	}
+	for _, l := range lists {
+		list := index + ":" + l.owner + ":0"
+		if err := client.RPush(ctx, list, toValues(l.items)...).Err(); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.ZAdd(ctx, index, redis.Z{Score: float64(l.claimedAt.UnixMilli()), Member: list}).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.RPush(ctx, redisRemoveUriQueue, "e").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.RecoverRemoveUriQueue(ctx)
+	if err != nil || n != 3 {
+		t.Fatalf("RecoverRemoveUriQueue() = %d, %v, want 3, nil", n, err)
+	}
+	queue, _ := client.LRange(ctx, redisRemoveUriQueue, 0, -1).Result()
+	if queue[len(queue)-1] != "e" {
+		t.Errorf("queue = %v, want the recovered ids before e", queue)
+	}
+	sort.Strings(queue)
+	if !equalStrings(queue, []string{"a", "b", "c", "e"}) {
+		t.Errorf("queue = %v, want a, b, c and e", queue)
+	}
+	if remaining, _ := client.ZRange(ctx, index, 0, -1).Result(); !equalStrings(remaining, []string{index + ":fresh:0"}) {
+		t.Errorf("registered in-flight lists = %v, want only the fresh one", remaining)
+	}
+}
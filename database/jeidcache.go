@@ -0,0 +1,198 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// redisInvalidateChannel is the channel invalidation messages of client side caching are redirected to
+const redisInvalidateChannel = "__redis__:invalidate"
+
+// jobExecutionCacheMaxAge is how long a JEID hash is assumed unchanged without an invalidation
+// message before it is read again, which bounds the damage of a missed invalidation
+const jobExecutionCacheMaxAge = time.Minute
+
+// jobExecutionCache tracks which JEID hashes have changed since they were last read, using
+// client side caching in broadcasting mode so that unchanged job execution stats aren't
+// read from Redis and written to RethinkDB every pass.
+//
+// Invalidation messages are redirected to a subscriber connection. A separate tracking
+// connection has tracking enabled on every connect, and everything is considered changed
+// whenever either connection reconnects since invalidation messages may have been missed.
+type jobExecutionCache struct {
+	subscriber *redis.Client
+	tracker    *redis.Client
+	prefixes   []string
+
+	// redirect is the client id of the subscriber connection
+	redirect int64
+	// connects is incremented every time the subscriber or tracker connects
+	connects int64
+
+	mu sync.Mutex
+	// tracked is the value of connects when tracking was last enabled
+	tracked int64
+	// read holds the time each unchanged key was last read
+	read map[string]time.Time
+}
+
+// newJobExecutionCache returns a cache tracking changes to keys with the given prefixes
+func newJobExecutionCache(ctx context.Context, client redis.UniversalClient, prefixes []string) (*jobExecutionCache, error) {
+	c, ok := client.(*redis.Client)
+	if !ok {
+		return nil, errors.New("client side caching of job executions is not supported in cluster mode")
+	}
+	cache := &jobExecutionCache{prefixes: prefixes, read: make(map[string]time.Time)}
+
+	subscriberOpts := *c.Options()
+	subscriberOpts.Protocol = 2
+	subscriberOpts.PoolSize = 1
+	subscriberOpts.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		id, err := cn.ClientID(ctx).Result()
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&cache.redirect, id)
+		atomic.AddInt64(&cache.connects, 1)
+		return nil
+	}
+	cache.subscriber = redis.NewClient(&subscriberOpts)
+
+	trackerOpts := *c.Options()
+	trackerOpts.PoolSize = 1
+	trackerOpts.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		atomic.AddInt64(&cache.connects, 1)
+		return cache.track(ctx, cn)
+	}
+	cache.tracker = redis.NewClient(&trackerOpts)
+
+	pubsub := cache.subscriber.Subscribe(ctx, redisInvalidateChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close()
+		return nil, err
+	}
+	go cache.listen(pubsub)
+
+	if err := cache.tracker.Ping(ctx).Err(); err != nil {
+		_ = pubsub.Close()
+		return nil, err
+	}
+	return cache, nil
+}
+
+// track (re)enables tracking of the cached key prefixes on cn, redirecting invalidation messages
+// to the subscriber
+func (c *jobExecutionCache) track(ctx context.Context, cn redis.Cmdable) error {
+	args := []interface{}{"CLIENT", "TRACKING", "on", "REDIRECT", atomic.LoadInt64(&c.redirect), "BCAST"}
+	for _, prefix := range c.prefixes {
+		args = append(args, "PREFIX", prefix)
+	}
+	_, err := cn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Do(ctx, "CLIENT", "TRACKING", "off")
+		pipe.Do(ctx, args...)
+		return nil
+	})
+	return err
+}
+
+// listen invalidates the keys of invalidation messages until pubsub is closed
+func (c *jobExecutionCache) listen(pubsub *redis.PubSub) {
+	ctx := context.Background()
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if errors.Is(err, redis.ErrClosed) {
+			return
+		} else if err != nil {
+			time.Sleep(time.Second)
+		}
+		switch msg := msg.(type) {
+		case *redis.Message:
+			c.invalidate(msg.PayloadSlice...)
+			if msg.Payload != "" {
+				c.invalidate(msg.Payload)
+			}
+		default:
+			if err != nil {
+				// a flush of the database is sent as an invalidation message without keys, which
+				// isn't parsed, so anything but a message invalidates every key
+				log.Debug().Err(err).Str("component", "redis").Msg("Invalidating cached job executions")
+			}
+			c.invalidateAll()
+		}
+	}
+}
+
+// sync makes sure tracking is enabled for the current subscriber connection, invalidating
+// every key if the subscriber or tracker reconnected since the last call
+func (c *jobExecutionCache) sync(ctx context.Context) error {
+	if err := c.tracker.Ping(ctx).Err(); err != nil {
+		c.invalidateAll()
+		return err
+	}
+	connects := atomic.LoadInt64(&c.connects)
+	c.mu.Lock()
+	changed := connects != c.tracked
+	c.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	if err := c.track(ctx, c.tracker); err != nil {
+		return err
+	}
+	c.invalidateAll()
+	c.mu.Lock()
+	c.tracked = connects
+	c.mu.Unlock()
+	return nil
+}
+
+// stale reports whether key must be read because it may have changed since it was last read,
+// and records it as read if so
+func (c *jobExecutionCache) stale(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if last, ok := c.read[key]; ok && now.Sub(last) < jobExecutionCacheMaxAge {
+		return false
+	}
+	c.read[key] = now
+	return true
+}
+
+// invalidate records that keys have changed
+func (c *jobExecutionCache) invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		delete(c.read, key)
+	}
+}
+
+// invalidateAll records that every key may have changed
+func (c *jobExecutionCache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.read = make(map[string]time.Time)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// ExpireJobExecutions expires the JEID hashes of job executions that have ended in RethinkDB
+// after ttl, or deletes them if ttl is zero, and returns the number of hashes expired or deleted.
+//
+// Hashes that already have a TTL are left alone so that their expiry isn't pushed out by
+// every pass.
+func (d *database) ExpireJobExecutions(ctx context.Context, ttl time.Duration) (int, error) {
+	if d.rethinkDB.skip(ctx, "expire-job-executions") {
+		return 0, nil
+	}
+	return d.forEachLayout(ctx, func(k keys) (int, error) {
+		if !k.owns(k.jobExecutionPrefix) {
+			return 0, nil
+		}
+		count := 0
+		err := forEachMaster(ctx, d.redis, func(node redis.UniversalClient) error {
+			var cursor uint64
+			for {
+				keys, next, err := node.Scan(ctx, cursor, k.jobExecutionPrefix+"*", jobExecutionScanCount).Result()
+				if err != nil {
+					return err
+				}
+				if len(keys) > 0 {
+					n, err := d.expireJobExecutions(ctx, node, k.jobExecutionPrefix, keys, ttl)
+					count += n
+					if err != nil {
+						return err
+					}
+				}
+				if next == 0 {
+					return nil
+				}
+				cursor = next
+			}
+		})
+		if err != nil {
+			return count, fmt.Errorf("failed to expire job executions: %w", err)
+		}
+		return count, nil
+	})
+}
+
+// expireJobExecutions expires the given JEID keys of job executions that have ended
+func (d *database) expireJobExecutions(ctx context.Context, client redis.UniversalClient, prefix string, keys []string, ttl time.Duration) (int, error) {
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = strings.TrimPrefix(key, prefix)
+	}
+	ended, err := endedJobExecutions(d.rethinkDB, ctx, ids)
+	if err != nil || len(ended) == 0 {
+		return 0, err
+	}
+
+	pipe := client.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(ended))
+	for i, id := range ended {
+		ttls[i] = pipe.TTL(ctx, prefix+id)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, err
+	}
+	var expire []string
+	for i, id := range ended {
+		// a TTL of -1 means the key exists without a TTL
+		if ttls[i].Val() == -1 {
+			expire = append(expire, prefix+id)
+		}
+	}
+	if len(expire) == 0 {
+		return 0, nil
+	}
+	if d.dryRun {
+		d.wouldDo(ctx, "expire-job-executions", prefix, len(expire))
+		return 0, nil
+	}
+
+	pipe = client.Pipeline()
+	for _, key := range expire {
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		} else {
+			pipe.Del(ctx, key)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return len(expire), nil
+}
+
+// endedJobExecutions returns the ids of the job executions that have ended
+func endedJobExecutions(rethinkDB *RethinkDbConnection, ctx context.Context, ids []string) ([]string, error) {
+	term := r.Table(rethinkDbTableJobExecutions).GetAll(r.Args(ids)).
+		Filter(func(doc r.Term) interface{} {
+			return r.Expr(jobExecutionTerminalStates).Contains(doc.Field("state"))
+		}).
+		Field("id")
+	cursor, err := rethinkDB.execRead(ctx, "get-ended-job-executions", &term, len(ids))
+	if err != nil {
+		return nil, err
+	}
+	var ended []string
+	err = cursor.All(&ended)
+	return ended, err
+}
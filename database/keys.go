@@ -0,0 +1,212 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keys holds the names of the redis keys shared with the frontier
+type keys struct {
+	removeUriQueue              string
+	removeUriHighQueue          string
+	removeUriStream             string
+	jobExecutionPrefix          string
+	waitQueue                   string
+	readyQueue                  string
+	busyQueue                   string
+	timeoutQueue                string
+	crawlExecutionRunningQueue  string
+	crawlExecutionTimeoutQueue  string
+	crawlExecutionAbortedStream string
+
+	// shared holds the key names that are also in an earlier layout, see markShared
+	shared map[string]bool
+}
+
+// defaultKeys is the key layout used by the frontier
+var defaultKeys = keys{
+	removeUriQueue:              redisRemoveUriQueue,
+	removeUriHighQueue:          redisRemoveUriHighQueue,
+	removeUriStream:             redisRemoveUriStream,
+	jobExecutionPrefix:          redisJobExecutionPrefix,
+	waitQueue:                   redisWaitQueue,
+	readyQueue:                  redisReadyQueue,
+	busyQueue:                   redisBusyQueue,
+	timeoutQueue:                redisTimeoutQueue,
+	crawlExecutionRunningQueue:  redisCrawlExecutionRunningQueue,
+	crawlExecutionTimeoutQueue:  redisCrawlExecutionTimeoutQueue,
+	crawlExecutionAbortedStream: redisCrawlExecutionAbortedStream,
+}
+
+// names returns pointers to every key name in k
+func (k *keys) names() []*string {
+	return []*string{
+		&k.removeUriQueue,
+		&k.removeUriHighQueue,
+		&k.removeUriStream,
+		&k.jobExecutionPrefix,
+		&k.waitQueue,
+		&k.readyQueue,
+		&k.busyQueue,
+		&k.timeoutQueue,
+		&k.crawlExecutionRunningQueue,
+		&k.crawlExecutionTimeoutQueue,
+		&k.crawlExecutionAbortedStream,
+	}
+}
+
+// owns reports whether name isn't also in an earlier layout. Operations on a key are only done
+// with the layout that owns it so that keys left unmapped aren't operated on or counted twice.
+func (k keys) owns(name string) bool {
+	return !k.shared[name]
+}
+
+// markShared marks the key names of each layout that are also in an earlier layout
+func markShared(layouts []keys) []keys {
+	seen := make(map[string]bool)
+	for i := range layouts {
+		shared := make(map[string]bool)
+		for _, name := range layouts[i].names() {
+			if seen[*name] {
+				shared[*name] = true
+			}
+		}
+		for _, name := range layouts[i].names() {
+			seen[*name] = true
+		}
+		layouts[i].shared = shared
+	}
+	return layouts
+}
+
+// mapped returns a copy of k where key names found in mapping are replaced
+func (k keys) mapped(mapping map[string]string) keys {
+	for _, name := range k.names() {
+		if to, ok := mapping[*name]; ok {
+			*name = to
+		}
+	}
+	return k
+}
+
+// prefixed returns a copy of k where every key name is prefixed with prefix
+func (k keys) prefixed(prefix string) keys {
+	for _, name := range k.names() {
+		*name = prefix + *name
+	}
+	return k
+}
+
+// sharded returns a copy of k where the hash tags of the crawl host group queues are suffixed
+// with shard, e.g. chg_wait{chg3} for shard 3 of chg_wait{chg}
+func (k keys) sharded(shard int) keys {
+	for _, name := range []*string{&k.waitQueue, &k.readyQueue, &k.busyQueue, &k.timeoutQueue} {
+		*name = shardedKey(*name, shard)
+	}
+	return k
+}
+
+// shardedKey returns key with its hash tag suffixed with shard, or with a hash tag holding
+// shard appended if key has no hash tag
+func shardedKey(key string, shard int) string {
+	n := strconv.Itoa(shard)
+	if tag := hashTag(key); tag != key {
+		start := strings.IndexByte(key, '{') + 1
+		return key[:start+len(tag)] + n + key[start+len(tag):]
+	}
+	return key + "{" + n + "}"
+}
+
+// chgShardLayouts returns the key layouts of the crawl host group queues, which are the layouts
+// with each of their crawl host group queues split into shards (0 for no sharding)
+func chgShardLayouts(layouts []keys, shards int) []keys {
+	if shards <= 0 {
+		return layouts
+	}
+	sharded := make([]keys, 0, len(layouts)*shards)
+	for _, k := range layouts {
+		for i := 0; i < shards; i++ {
+			sharded = append(sharded, k.sharded(i))
+		}
+	}
+	return markShared(sharded)
+}
+
+// KeyMappingOptions configures remapping of redis key names during frontier key migrations
+type KeyMappingOptions struct {
+	// Mapping maps default key names to new key names
+	Mapping map[string]string
+	// MappedOnly makes the workers operate on the mapped key names only instead of
+	// on both the default and the mapped key names
+	MappedOnly bool
+}
+
+// ParseKeyMapping parses a key mapping on the form "old=new,old2=new2"
+func ParseKeyMapping(s string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid key mapping: %s", pair)
+		}
+		mapping[from] = to
+	}
+	return mapping, nil
+}
+
+// keyLayouts returns the key layouts the workers should operate on, with every key name prefixed with prefix
+func keyLayouts(opts KeyMappingOptions, prefix string) ([]keys, error) {
+	layouts, err := mappedKeyLayouts(opts)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		for i, k := range layouts {
+			layouts[i] = k.prefixed(prefix)
+		}
+	}
+	return markShared(layouts), nil
+}
+
+func mappedKeyLayouts(opts KeyMappingOptions) ([]keys, error) {
+	if len(opts.Mapping) == 0 {
+		return []keys{defaultKeys}, nil
+	}
+
+	known := make(map[string]bool)
+	for _, name := range defaultKeys.names() {
+		known[*name] = true
+	}
+	for from := range opts.Mapping {
+		if !known[from] {
+			return nil, fmt.Errorf("unknown key in key mapping: %s", from)
+		}
+	}
+
+	mapped := defaultKeys.mapped(opts.Mapping)
+	if opts.MappedOnly {
+		return []keys{mapped}, nil
+	}
+	return []keys{defaultKeys, mapped}, nil
+}
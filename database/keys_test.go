@@ -0,0 +1,184 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// owners returns the number of layouts owning each key name
+func owners(layouts []keys) map[string]int {
+	owners := make(map[string]int)
+	for _, k := range layouts {
+		for _, name := range k.names() {
+			if _, ok := owners[*name]; !ok {
+				owners[*name] = 0
+			}
+			if k.owns(*name) {
+				owners[*name]++
+			}
+		}
+	}
+	return owners
+}
+
+func TestKeyLayouts(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        KeyMappingOptions
+		prefix      string
+		shards      int
+		wantLayouts int
+		wantChg     int
+		wantKeys    []string // mapped key names expected in the chg layouts
+		wantErr     bool
+	}{
+		{
+			name:        "no mapping",
+			wantLayouts: 1,
+			wantChg:     1,
+		},
+		{
+			name:        "mapped key is added",
+			opts:        KeyMappingOptions{Mapping: map[string]string{redisReadyQueue: "ready{chg}"}},
+			wantLayouts: 2,
+			wantChg:     2,
+			wantKeys:    []string{"ready{chg}"},
+		},
+		{
+			name:        "mapped only",
+			opts:        KeyMappingOptions{Mapping: map[string]string{redisRemoveUriQueue: "REMURI2"}, MappedOnly: true},
+			wantLayouts: 1,
+			wantChg:     1,
+			wantKeys:    []string{"REMURI2"},
+		},
+		{
+			name:        "prefixed",
+			opts:        KeyMappingOptions{Mapping: map[string]string{redisRemoveUriQueue: "REMURI2"}},
+			prefix:      "p:",
+			wantLayouts: 2,
+			wantChg:     2,
+			wantKeys:    []string{"p:REMURI2"},
+		},
+		{
+			name:        "sharded",
+			opts:        KeyMappingOptions{Mapping: map[string]string{redisWaitQueue: "wait{chg}"}},
+			shards:      2,
+			wantLayouts: 2,
+			wantChg:     4,
+			wantKeys:    []string{"wait{chg0}", "wait{chg1}"},
+		},
+		{
+			name:    "unknown key",
+			opts:    KeyMappingOptions{Mapping: map[string]string{"unknown": "other"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layouts, err := keyLayouts(tt.opts, tt.prefix)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("keyLayouts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			chgLayouts := chgShardLayouts(layouts, tt.shards)
+			if len(layouts) != tt.wantLayouts || len(chgLayouts) != tt.wantChg {
+				t.Fatalf("got %d layouts and %d chg layouts, want %d and %d", len(layouts), len(chgLayouts), tt.wantLayouts, tt.wantChg)
+			}
+			for _, l := range [][]keys{layouts, chgLayouts} {
+				for name, n := range owners(l) {
+					if n != 1 {
+						t.Errorf("key %s is owned by %d layouts, want 1", name, n)
+					}
+				}
+			}
+			names := owners(chgLayouts)
+			for _, want := range tt.wantKeys {
+				if _, ok := names[want]; !ok {
+					t.Errorf("key %s not in chg layouts", want)
+				}
+			}
+		})
+	}
+}
+
+// TestKeyMappingCountsOnce checks that queues left unmapped are only counted once when
+// the workers operate on both the default and the mapped key names
+func TestKeyMappingCountsOnce(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestScript(t)
+	db, err := NewDatabase(ctx, client, nil, Options{
+		KeyMapping: KeyMappingOptions{Mapping: map[string]string{redisReadyQueue: "ready{chg}"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for queue, items := range map[string][]interface{}{
+		redisReadyQueue:                 {"a", "b"},
+		"ready{chg}":                    {"c"},
+		redisTimeoutQueue:               {"d"},
+		redisCrawlExecutionTimeoutQueue: {"ce1"},
+		redisRemoveUriQueue:             {"u1", "u2"},
+	} {
+		if err := client.RPush(ctx, queue, items...).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := db.ReadyQueueLength(ctx); err != nil || n != 3 {
+		t.Errorf("ReadyQueueLength() = %d, %v, want 3", n, err)
+	}
+	sample, err := db.LagSample(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sample.TimeoutQueueLength != 2 {
+		t.Errorf("TimeoutQueueLength = %d, want 2", sample.TimeoutQueueLength)
+	}
+	if sample.RemoveUriQueueLength != 2 {
+		t.Errorf("RemoveUriQueueLength = %d, want 2", sample.RemoveUriQueueLength)
+	}
+}
+
+// TestWaitForRemoveUriQueueWatchesEveryLayout checks that uris queued in the remove queue of any
+// key layout are noticed without reordering the queue
+func TestWaitForRemoveUriQueueWatchesEveryLayout(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestScript(t)
+	db, err := NewDatabase(ctx, client, nil, Options{
+		KeyMapping: KeyMappingOptions{Mapping: map[string]string{redisRemoveUriQueue: "REMURI2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RPush(ctx, redisRemoveUriQueue, "a", "b", "c").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if queued, err := db.WaitForRemoveUriQueue(ctx, time.Second); err != nil || !queued {
+		t.Fatalf("WaitForRemoveUriQueue() = %v, %v, want true, nil", queued, err)
+	}
+	if queue, _ := client.LRange(ctx, redisRemoveUriQueue, 0, -1).Result(); !equalStrings(queue, []string{"a", "b", "c"}) {
+		t.Errorf("queue = %v, want [a b c]", queue)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+)
+
+const (
+	// latencySmoothing is the weight of the latest query duration in the smoothed query latency
+	latencySmoothing = 0.2
+	// latencyMaxAge is how long the smoothed query latency is considered current after the last query
+	latencyMaxAge = time.Minute
+)
+
+// latencyTracker keeps a moving average of the duration of RethinkDB queries
+type latencyTracker struct {
+	mu      sync.Mutex
+	average float64
+	last    time.Time
+}
+
+// observe records the duration of a query
+func (t *latencyTracker) observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.last.IsZero() {
+		t.average = d.Seconds()
+	} else {
+		t.average = latencySmoothing*d.Seconds() + (1-latencySmoothing)*t.average
+	}
+	t.last = time.Now()
+	metrics.RethinkDbLatency.Set(t.average)
+}
+
+// Latency returns the moving average of the duration of recent queries, or zero if there has
+// been no query in a while
+func (c *RethinkDbConnection) Latency() time.Duration {
+	t := &c.latency
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.last) > latencyMaxAge {
+		return 0
+	}
+	return time.Duration(t.average * float64(time.Second))
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// redisLeaderKey holds the token of the replica elected to run the workers
+const redisLeaderKey = "frontier:qw:leader"
+
+// LeaderElectionOptions configures a LeaderElection
+type LeaderElectionOptions struct {
+	// Owner identifies the replica in its token, e.g. the host name
+	Owner string
+	// Ttl is the TTL of the leader key. Standby replicas take over at most Ttl after the
+	// leader died, and the leader steps down if it fails to renew the key within Ttl.
+	Ttl time.Duration
+}
+
+// LeaderElection elects one of several replicas as the leader with a Redis key set with SET NX
+// and a TTL, which the leader renews every third of the TTL and deletes when it stops.
+type LeaderElection struct {
+	lease *lease
+}
+
+// NewLeaderElection returns a LeaderElection, which campaigns for leadership when Run is called
+func NewLeaderElection(redisClient redis.UniversalClient, opts LeaderElectionOptions) *LeaderElection {
+	return &LeaderElection{
+		lease: newLease(redisClient, redisLeaderKey, opts.Owner, opts.Ttl),
+	}
+}
+
+// IsLeader returns true if this replica is the leader. A leader that has not renewed the leader
+// key within its TTL is not considered the leader, since another replica may have taken over.
+func (e *LeaderElection) IsLeader() bool {
+	return e.lease.held()
+}
+
+// Run campaigns for leadership until ctx is done, then steps down
+func (e *LeaderElection) Run(ctx context.Context) {
+	log.Info().Str("token", e.lease.token).Dur("ttl", e.lease.ttl).Msg("Campaigning for leadership")
+	ticker := time.NewTicker(e.lease.ttl / 3)
+	defer ticker.Stop()
+	for {
+		e.Campaign(ctx)
+		select {
+		case <-ctx.Done():
+			e.resign()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Campaign takes the leader key if it is free or renews it if it is held by this replica and
+// returns true if this replica is the leader
+func (e *LeaderElection) Campaign(ctx context.Context) bool {
+	was, is, err := e.lease.acquire(ctx)
+	switch {
+	case err != nil:
+		log.Warn().Err(err).Bool("leader", was).Msg("Failed to campaign for leadership")
+		if was && !is {
+			log.Error().Msg("Failed to renew leadership in time, stepping down")
+			metrics.Leader.Set(0)
+		}
+	case is && !was:
+		log.Info().Msg("Elected leader")
+		metrics.Leader.Set(1)
+	case was && !is:
+		log.Error().Msg("Lost leadership to another replica")
+		metrics.Leader.Set(0)
+	}
+	return is
+}
+
+// resign steps down and deletes the leader key if it is held by this replica, letting a
+// standby replica take over without waiting for the key to expire
+func (e *LeaderElection) resign() {
+	// ctx of Run is done when it resigns
+	held, err := e.lease.release(context.Background())
+	if !held {
+		return
+	}
+	metrics.Leader.Set(0)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to resign leadership, it is handed over when the leader key expires")
+		return
+	}
+	log.Info().Msg("Resigned leadership")
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// leaseReleaseScript deletes the key of a lease if it still holds the token
+var leaseReleaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+    return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// lease is a Redis key held by one replica at a time, which is set with SET NX and a TTL and
+// renewed by its holder before it expires
+type lease struct {
+	redis redis.UniversalClient
+	key   string
+	token string
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	renewed time.Time
+}
+
+func newLease(redisClient redis.UniversalClient, key string, owner string, ttl time.Duration) *lease {
+	return &lease{
+		redis: redisClient,
+		key:   key,
+		token: owner + "/" + newIdempotencyToken(),
+		ttl:   ttl,
+	}
+}
+
+// held returns true if the lease is held. A lease that has not been renewed within its TTL is
+// not considered held, since another replica may have taken it.
+func (l *lease) held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.renewed.IsZero() && time.Since(l.renewed) < l.ttl
+}
+
+// acquire takes the key if it is free or renews it if it is held and returns whether the
+// lease was held before and after
+func (l *lease) acquire(ctx context.Context) (was bool, is bool, err error) {
+	was = l.held()
+	start := time.Now()
+	if was {
+		var n int
+		n, err = maintenanceRefreshScript.Run(ctx, l.redis, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+		is = n == 1
+	} else {
+		is, err = l.redis.SetNX(ctx, l.key, l.token, l.ttl).Result()
+	}
+	if err != nil {
+		return was, l.held(), err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if is {
+		// the key may expire ttl after the command was sent
+		l.renewed = start
+	} else {
+		l.renewed = time.Time{}
+	}
+	return was, is, nil
+}
+
+// release deletes the key if the lease is held, letting another replica take it without
+// waiting for the key to expire, and returns whether the lease was held
+func (l *lease) release(ctx context.Context) (bool, error) {
+	if !l.held() {
+		return false, nil
+	}
+	l.mu.Lock()
+	l.renewed = time.Time{}
+	l.mu.Unlock()
+	return true, leaseReleaseScript.Run(ctx, l.redis, []string{l.key}, l.token).Err()
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// The maintenance lock is shared with the frontier:
+//
+//   - A holder sets redisMaintenanceLockKey to a unique token with SET NX and a TTL, which it
+//     refreshes while holding the lock.
+//   - The frontier does not hand out crawl host groups while the lock key exists, and
+//     acknowledges that it has paused scheduling by setting redisMaintenanceAckKey to the token
+//     of the lock.
+//   - The holder waits for the acknowledgement before making structural changes, and releases
+//     the lock by deleting the lock key if it still holds its token, then the acknowledgement.
+const (
+	redisMaintenanceLockKey = "frontier:maintenance"
+	redisMaintenanceAckKey  = "frontier:maintenance:ack"
+)
+
+// ErrMaintenanceLocked is returned when the maintenance lock is held by someone else
+var ErrMaintenanceLocked = errors.New("maintenance lock is held by someone else")
+
+// ErrMaintenanceNotAcknowledged is returned when the frontier did not acknowledge the maintenance lock in time
+var ErrMaintenanceNotAcknowledged = errors.New("frontier did not acknowledge maintenance lock")
+
+// maintenanceRefreshScript extends the TTL of the lock if it still holds the token
+var maintenanceRefreshScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+    return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// MaintenanceLockOptions configures a MaintenanceLock
+type MaintenanceLockOptions struct {
+	// Owner identifies the holder of the lock in its token, e.g. the host name
+	Owner string
+	// Ttl is the TTL of the lock key, which is refreshed while the lock is held
+	Ttl time.Duration
+	// AckTimeout is how long to wait for the frontier to acknowledge the lock (0 to not wait)
+	AckTimeout time.Duration
+}
+
+// MaintenanceLock requests the frontier to pause scheduling during repairs and migrations
+type MaintenanceLock struct {
+	redis redis.UniversalClient
+	opts  MaintenanceLockOptions
+}
+
+// NewMaintenanceLock returns a MaintenanceLock
+func NewMaintenanceLock(redisClient redis.UniversalClient, opts MaintenanceLockOptions) *MaintenanceLock {
+	return &MaintenanceLock{
+		redis: redisClient,
+		opts:  opts,
+	}
+}
+
+// Acquire takes the maintenance lock and waits for the frontier to acknowledge it. The returned
+// function releases the lock and must be called when the maintenance is done.
+func (m *MaintenanceLock) Acquire(ctx context.Context, reason string) (func(), error) {
+	token := m.opts.Owner + "/" + newIdempotencyToken()
+	ok, err := m.redis.SetNX(ctx, redisMaintenanceLockKey, token, m.opts.Ttl).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire maintenance lock: %w", err)
+	}
+	if !ok {
+		return nil, ErrMaintenanceLocked
+	}
+
+	refreshCtx, stopRefresh := context.WithCancel(context.Background())
+	go m.refresh(refreshCtx, token)
+	release := func() {
+		stopRefresh()
+		// the lock and its acknowledgement are deleted one at a time since they may be in
+		// different slots of a cluster
+		released, err := leaseReleaseScript.Run(context.Background(), m.redis, []string{redisMaintenanceLockKey}, token).Int()
+		if err != nil {
+			log.Warn().Err(err).Str("reason", reason).Msg("Failed to release maintenance lock, it is released when it expires")
+			return
+		}
+		if released == 1 {
+			if err := m.redis.Del(context.Background(), redisMaintenanceAckKey).Err(); err != nil {
+				log.Warn().Err(err).Str("reason", reason).Msg("Failed to delete maintenance lock acknowledgement")
+			}
+		}
+		log.Info().Str("reason", reason).Msg("Released maintenance lock")
+	}
+
+	if err := m.awaitAck(ctx, token); err != nil {
+		release()
+		return nil, err
+	}
+	log.Info().Str("reason", reason).Msg("Acquired maintenance lock")
+	return release, nil
+}
+
+// awaitAck waits until the frontier has acknowledged the lock with token
+func (m *MaintenanceLock) awaitAck(ctx context.Context, token string) error {
+	if m.opts.AckTimeout <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(m.opts.AckTimeout)
+	for {
+		ack, err := m.redis.Get(ctx, redisMaintenanceAckKey).Result()
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("failed to get maintenance lock acknowledgement: %w", err)
+		}
+		if ack == token {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrMaintenanceNotAcknowledged
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// refresh extends the TTL of the lock with token until ctx is done
+func (m *MaintenanceLock) refresh(ctx context.Context, token string) {
+	ticker := time.NewTicker(m.opts.Ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ok, err := maintenanceRefreshScript.Run(ctx, m.redis, []string{redisMaintenanceLockKey}, token, m.opts.Ttl.Milliseconds()).Int()
+			if err != nil {
+				log.Warn().Err(err).Msg("Failed to refresh maintenance lock")
+			} else if ok == 0 {
+				log.Error().Msg("Lost maintenance lock before maintenance was done")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"bufio"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// MemoryMonitor detects when Redis approaches its memory limit, so that workers draining the
+// queues can be given priority over workers that only read from Redis
+type MemoryMonitor struct {
+	redis     redis.UniversalClient
+	threshold float64
+
+	mu       sync.Mutex
+	pressure bool
+}
+
+// NewMemoryMonitor returns a MemoryMonitor reporting pressure when the used memory of a Redis
+// master exceeds threshold (0-1) of its maxmemory
+func NewMemoryMonitor(redisClient redis.UniversalClient, threshold float64) *MemoryMonitor {
+	return &MemoryMonitor{
+		redis:     redisClient,
+		threshold: threshold,
+	}
+}
+
+// Check reads the memory usage of every master and returns the highest ratio of used memory to
+// maxmemory. Masters without maxmemory are ignored.
+func (m *MemoryMonitor) Check(ctx context.Context) (float64, error) {
+	var usage float64
+	err := forEachMaster(ctx, m.redis, func(node redis.UniversalClient) error {
+		info, err := node.Info(ctx, "memory").Result()
+		if err != nil {
+			return err
+		}
+		fields := parseInfo(info)
+		used, _ := strconv.ParseFloat(fields["used_memory"], 64)
+		max, _ := strconv.ParseFloat(fields["maxmemory"], 64)
+		if max > 0 && used/max > usage {
+			usage = used / max
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	metrics.RedisMemoryUsage.Set(usage)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pressure := usage > m.threshold
+	if pressure {
+		log.Warn().Str("component", "redis").Float64("usage", usage).Float64("threshold", m.threshold).
+			Msg("Redis is approaching its memory limit, prioritizing draining workers")
+	} else if m.pressure {
+		log.Info().Str("component", "redis").Float64("usage", usage).Msg("Redis memory pressure relieved")
+	}
+	m.pressure = pressure
+	return usage, nil
+}
+
+// UnderPressure returns true if Redis was approaching its memory limit at the last check
+func (m *MemoryMonitor) UnderPressure() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pressure
+}
+
+// parseInfo returns the fields of the output of the INFO command
+func parseInfo(info string) map[string]string {
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+	return fields
+}
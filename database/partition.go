@@ -0,0 +1,84 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"hash/fnv"
+)
+
+type partitionKey struct{}
+
+type batchSizeKey struct{}
+
+// partition identifies which of count concurrent consumers of a queue is calling
+type partition struct {
+	index int
+	count int
+}
+
+// WithPartition returns a context making queue operations only process the items
+// belonging to partition index of count concurrent consumers
+func WithPartition(ctx context.Context, index int, count int) context.Context {
+	return context.WithValue(ctx, partitionKey{}, partition{index: index, count: count})
+}
+
+// partitionFromContext returns the partition of ctx, which is the only partition if none is set
+func partitionFromContext(ctx context.Context) partition {
+	if p, ok := ctx.Value(partitionKey{}).(partition); ok && p.count > 1 {
+		return p
+	}
+	return partition{index: 0, count: 1}
+}
+
+// WithBatchSize returns a context making queue operations process batches of up to size
+// items instead of the default batch size
+func WithBatchSize(ctx context.Context, size int) context.Context {
+	return context.WithValue(ctx, batchSizeKey{}, size)
+}
+
+// batchSizeFromContext returns the batch size of ctx, which is RemoveUriQueueBatchSize if none is set
+func batchSizeFromContext(ctx context.Context) int {
+	if size, ok := ctx.Value(batchSizeKey{}).(int); ok && size > 0 {
+		return size
+	}
+	return RemoveUriQueueBatchSize
+}
+
+// owns returns true if item belongs to the partition
+func (p partition) owns(item string) bool {
+	if p.count <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(item))
+	return int(h.Sum32()%uint32(p.count)) == p.index
+}
+
+// filter returns the items belonging to the partition
+func (p partition) filter(items []string) []string {
+	if p.count <= 1 {
+		return items
+	}
+	owned := items[:0:0]
+	for _, item := range items {
+		if p.owns(item) {
+			owned = append(owned, item)
+		}
+	}
+	return owned
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// redisPauseKey is set by the frontier while the crawler is paused
+const redisPauseKey = "frontier:paused"
+
+// PauseFlag reads the frontier's global pause flag, which exists while the crawler is paused
+type PauseFlag struct {
+	redis    redis.UniversalClient
+	interval time.Duration
+
+	mu      sync.Mutex
+	paused  bool
+	checked time.Time
+}
+
+// NewPauseFlag returns a PauseFlag that checks the pause key at most every interval
+func NewPauseFlag(redisClient redis.UniversalClient, interval time.Duration) *PauseFlag {
+	return &PauseFlag{
+		redis:    redisClient,
+		interval: interval,
+	}
+}
+
+// Paused returns true if the crawler is paused
+func (p *PauseFlag) Paused(ctx context.Context) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.checked) < p.interval {
+		return p.paused, nil
+	}
+	n, err := p.redis.Exists(ctx, redisPauseKey).Result()
+	if err != nil {
+		return false, err
+	}
+	if paused := n > 0; paused != p.paused {
+		if paused {
+			log.Info().Msg("Crawler is paused, holding off paused workers")
+			metrics.FrontierPaused.Set(1)
+		} else {
+			log.Info().Msg("Crawler is resumed")
+			metrics.FrontierPaused.Set(0)
+		}
+		p.paused = paused
+	}
+	p.checked = time.Now()
+	return p.paused, nil
+}
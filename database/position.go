@@ -0,0 +1,275 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// ErrInvalidQueuePositionRequest is returned when a queue position request is invalid
+var ErrInvalidQueuePositionRequest = errors.New("invalid queue position request")
+
+// States of a crawl host group in the frontier queues
+const (
+	// CrawlHostGroupReady is a crawl host group in the ready queue waiting for a harvester
+	CrawlHostGroupReady = "ready"
+	// CrawlHostGroupWaiting is a crawl host group in the wait queue waiting out its politeness delay
+	CrawlHostGroupWaiting = "waiting"
+	// CrawlHostGroupBusy is a crawl host group being fetched by a harvester
+	CrawlHostGroupBusy = "busy"
+	// CrawlHostGroupTimeout is a crawl host group in the timeout queue after its busy timeout expired
+	CrawlHostGroupTimeout = "timeout"
+	// CrawlHostGroupIdle is a crawl host group in none of the queues
+	CrawlHostGroupIdle = "idle"
+)
+
+// CrawlHostGroupState is the presence of a crawl host group in one of the frontier queues
+type CrawlHostGroupState struct {
+	// State is the queue the crawl host group is in (ready, waiting, busy or timeout)
+	State string `json:"state"`
+	// Queue is the key name of the queue
+	Queue string `json:"queue"`
+	// Position is the 1-based position in a ready or timeout queue
+	Position int `json:"position,omitempty"`
+	// DueAt is when a waiting crawl host group is due, or a busy crawl host group times out
+	DueAt time.Time `json:"dueAt,omitempty"`
+}
+
+// QueuePositionRequest identifies the seed or crawl execution to estimate the queue position of
+type QueuePositionRequest struct {
+	SeedId      string `json:"seedId,omitempty"`
+	ExecutionId string `json:"executionId,omitempty"`
+}
+
+// QueuePosition is the estimated position in the frontier of the queued uris of a seed or crawl execution
+type QueuePosition struct {
+	QueuePositionRequest
+	// QueuedUris is the number of queued uris
+	QueuedUris int `json:"queuedUris"`
+	// EstimatedStart is when the first queued uri is estimated to be fetched, zero if nothing is queued
+	EstimatedStart time.Time `json:"estimatedStart,omitempty"`
+	// CrawlHostGroups is the position of each crawl host group holding queued uris
+	CrawlHostGroups []CrawlHostGroupPosition `json:"crawlHostGroups"`
+}
+
+// CrawlHostGroupPosition is the position in the frontier queues of a crawl host group
+type CrawlHostGroupPosition struct {
+	Id string `json:"id"`
+	// QueuedUris is the number of queued uris of the seed or crawl execution in the crawl host group
+	QueuedUris int `json:"queuedUris"`
+	// EarliestFetch is the earliest time any of the queued uris may be fetched
+	EarliestFetch time.Time `json:"earliestFetch,omitempty"`
+	// State is the state of the crawl host group (ready, waiting, busy or idle)
+	State string `json:"state"`
+	// ReadyPosition is the 1-based position in the ready queue of a ready crawl host group
+	ReadyPosition int `json:"readyPosition,omitempty"`
+	// ReadyQueueLength is the length of the ready queue
+	ReadyQueueLength int `json:"readyQueueLength"`
+	// DueAt is when a waiting crawl host group is due, or a busy crawl host group times out
+	DueAt time.Time `json:"dueAt,omitempty"`
+	// EstimatedStart is when the first queued uri in the crawl host group is estimated to be fetched
+	EstimatedStart time.Time `json:"estimatedStart"`
+}
+
+// QueuePosition estimates the position in the frontier of the queued uris of a seed or crawl execution
+// from the state of their crawl host groups in the frontier queues and their earliest fetch times.
+func (d *database) QueuePosition(ctx context.Context, request QueuePositionRequest) (QueuePosition, error) {
+	position := QueuePosition{QueuePositionRequest: request, CrawlHostGroups: []CrawlHostGroupPosition{}}
+
+	var filter r.Term
+	switch {
+	case request.SeedId != "" && request.ExecutionId != "":
+		return position, fmt.Errorf("%w: only one of seedId and executionId may be set", ErrInvalidQueuePositionRequest)
+	case request.SeedId != "":
+		filter = r.Row.Field("seedId").Eq(request.SeedId)
+	case request.ExecutionId != "":
+		filter = r.Row.Field("executionId").Eq(request.ExecutionId)
+	default:
+		return position, fmt.Errorf("%w: seedId or executionId must be set", ErrInvalidQueuePositionRequest)
+	}
+
+	term := r.Table(rethinkDbTableUriQueue).Filter(filter).Group("crawlHostGroupId").Ungroup().Map(func(group r.Term) interface{} {
+		return map[string]interface{}{
+			"id":            group.Field("group"),
+			"queuedUris":    group.Field("reduction").Count(),
+			"earliestFetch": group.Field("reduction").Field("earliestFetchTimeStamp").Min(),
+		}
+	})
+	cursor, err := d.rethinkDB.execRead(ctx, "get-queue-position", &term, 1)
+	if err != nil {
+		return position, err
+	}
+	var groups []struct {
+		Id            string    `rethinkdb:"id"`
+		QueuedUris    int       `rethinkdb:"queuedUris"`
+		EarliestFetch time.Time `rethinkdb:"earliestFetch"`
+	}
+	if err := cursor.All(&groups); err != nil {
+		return position, err
+	}
+	if len(groups) == 0 {
+		return position, nil
+	}
+
+	ready, readyLength, err := d.readyPositions(ctx)
+	if err != nil {
+		return position, err
+	}
+
+	client := d.redis
+	now := time.Now().UTC()
+	for _, group := range groups {
+		chg := CrawlHostGroupPosition{
+			Id:               group.Id,
+			QueuedUris:       group.QueuedUris,
+			EarliestFetch:    group.EarliestFetch,
+			State:            CrawlHostGroupIdle,
+			ReadyQueueLength: readyLength,
+		}
+		if p, ok := ready[group.Id]; ok {
+			chg.State = CrawlHostGroupReady
+			chg.ReadyPosition = p
+			chg.EstimatedStart = now
+		} else if due, state, err := d.crawlHostGroupDue(ctx, client, group.Id); err != nil {
+			return position, err
+		} else if state != "" {
+			chg.State = state
+			chg.DueAt = due
+			chg.EstimatedStart = now
+			if state == CrawlHostGroupWaiting && due.After(now) {
+				chg.EstimatedStart = due
+			}
+		} else {
+			chg.EstimatedStart = now
+		}
+		if chg.EarliestFetch.After(chg.EstimatedStart) {
+			chg.EstimatedStart = chg.EarliestFetch
+		}
+
+		position.QueuedUris += chg.QueuedUris
+		if position.EstimatedStart.IsZero() || chg.EstimatedStart.Before(position.EstimatedStart) {
+			position.EstimatedStart = chg.EstimatedStart
+		}
+		position.CrawlHostGroups = append(position.CrawlHostGroups, chg)
+	}
+	return position, nil
+}
+
+// CrawlHostGroupStates returns every queue a crawl host group is in. A crawl host group should
+// be in at most one queue, but may be observed in none or several while it is being moved.
+func (d *database) CrawlHostGroupStates(ctx context.Context, id string) ([]CrawlHostGroupState, error) {
+	pipe := d.redis.Pipeline()
+	type zsetCmd struct {
+		state string
+		queue string
+		cmd   *redis.FloatCmd
+	}
+	type listCmd struct {
+		state string
+		queue string
+		cmd   *redis.StringSliceCmd
+	}
+	var zsets []zsetCmd
+	var lists []listCmd
+	for _, k := range d.chgLayouts {
+		for _, z := range []struct{ state, queue string }{{CrawlHostGroupWaiting, k.waitQueue}, {CrawlHostGroupBusy, k.busyQueue}} {
+			if k.owns(z.queue) {
+				zsets = append(zsets, zsetCmd{z.state, z.queue, pipe.ZScore(ctx, z.queue, id)})
+			}
+		}
+		for _, l := range []struct{ state, queue string }{{CrawlHostGroupReady, k.readyQueue}, {CrawlHostGroupTimeout, k.timeoutQueue}} {
+			if k.owns(l.queue) {
+				lists = append(lists, listCmd{l.state, l.queue, pipe.LRange(ctx, l.queue, 0, -1)})
+			}
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	var states []CrawlHostGroupState
+	for _, z := range zsets {
+		score, err := z.cmd.Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		states = append(states, CrawlHostGroupState{
+			State: z.state,
+			Queue: z.queue,
+			DueAt: time.Unix(0, int64(score)*int64(time.Millisecond)).UTC(),
+		})
+	}
+	for _, l := range lists {
+		for i, chg := range l.cmd.Val() {
+			if chg == id {
+				states = append(states, CrawlHostGroupState{State: l.state, Queue: l.queue, Position: i + 1})
+			}
+		}
+	}
+	return states, nil
+}
+
+// readyPositions returns the 1-based position of every crawl host group in its ready queue
+// and the total length of the ready queues
+func (d *database) readyPositions(ctx context.Context) (map[string]int, int, error) {
+	positions := make(map[string]int)
+	length := 0
+	for _, k := range d.chgLayouts {
+		if !k.owns(k.readyQueue) {
+			continue
+		}
+		chgs, err := d.redis.LRange(ctx, k.readyQueue, 0, -1).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		for i, chg := range chgs {
+			if _, ok := positions[chg]; !ok {
+				positions[chg] = i + 1
+			}
+		}
+		length += len(chgs)
+	}
+	return positions, length, nil
+}
+
+// crawlHostGroupDue returns the state and due time of a crawl host group in the wait or busy queues,
+// or an empty state if it is in neither
+func (d *database) crawlHostGroupDue(ctx context.Context, client redis.UniversalClient, chg string) (time.Time, string, error) {
+	for _, k := range d.chgLayouts {
+		for _, queue := range []struct {
+			key   string
+			state string
+		}{{k.waitQueue, CrawlHostGroupWaiting}, {k.busyQueue, CrawlHostGroupBusy}} {
+			score, err := client.ZScore(ctx, queue.key, chg).Result()
+			if err == redis.Nil {
+				continue
+			} else if err != nil {
+				return time.Time{}, "", err
+			}
+			return time.Unix(0, int64(score)*int64(time.Millisecond)).UTC(), queue.state, nil
+		}
+	}
+	return time.Time{}, "", nil
+}
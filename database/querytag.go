@@ -0,0 +1,55 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"strings"
+
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+type workerNameKey struct{}
+
+// WithWorkerName returns a context attributing database operations to the named worker
+func WithWorkerName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, workerNameKey{}, name)
+}
+
+// workerName returns the name of the worker of ctx or the empty string
+func workerName(ctx context.Context) string {
+	name, _ := ctx.Value(workerNameKey{}).(string)
+	return name
+}
+
+// tagged returns term wrapped so that the query carries a tag identifying the operation,
+// worker and version. ReQL has no query comments, but the tag is part of the query shown
+// in the rethinkdb.jobs system table, which lets slow query analysis on the server side
+// attribute load to specific worker operations.
+func (c *RethinkDbConnection) tagged(ctx context.Context, name string, term r.Term) r.Term {
+	if c.queryTag == "" {
+		return term
+	}
+	parts := []string{c.queryTag}
+	if worker := workerName(ctx); worker != "" {
+		parts = append(parts, worker)
+	}
+	parts = append(parts, name)
+	return r.Expr(strings.Join(parts, ":")).Do(func(r.Term) r.Term {
+		return term
+	})
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"golang.org/x/time/rate"
+)
+
+// newWriteLimiter returns a token bucket limiting writes to limit documents per second in bursts
+// of up to burst documents, or nil if limit is not positive
+func newWriteLimiter(limit float64, burst int) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// throttleWrite waits until the write rate limit, which is shared by all workers, allows
+// writing n documents or ctx is done. Writes larger than the burst size wait for the
+// tokens a burst at a time.
+func (c *RethinkDbConnection) throttleWrite(ctx context.Context, name string, n int) error {
+	if c.writeLimiter == nil {
+		return nil
+	}
+	start := time.Now()
+	burst := c.writeLimiter.Burst()
+	for n > 0 {
+		tokens := n
+		if tokens > burst {
+			tokens = burst
+		}
+		if err := c.writeLimiter.WaitN(ctx, tokens); err != nil {
+			return fmt.Errorf("failed to %s: write rate limit: %w", name, err)
+		}
+		n -= tokens
+	}
+	metrics.RethinkDbWriteThrottle.WithLabelValues(name).Add(time.Since(start).Seconds())
+	return nil
+}
@@ -17,51 +17,248 @@
 package database
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog/log"
 )
 
-func NewRedisClient(host string, port int) (*redis.Client, error) {
-	addr := fmt.Sprintf("%s:%d", host, port)
-	client := redis.NewClient(&redis.Options{
-		Addr:       addr,
-		MaxRetries: 3,
-	})
+var (
+	// ErrRedisUnavailable is returned when Redis can't be reached
+	ErrRedisUnavailable = errors.New("failed to ping redis")
+	// ErrRedisAuth is returned when Redis rejects the credentials
+	ErrRedisAuth = errors.New("failed to authenticate with redis")
+)
+
+// RedisOptions configures the Redis client
+type RedisOptions struct {
+	// Network is the network type of a single node, either tcp (the default) or unix
+	Network string
+	Host    string
+	Port    int
+	// Socket is the path of the unix socket of a single node (unix network)
+	Socket string
+	// SentinelMaster is the name of the master monitored by Redis Sentinel. If set, the address
+	// of the master is looked up from the sentinels instead of connecting to Host and Port, and
+	// the client reconnects to the new master after a failover.
+	SentinelMaster string
+	// SentinelAddrs are the host:port addresses of the sentinels
+	SentinelAddrs []string
+	// ClusterAddrs are the host:port addresses of Redis Cluster nodes. If set, the client
+	// connects to the cluster and routes each command to the node serving its key.
+	ClusterAddrs []string
+	// TLSConfig enables TLS if set (see TLSOptions)
+	TLSConfig *tls.Config
+	// Username is the ACL user authenticated as with Password (the default user if empty)
+	Username string
+	// Password authenticates the connection if set
+	Password string
+	// DB is the logical database selected after connecting, which must be 0 in a cluster
+	DB int
+	// DialTimeout is the timeout for establishing new connections (the client default if zero)
+	DialTimeout time.Duration
+	// ReadTimeout is the timeout for reading a reply, which is extended by the timeout of
+	// blocking commands (the client default if zero)
+	ReadTimeout time.Duration
+	// WriteTimeout is the timeout for writing a command (the client default if zero)
+	WriteTimeout time.Duration
+}
 
-	_, err := client.Ping().Result()
+func NewRedisClient(ctx context.Context, opts RedisOptions) (redis.UniversalClient, error) {
+	var client redis.UniversalClient
+	var addr string
+	switch {
+	case len(opts.ClusterAddrs) > 0:
+		if opts.DB != 0 {
+			return nil, fmt.Errorf("redis cluster only supports database 0, not %d", opts.DB)
+		}
+		addr = fmt.Sprintf("cluster %s", strings.Join(opts.ClusterAddrs, ","))
+		client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        opts.ClusterAddrs,
+			Username:     opts.Username,
+			Password:     opts.Password,
+			MaxRetries:   3,
+			TLSConfig:    opts.TLSConfig,
+			DialTimeout:  opts.DialTimeout,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+		})
+	case opts.SentinelMaster != "":
+		addr = fmt.Sprintf("%s (sentinels %s)", opts.SentinelMaster, strings.Join(opts.SentinelAddrs, ","))
+		client = redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    opts.SentinelMaster,
+			SentinelAddrs: opts.SentinelAddrs,
+			Username:      opts.Username,
+			Password:      opts.Password,
+			DB:            opts.DB,
+			MaxRetries:    3,
+			TLSConfig:     opts.TLSConfig,
+			DialTimeout:   opts.DialTimeout,
+			ReadTimeout:   opts.ReadTimeout,
+			WriteTimeout:  opts.WriteTimeout,
+		})
+	default:
+		addr = fmt.Sprintf("%s:%d", opts.Host, opts.Port)
+		if opts.Network == "unix" {
+			addr = opts.Socket
+		}
+		client = redis.NewClient(&redis.Options{
+			Network:      opts.Network,
+			Addr:         addr,
+			Username:     opts.Username,
+			Password:     opts.Password,
+			DB:           opts.DB,
+			MaxRetries:   3,
+			TLSConfig:    opts.TLSConfig,
+			DialTimeout:  opts.DialTimeout,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+		})
+	}
+
+	_, err := client.Ping(ctx).Result()
 	if err != nil {
-		return nil, fmt.Errorf("failed to ping redis: %w", err)
+		_ = client.Close()
+		if isRedisAuthError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrRedisAuth, err)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrRedisUnavailable, err)
 	}
 
-	log.Info().Str("component", "redis").Msgf("Connected to Redis at %s", addr)
+	log.Info().Str("component", "redis").Bool("tls", opts.TLSConfig != nil).Int("db", opts.DB).Msgf("Connected to Redis at %s", addr)
 
 	return client, err
 }
 
-func loadRedisScript(client *redis.Client, path string) (*redis.Script, error) {
-	bytes, err := os.ReadFile(path)
+// transientRedisErrorPrefixes are the prefixes of redis error replies for conditions expected to
+// clear up, like a server loading its dataset or a failover in progress
+var transientRedisErrorPrefixes = []string{"LOADING", "READONLY", "MASTERDOWN", "TRYAGAIN", "CLUSTERDOWN", "BUSY"}
+
+// IsTransient returns true if err is a redis failure that is likely to succeed when retried,
+// like a lost connection, a network timeout or a server that is loading or failing over
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, redis.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		for _, prefix := range transientRedisErrorPrefixes {
+			if redis.HasErrorPrefix(redisErr, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isRedisAuthError returns true if err is a reply rejecting missing or wrong credentials
+func isRedisAuthError(err error) bool {
+	msg := err.Error()
+	return strings.HasPrefix(msg, "NOAUTH") || strings.HasPrefix(msg, "WRONGPASS") || strings.HasPrefix(msg, "ERR invalid password")
+}
+
+// readRedisScript reads the named script from fsys without loading it into redis
+func readRedisScript(fsys fs.FS, name string) (*redis.Script, error) {
+	bytes, err := fs.ReadFile(fsys, name)
 	if err != nil {
 		return nil, err
 	}
+	return redis.NewScript(string(bytes)), nil
+}
 
-	// create script
-	script := redis.NewScript(string(bytes))
-
-	// load script if it doesn't exist in redis
-	boolSlice, err := script.Exists(client).Result()
+func loadRedisScript(ctx context.Context, client redis.UniversalClient, fsys fs.FS, name string) (*redis.Script, error) {
+	script, err := readRedisScript(fsys, name)
 	if err != nil {
 		return nil, err
 	}
-	for _, exists := range boolSlice {
-		if !exists {
-			if err := script.Load(client).Err(); err != nil {
-				return nil, err
+
+	// load script if it doesn't exist in redis, on every master of a cluster since the script
+	// is run on the master serving its keys
+	err = forEachMaster(ctx, client, func(node redis.UniversalClient) error {
+		boolSlice, err := script.Exists(ctx, node).Result()
+		if err != nil {
+			return err
+		}
+		for _, exists := range boolSlice {
+			if !exists {
+				if err := script.Load(ctx, node).Err(); err != nil {
+					return err
+				}
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return script, nil
 }
+
+// isScriptCommandDenied returns true if err is a reply rejecting a SCRIPT command because the user
+// lacks permission to run it or the command is disabled or renamed, as on some managed services
+func isScriptCommandDenied(err error) bool {
+	var redisErr redis.Error
+	if !errors.As(err, &redisErr) {
+		return false
+	}
+	msg := redisErr.Error()
+	return strings.HasPrefix(msg, "NOPERM") || strings.HasPrefix(msg, "ERR unknown command")
+}
+
+// isCluster returns true if client is connected to a Redis Cluster
+func isCluster(client redis.UniversalClient) bool {
+	_, ok := client.(*redis.ClusterClient)
+	return ok
+}
+
+// forEachMaster calls fn with the client of each master of a cluster one at a time, or with
+// client itself if it is not connected to a cluster. It is used by commands that only see the
+// keys of a single node, like SCAN.
+func forEachMaster(ctx context.Context, client redis.UniversalClient, fn func(node redis.UniversalClient) error) error {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return fn(client)
+	}
+	// fn is called concurrently for each master by the cluster client
+	var mu sync.Mutex
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return fn(node)
+	})
+}
+
+// sameSlot returns true if keys a and b are known to be in the same hash slot of a cluster
+// because they have the same hash tag, e.g. chg_wait{chg} and chg_ready{chg}
+func sameSlot(a string, b string) bool {
+	return hashTag(a) == hashTag(b)
+}
+
+// hashTag returns the part of key that is hashed to find its slot in a cluster
+func hashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// redisRemoveUriStream is the stream variant of the REMURI queue
+const redisRemoveUriStream = "REMURI_STREAM"
+
+// removeUriStreamField is the field of a remove stream entry holding the uri id
+const removeUriStreamField = "id"
+
+// RemoveUriStreamOptions configures consuming the remove queue as a Redis Stream
+type RemoveUriStreamOptions struct {
+	// Enabled makes the remuri-queue worker consume the REMURI_STREAM stream in addition to
+	// the REMURI lists
+	Enabled bool
+	// Group is the consumer group shared by all queue worker instances
+	Group string
+}
+
+// removeFromUriStream removes the queued uris of a batch of entries of the remove stream and
+// acknowledges the entries after the uris are deleted from RethinkDB.
+//
+// Entries are delivered at least once: entries that failed to be processed stay pending and are
+// read again by the next pass, and the pending entries of consumers that died are claimed after
+// they have been idle for inflightStaleAfter.
+func (d *database) removeFromUriStream(ctx context.Context, stream string) (int, error) {
+	if d.dryRun {
+		n, err := d.redis.XLen(ctx, stream).Result()
+		d.wouldDo(ctx, "delete-queued-uris", stream, int(n))
+		return 0, err
+	}
+
+	entries, err := d.readUriStream(ctx, stream)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s: %w", stream, err)
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	if deferred, err := d.deferUriQueueRemoval(ctx, len(entries)); err != nil || deferred {
+		return 0, err
+	}
+
+	entryIds := make([]string, 0, len(entries))
+	uriIds := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		entryIds = append(entryIds, entry.ID)
+		if uriId, ok := entry.Values[removeUriStreamField].(string); ok && uriId != "" {
+			uriIds = append(uriIds, uriId)
+		}
+	}
+
+	removed := 0
+	if len(uriIds) > 0 {
+		removed, err = d.removeQueuedUris(ctx, uriIds)
+		if err != nil {
+			return removed, fmt.Errorf("removed %d of %d queued uris: %w", removed, len(uriIds), err)
+		}
+	}
+
+	pipe := d.redis.TxPipeline()
+	pipe.XAck(ctx, stream, d.removeUriStream.Group, entryIds...)
+	pipe.XDel(ctx, stream, entryIds...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return removed, fmt.Errorf("failed to acknowledge entries of %s: %w", stream, err)
+	}
+	dequeued(stream, DequeueReasonProcessed, removed)
+	dequeued(stream, DequeueReasonEvictedMissingDoc, len(entries)-removed)
+	d.replication.check(ctx, "ack-remove-stream")
+	return removed, nil
+}
+
+// readUriStream returns a batch of entries of the remove stream for this consumer, which are
+// entries delivered to it before but not acknowledged, or else entries claimed from consumers
+// that died, or else new entries. The consumer group is created if it doesn't exist.
+func (d *database) readUriStream(ctx context.Context, stream string) ([]redis.XMessage, error) {
+	group := d.removeUriStream.Group
+	consumer := d.owner + ":" + strconv.Itoa(partitionFromContext(ctx).index)
+	size := int64(batchSizeFromContext(ctx))
+
+	read := func(id string) ([]redis.XMessage, error) {
+		streams, err := d.redis.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{stream, id},
+			Count:    size,
+			Block:    -1,
+		}).Result()
+		if err == redis.Nil {
+			return nil, nil
+		} else if err != nil || len(streams) == 0 {
+			return nil, err
+		}
+		return streams[0].Messages, nil
+	}
+
+	if _, ok := d.streamGroups.Load(stream); !ok {
+		err := d.redis.XGroupCreateMkStream(ctx, stream, group, "0").Err()
+		if err == nil {
+			log.Ctx(ctx).Info().Str("stream", stream).Str("group", group).Msg("Created consumer group of remove stream")
+		} else if !redis.HasErrorPrefix(err, "BUSYGROUP") {
+			return nil, err
+		}
+		d.streamGroups.Store(stream, struct{}{})
+	}
+
+	entries, err := read("0")
+	if err != nil || len(entries) > 0 {
+		return entries, err
+	}
+
+	entries, _, err = d.redis.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   stream,
+		Group:    group,
+		Consumer: consumer,
+		MinIdle:  inflightStaleAfter,
+		Start:    "0-0",
+		Count:    size,
+	}).Result()
+	if err != nil || len(entries) > 0 {
+		return entries, err
+	}
+
+	return read(">")
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// replication check modes
+const (
+	ReplicationCheckNone = "none"
+	ReplicationCheckWarn = "warn"
+	ReplicationCheckWait = "wait"
+)
+
+// replicationCheckInterval is the minimum interval between replication lag checks in warn mode
+const replicationCheckInterval = time.Second
+
+// ReplicationOptions configures checking of redis replication after correctness critical queue operations
+type ReplicationOptions struct {
+	// Mode is one of none, warn or wait
+	Mode string
+	// MaxLag is the replication offset lag in bytes above which a warning is logged (warn mode)
+	MaxLag int64
+	// Replicas is the number of replicas that must acknowledge writes (wait mode)
+	Replicas int
+	// Timeout is how long to wait for replicas to acknowledge writes (wait mode)
+	Timeout time.Duration
+}
+
+// replicationChecker checks that queue state is replicated before it is trusted
+type replicationChecker struct {
+	opts  ReplicationOptions
+	redis *redis.Client
+
+	mu        sync.Mutex
+	lastCheck time.Time
+}
+
+func newReplicationChecker(redisClient redis.UniversalClient, opts ReplicationOptions) (*replicationChecker, error) {
+	switch opts.Mode {
+	case "", ReplicationCheckNone, ReplicationCheckWarn, ReplicationCheckWait:
+	default:
+		return nil, fmt.Errorf("unknown replication check mode: %s", opts.Mode)
+	}
+	// the replication of a cluster is checked per node, which is left to the cluster
+	client, ok := redisClient.(*redis.Client)
+	if !ok && opts.Mode != "" && opts.Mode != ReplicationCheckNone {
+		return nil, fmt.Errorf("replication check is not supported by a Redis Cluster: %s", opts.Mode)
+	}
+	return &replicationChecker{
+		opts:  opts,
+		redis: client,
+	}, nil
+}
+
+// check checks replication according to the configured mode, logging a warning if replicas are lagging behind.
+func (rc *replicationChecker) check(ctx context.Context, operation string) {
+	var err error
+	switch rc.opts.Mode {
+	case ReplicationCheckWarn:
+		err = rc.checkLag(ctx, operation)
+	case ReplicationCheckWait:
+		err = rc.wait(ctx, operation)
+	default:
+		return
+	}
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("component", "redis").Str("operation", operation).Msg("Failed to check replication")
+	}
+}
+
+// checkLag compares the replication offset of the master with its replicas
+func (rc *replicationChecker) checkLag(ctx context.Context, operation string) error {
+	rc.mu.Lock()
+	if time.Since(rc.lastCheck) < replicationCheckInterval {
+		rc.mu.Unlock()
+		return nil
+	}
+	rc.lastCheck = time.Now()
+	rc.mu.Unlock()
+
+	info, err := rc.redis.Info(ctx, "replication").Result()
+	if err != nil {
+		return err
+	}
+	lag, replicas, err := parseReplicationLag(info)
+	if err != nil {
+		return err
+	}
+	metrics.RedisReplicationLag.Set(float64(lag))
+	if lag > rc.opts.MaxLag {
+		metrics.RedisReplicationWarnings.WithLabelValues(operation).Inc()
+		log.Ctx(ctx).Warn().
+			Str("component", "redis").
+			Str("operation", operation).
+			Int64("lagBytes", lag).
+			Int("replicas", replicas).
+			Msg("Redis replicas are lagging behind master")
+	}
+	return nil
+}
+
+// wait blocks until the configured number of replicas have acknowledged previous writes or the timeout is reached
+func (rc *replicationChecker) wait(ctx context.Context, operation string) error {
+	acked, err := rc.redis.Wait(ctx, rc.opts.Replicas, rc.opts.Timeout).Result()
+	if err != nil {
+		return err
+	}
+	if int(acked) < rc.opts.Replicas {
+		metrics.RedisReplicationWarnings.WithLabelValues(operation).Inc()
+		log.Ctx(ctx).Warn().
+			Str("component", "redis").
+			Str("operation", operation).
+			Int64("acked", acked).
+			Int("replicas", rc.opts.Replicas).
+			Msg("Write not acknowledged by enough redis replicas")
+	}
+	return nil
+}
+
+// parseReplicationLag parses the output of INFO replication and returns the max
+// offset lag in bytes of any replica together with the number of replicas.
+func parseReplicationLag(info string) (int64, int, error) {
+	var masterOffset int64
+	var replicaOffsets []int64
+
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch {
+		case key == "master_repl_offset":
+			offset, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("invalid master_repl_offset: %w", err)
+			}
+			masterOffset = offset
+		case strings.HasPrefix(key, "slave"):
+			if _, err := strconv.Atoi(strings.TrimPrefix(key, "slave")); err != nil {
+				continue
+			}
+			for _, field := range strings.Split(value, ",") {
+				k, v, _ := strings.Cut(field, "=")
+				if k != "offset" {
+					continue
+				}
+				offset, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return 0, 0, fmt.Errorf("invalid offset of %s: %w", key, err)
+				}
+				replicaOffsets = append(replicaOffsets, offset)
+			}
+		}
+	}
+
+	var lag int64
+	for _, offset := range replicaOffsets {
+		if masterOffset-offset > lag {
+			lag = masterOffset - offset
+		}
+	}
+	return lag, len(replicaOffsets), scanner.Err()
+}
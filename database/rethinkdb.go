@@ -18,23 +18,38 @@ package database
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/nlnwa/veidemann-frontier-queue-workers/logger"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
 	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
 	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
 )
 
 // RethinkDbConnection holds the database connection
 type RethinkDbConnection struct {
-	connectOpts  r.ConnectOpts
-	session      r.QueryExecutor
-	maxRetries   int
-	waitTimeout  time.Duration
-	queryTimeout time.Duration
-	batchSize    int
-	logger       zerolog.Logger
+	connectOpts        r.ConnectOpts
+	session            r.QueryExecutor
+	maxRetries         int
+	waitTimeout        time.Duration
+	queryTimeout       time.Duration
+	slowQueryThreshold time.Duration
+	coalescer          *writeCoalescer
+	rebalanceGuard     bool
+	queryTag           string
+	defaultDurability  string
+	durabilities       map[string]string
+	breaker            *circuitBreaker
+	tables             tableAvailability
+	latency            latencyTracker
+	writeLimiter       *rate.Limiter
+	logger             zerolog.Logger
 }
 
 type RethinkDbOptions struct {
@@ -46,30 +61,96 @@ type RethinkDbOptions struct {
 	QueryTimeout       time.Duration
 	MaxRetries         int
 	MaxOpenConnections int
+	SlowQueryThreshold time.Duration
+	// Addresses are the host:port addresses of several RethinkDB servers or proxies, which are
+	// used instead of Address. Queries fail over to another address on connection errors.
+	Addresses []string
+	// TLSConfig enables TLS if set (see TLSOptions)
+	TLSConfig *tls.Config
+	// ConnectTimeout is the timeout of connecting to a server (10s if zero)
+	ConnectTimeout time.Duration
+	// ConnectRetries is the number of times connecting to a server is retried (10 if zero)
+	ConnectRetries int
+	// WaitTimeout is how long to wait for the tables to be ready after a query timed out (60s if zero)
+	WaitTimeout time.Duration
+	// WriteDurability is the durability of writes, soft or hard (soft if empty)
+	WriteDurability string
+	// OperationDurability overrides the durability of writes by operation name (see ParseWriteDurability)
+	OperationDurability map[string]string
+	// WriteCoalesceWindow is how long small writes wait to be batched with writes
+	// from other workers (0 disables write coalescing)
+	WriteCoalesceWindow time.Duration
+	// WriteCoalesceMaxBatch is the max number of writes in a coalesced batch
+	WriteCoalesceMaxBatch int
+	// RebalanceGuard defers batch operations on tables that are being rebalanced
+	RebalanceGuard bool
+	// BreakerThreshold is the number of consecutive failed operations that trips the circuit breaker (0 disables the breaker)
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit breaker stays open before letting a probe through
+	BreakerCooldown time.Duration
+	// WriteRateLimit is the max number of documents written per second by all workers (0 for no limit)
+	WriteRateLimit float64
+	// WriteRateBurst is the max number of documents written in a burst above the write rate limit
+	WriteRateBurst int
+	// QueryTag prefixes the tag attached to each query, e.g. name and version (empty disables tagging)
+	QueryTag string
 }
 
 // NewRethinkDbConnection creates a new RethinkDbConnection object
 func NewRethinkDbConnection(opts RethinkDbOptions) *RethinkDbConnection {
-	return &RethinkDbConnection{
+	c := &RethinkDbConnection{
 		connectOpts: r.ConnectOpts{
 			Address:        opts.Address,
+			Addresses:      opts.Addresses,
 			Username:       opts.Username,
 			Password:       opts.Password,
+			TLSConfig:      opts.TLSConfig,
 			Database:       opts.Database,
 			InitialCap:     2,
 			MaxOpen:        opts.MaxOpenConnections,
 			UseOpentracing: opts.UseOpenTracing,
-			NumRetries:     10,
-			Timeout:        10 * time.Second,
+			NumRetries:     opts.ConnectRetries,
+			Timeout:        opts.ConnectTimeout,
 		},
-		maxRetries:   opts.MaxRetries,
-		waitTimeout:  60 * time.Second,
-		queryTimeout: opts.QueryTimeout,
-		batchSize:    200,
-		logger:       zlog.With().Str("component", "rethinkdb").Logger(),
+		maxRetries:         opts.MaxRetries,
+		waitTimeout:        opts.WaitTimeout,
+		queryTimeout:       opts.QueryTimeout,
+		slowQueryThreshold: opts.SlowQueryThreshold,
+		rebalanceGuard:     opts.RebalanceGuard,
+		queryTag:           opts.QueryTag,
+		defaultDurability:  opts.WriteDurability,
+		durabilities:       opts.OperationDurability,
+		writeLimiter:       newWriteLimiter(opts.WriteRateLimit, opts.WriteRateBurst),
+		logger:             zlog.With().Str("component", "rethinkdb").Logger(),
 	}
+	if c.connectOpts.NumRetries == 0 {
+		c.connectOpts.NumRetries = 10
+	}
+	if c.connectOpts.Timeout == 0 {
+		c.connectOpts.Timeout = 10 * time.Second
+	}
+	if c.waitTimeout == 0 {
+		c.waitTimeout = 60 * time.Second
+	}
+	if c.defaultDurability == "" {
+		c.defaultDurability = DurabilitySoft
+	}
+	if opts.BreakerThreshold > 0 {
+		c.breaker = newCircuitBreaker(opts.BreakerThreshold, opts.BreakerCooldown)
+	}
+	if opts.WriteCoalesceWindow > 0 && opts.WriteCoalesceMaxBatch > 1 {
+		c.coalescer = newWriteCoalescer(c, opts.WriteCoalesceWindow, opts.WriteCoalesceMaxBatch)
+	}
+	return c
 }
 
+var (
+	// ErrRethinkDbUnavailable is returned when RethinkDB can't be reached
+	ErrRethinkDbUnavailable = errors.New("failed to connect to RethinkDB")
+	// ErrRethinkDbAuth is returned when RethinkDB rejects the credentials
+	ErrRethinkDbAuth = errors.New("failed to authenticate with RethinkDB")
+)
+
 // Connect establishes connections
 func (c *RethinkDbConnection) Connect() error {
 	log := c.logger
@@ -77,52 +158,146 @@ func (c *RethinkDbConnection) Connect() error {
 	// Set up database RethinkDbConnection
 	c.session, err = r.Connect(c.connectOpts)
 	if err != nil {
-		return fmt.Errorf("failed to connect to RethinkDB at %s: %w", c.connectOpts.Address, err)
+		var authErr r.RQLAuthError
+		if errors.As(err, &authErr) {
+			return fmt.Errorf("%w at %s: %v", ErrRethinkDbAuth, c.address(), err)
+		}
+		return fmt.Errorf("%w at %s: %v", ErrRethinkDbUnavailable, c.address(), err)
 	}
-	log.Info().Msgf("Connected to RethinkDB at %s", c.connectOpts.Address)
+	log.Info().Msgf("Connected to RethinkDB at %s", c.address())
 	return nil
 }
 
-// Close closes the RethinkDbConnection
+// address returns the address or addresses connected to
+func (c *RethinkDbConnection) address() string {
+	if len(c.connectOpts.Addresses) > 0 {
+		return strings.Join(c.connectOpts.Addresses, ",")
+	}
+	return c.connectOpts.Address
+}
+
+// Close closes the RethinkDbConnection. It does nothing if the connection was never opened.
 func (c *RethinkDbConnection) Close() error {
+	if c.session == nil {
+		return nil
+	}
 	log := c.logger
 	log.Info().Msgf("Closing connection to RethinkDB")
 	return c.session.(*r.Session).Close()
 }
 
 // execRead executes the given read term with a timeout
-func (c *RethinkDbConnection) execRead(ctx context.Context, name string, term *r.Term) (*r.Cursor, error) {
+func (c *RethinkDbConnection) execRead(ctx context.Context, name string, term *r.Term, size int) (*r.Cursor, error) {
 	q := func(ctx context.Context) (*r.Cursor, error) {
 		runOpts := r.RunOpts{
 			Context: ctx,
 		}
-		return term.Run(c.session, runOpts)
+		return c.tagged(ctx, name, *term).Run(c.session, runOpts)
 	}
-	return c.execWithRetry(ctx, name, q)
+	return c.execWithRetry(ctx, name, size, q)
+}
+
+// execReadAll executes the given read term with a timeout and reads all results into out before
+// the timeout is cancelled, which a cursor returned by execRead may need to fetch further batches
+func (c *RethinkDbConnection) execReadAll(ctx context.Context, name string, term *r.Term, size int, out interface{}) error {
+	return c.execReadEach(ctx, name, term, size, func(cursor *r.Cursor) error {
+		return cursor.All(out)
+	})
+}
+
+// execReadEach executes the given read term with a timeout and calls fn with the cursor before the
+// timeout is cancelled, which lets fn stream the results. fn is called again if the query is retried.
+func (c *RethinkDbConnection) execReadEach(ctx context.Context, name string, term *r.Term, size int, fn func(cursor *r.Cursor) error) error {
+	q := func(ctx context.Context) (*r.Cursor, error) {
+		runOpts := r.RunOpts{
+			Context: ctx,
+		}
+		cursor, err := c.tagged(ctx, name, *term).Run(c.session, runOpts)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = cursor.Close()
+		}()
+		return nil, fn(cursor)
+	}
+	_, err := c.execWithRetry(ctx, name, size, q)
+	return err
+}
+
+// execChanges starts the given changefeed term, which runs until ctx is done instead of being
+// subject to the query timeout
+func (c *RethinkDbConnection) execChanges(ctx context.Context, name string, term *r.Term) (*r.Cursor, error) {
+	if !c.breaker.allow() {
+		return nil, fmt.Errorf("failed to %s: %w", name, ErrCircuitOpen)
+	}
+	cursor, err := c.tagged(ctx, name, *term).Run(c.session, r.RunOpts{Context: ctx})
+	c.breaker.record(err)
+	return cursor, err
 }
 
 // execWrite executes the given write term with a timeout
-func (c *RethinkDbConnection) execWrite(ctx context.Context, name string, term *r.Term) (writeResponse r.WriteResponse, err error) {
+func (c *RethinkDbConnection) execWrite(ctx context.Context, name string, term *r.Term, size int) (writeResponse r.WriteResponse, err error) {
+	if err = c.throttleWrite(ctx, name, size); err != nil {
+		return
+	}
 	q := func(ctx context.Context) (*r.Cursor, error) {
 		runOpts := r.RunOpts{
 			Context:    ctx,
-			Durability: "soft",
+			Durability: c.durability(name),
 		}
-		writeResponse, err = (*term).RunWrite(c.session, runOpts)
+		writeResponse, err = c.tagged(ctx, name, *term).RunWrite(c.session, runOpts)
 		return nil, err
 	}
-	_, err = c.execWithRetry(ctx, name, q)
+	_, err = c.execWithRetry(ctx, name, size, q)
+	return
+}
+
+// execSmallWrite executes a small write term, coalesced with writes from other workers if enabled
+func (c *RethinkDbConnection) execSmallWrite(ctx context.Context, name string, term *r.Term) (r.WriteResponse, error) {
+	if c.coalescer == nil {
+		return c.execWrite(ctx, name, term, 1)
+	}
+	return c.coalescer.write(ctx, *term, name)
+}
+
+// execWriteBatch executes the given write terms in a single query with a timeout
+func (c *RethinkDbConnection) execWriteBatch(ctx context.Context, name string, terms []r.Term) (writeResponses []r.WriteResponse, err error) {
+	if err = c.throttleWrite(ctx, name, len(terms)); err != nil {
+		return
+	}
+	q := func(ctx context.Context) (*r.Cursor, error) {
+		runOpts := r.RunOpts{
+			Context:    ctx,
+			Durability: c.durability(name),
+		}
+		cursor, err := c.tagged(ctx, name, r.Expr(terms)).Run(c.session, runOpts)
+		if err != nil {
+			return nil, err
+		}
+		return nil, cursor.All(&writeResponses)
+	}
+	_, err = c.execWithRetry(ctx, name, len(terms), q)
 	return
 }
 
 // execWithRetry executes given query function repeatedly until successful or max retry limit is reached
-func (c *RethinkDbConnection) execWithRetry(ctx context.Context, name string, q func(ctx context.Context) (*r.Cursor, error)) (cursor *r.Cursor, err error) {
+func (c *RethinkDbConnection) execWithRetry(ctx context.Context, name string, size int, q func(ctx context.Context) (*r.Cursor, error)) (cursor *r.Cursor, err error) {
+	if !c.breaker.allow() {
+		return nil, fmt.Errorf("failed to %s: %w", name, ErrCircuitOpen)
+	}
+	defer func() {
+		c.breaker.record(err)
+	}()
 	attempts := 0
-	log := c.logger.With().Str("operation", name).Logger()
+	log := c.logger.Hook(logger.TraceHook(ctx)).With().Str("operation", name).Logger()
 out:
 	for {
 		attempts++
+		start := time.Now()
 		cursor, err = c.exec(ctx, q)
+		c.latency.observe(time.Since(start))
+		c.logSlowQuery(ctx, name, size, attempts-1, time.Since(start))
 		if err == nil {
 			return
 		}
@@ -148,6 +323,21 @@ out:
 	return nil, fmt.Errorf("failed to %s after %d of %d attempts: %w", name, attempts, c.maxRetries+1, err)
 }
 
+// logSlowQuery logs and counts a query if its duration exceeds the slow query threshold
+func (c *RethinkDbConnection) logSlowQuery(ctx context.Context, name string, size int, retries int, duration time.Duration) {
+	if c.slowQueryThreshold <= 0 || duration < c.slowQueryThreshold {
+		return
+	}
+	metrics.RethinkDbSlowQueries.WithLabelValues(name).Inc()
+	log := c.logger.Hook(logger.TraceHook(ctx))
+	log.Warn().
+		Str("operation", name).
+		Int("batchSize", size).
+		Int("retries", retries).
+		Dur("duration", duration).
+		Msg("Slow query")
+}
+
 // exec the given query with a timeout
 func (c *RethinkDbConnection) exec(ctx context.Context, q func(ctx context.Context) (*r.Cursor, error)) (*r.Cursor, error) {
 	ctx, cancel := context.WithTimeout(ctx, c.queryTimeout)
@@ -33,7 +33,6 @@ func NewMockConnection() *RethinkDbMockConnection {
 				NumRetries: 10,
 			},
 			session:      r.NewMock(),
-			batchSize:    200,
 			queryTimeout: 5 * time.Second,
 		},
 	}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisRolloutVersionKey is the coordination key holding the newest version of the queue workers running
+const redisRolloutVersionKey = "frontier:qw:version"
+
+// VersionGate coordinates instances of different versions during a rolling upgrade so that
+// only instances of the newest version process correctness-critical queues.
+//
+// Instances of the newest version keep the coordination key alive, and instances finding
+// a newer version in the key fall back to read-only until the key expires.
+type VersionGate struct {
+	redis    redis.UniversalClient
+	version  [3]int
+	raw      string
+	ttl      time.Duration
+	interval time.Duration
+
+	mu      sync.Mutex
+	active  bool
+	checked time.Time
+}
+
+// NewVersionGate returns a VersionGate for an instance of the given semantic version that checks
+// the coordination key at most every interval and refreshes it with ttl.
+func NewVersionGate(redisClient redis.UniversalClient, version string, interval time.Duration, ttl time.Duration) (*VersionGate, error) {
+	v, ok := parseVersion(version)
+	if !ok {
+		return nil, fmt.Errorf("version gate requires a semantic version, got: %s", version)
+	}
+	return &VersionGate{
+		redis:    redisClient,
+		version:  v,
+		raw:      version,
+		ttl:      ttl,
+		interval: interval,
+	}, nil
+}
+
+// Active returns true if this instance runs the newest version and may process correctness-critical queues
+func (g *VersionGate) Active(ctx context.Context) (bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if time.Since(g.checked) < g.interval {
+		return g.active, nil
+	}
+
+	newest, err := g.redis.Get(ctx, redisRolloutVersionKey).Result()
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	v, ok := parseVersion(newest)
+	switch {
+	case err == redis.Nil || !ok || compareVersions(g.version, v) > 0:
+		err = g.redis.Set(ctx, redisRolloutVersionKey, g.raw, g.ttl).Err()
+		g.active = err == nil
+	case compareVersions(g.version, v) == 0:
+		err = g.redis.Expire(ctx, redisRolloutVersionKey, g.ttl).Err()
+		g.active = err == nil
+	default:
+		g.active = false
+	}
+	if err != nil {
+		return false, err
+	}
+	g.checked = time.Now()
+	return g.active, nil
+}
+
+// parseVersion parses a semantic version on the form [v]major.minor.patch[-pre][+build]
+func parseVersion(s string) ([3]int, bool) {
+	var v [3]int
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// compareVersions returns -1, 0 or 1 if a is older than, the same as or newer than b
+func compareVersions(a [3]int, b [3]int) int {
+	for i := range a {
+		if a[i] < b[i] {
+			return -1
+		}
+		if a[i] > b[i] {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/reconciler"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// endedRunningCrawlExecutions is a reconciler of the crawl executions in the running queues
+// that have ended in RethinkDB
+type endedRunningCrawlExecutions struct {
+	d *database
+}
+
+// EndedRunningCrawlExecutions returns a reconciler removing the crawl executions that have ended
+// in RethinkDB from the running queues, which catches those that the watch-crawl-executions
+// worker misses while it isn't following the changefeed.
+func (d *database) EndedRunningCrawlExecutions() reconciler.Reconciler {
+	return endedRunningCrawlExecutions{d: d}
+}
+
+func (e endedRunningCrawlExecutions) Name() string {
+	return "ended-running-crawl-executions"
+}
+
+// List pages through a temporary set of the crawl executions in the running queues of every key
+// layout, leaving out those already queued to be timed out, which is built in Redis at the start
+// of a pass so that the memory used doesn't grow with the number of crawl executions. The cursor
+// is the scan cursor and the key of the set separated by a colon.
+func (e endedRunningCrawlExecutions) List(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	if e.d.rethinkDB.skip(ctx, "ended-running-crawl-executions") {
+		return nil, "", nil
+	}
+	var candidates idSet
+	var scan uint64
+	if cursor == "" {
+		var err error
+		if candidates, err = e.candidates(ctx); err != nil {
+			return nil, "", err
+		}
+	} else {
+		s, key, ok := strings.Cut(cursor, ":")
+		if !ok {
+			return nil, "", fmt.Errorf("invalid cursor: %s", cursor)
+		}
+		var err error
+		if scan, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return nil, "", fmt.Errorf("invalid cursor: %s", cursor)
+		}
+		candidates = idSet{redis: e.d.redis, key: key}
+	}
+	ceids, next, err := candidates.page(ctx, scan, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	if next == 0 {
+		return ceids, "", candidates.delete(ctx)
+	}
+	return ceids, strconv.FormatUint(next, 10) + ":" + candidates.key, nil
+}
+
+// candidates returns a set of the crawl executions in the running queues that are not in the
+// crawl execution timeout queues
+func (e endedRunningCrawlExecutions) candidates(ctx context.Context) (idSet, error) {
+	prefix := idSetKeyPrefix(e.d.layouts[0].crawlExecutionRunningQueue)
+	running := newIdSet(e.d.redis, prefix)
+	queued := newIdSet(e.d.redis, prefix)
+	defer func() {
+		_ = running.delete(ctx)
+		_ = queued.delete(ctx)
+	}()
+	for _, k := range e.d.layouts {
+		if k.owns(k.crawlExecutionRunningQueue) {
+			if err := running.addSortedSet(ctx, k.crawlExecutionRunningQueue); err != nil {
+				return idSet{}, err
+			}
+		}
+		if k.owns(k.crawlExecutionTimeoutQueue) {
+			if err := queued.addList(ctx, k.crawlExecutionTimeoutQueue); err != nil {
+				return idSet{}, err
+			}
+		}
+	}
+	return running.diff(ctx, queued)
+}
+
+// Check reports whether the crawl execution has ended. Crawl executions that are missing in
+// RethinkDB are left to be timed out.
+func (e endedRunningCrawlExecutions) Check(ctx context.Context, ceid string) (bool, error) {
+	term := r.Table(rethinkDbTableCrawlExecutions).Get(ceid).HasFields("endTime").Default(false)
+	var ended []bool
+	if err := e.d.rethinkDB.execReadAll(ctx, "check-running-crawl-execution", &term, 1, &ended); err != nil {
+		return false, err
+	}
+	return len(ended) > 0 && ended[0], nil
+}
+
+func (e endedRunningCrawlExecutions) Repair(ctx context.Context, ceid string) error {
+	_, err := e.d.removeRunningCrawlExecution(ctx, ceid)
+	return err
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/reconciler"
+	"github.com/redis/go-redis/v9"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+func TestEndedRunningCrawlExecutions(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestScript(t)
+	conn := NewMockConnection()
+	mock := conn.GetMock()
+	db, err := NewDatabase(ctx, client, conn.RethinkDbConnection, Options{
+		KeyMapping: KeyMappingOptions{Mapping: map[string]string{redisCrawlExecutionRunningQueue: "running{ce}"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ended := map[string]bool{"ce1": true, "ce2": false, "ce3": true, "ce4": false}
+	for ceid, hasEnded := range ended {
+		if err := client.ZAdd(ctx, redisCrawlExecutionRunningQueue, redis.Z{Score: 1, Member: ceid}).Err(); err != nil {
+			t.Fatal(err)
+		}
+		// checked once
+		mock.On(r.Table(rethinkDbTableCrawlExecutions).Get(ceid).HasFields("endTime").Default(false)).
+			Return([]interface{}{hasEnded}, nil).Once()
+	}
+	// running in both layouts
+	if err := client.ZAdd(ctx, "running{ce}", redis.Z{Score: 1, Member: "ce1"}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	// left to the timeout worker, so never checked
+	if err := client.ZAdd(ctx, redisCrawlExecutionRunningQueue, redis.Z{Score: 1, Member: "ce5"}).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RPush(ctx, redisCrawlExecutionTimeoutQueue, "ce5").Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	runner := reconciler.NewRunner(db.EndedRunningCrawlExecutions(), reconciler.Options{PageSize: 1})
+	repaired, err := runner.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repaired != 2 {
+		t.Errorf("Run() repaired %d crawl executions, want 2", repaired)
+	}
+	mock.AssertExpectations(t)
+
+	running, err := client.ZRange(ctx, redisCrawlExecutionRunningQueue, 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(running, []string{"ce2", "ce4", "ce5"}) {
+		t.Errorf("running queue = %v, want [ce2 ce4 ce5]", running)
+	}
+	if mapped, _ := client.ZRange(ctx, "running{ce}", 0, -1).Result(); len(mapped) > 0 {
+		t.Errorf("mapped running queue = %v, want []", mapped)
+	}
+	if sets, _ := client.Keys(ctx, "*:idset:*").Result(); len(sets) > 0 {
+		t.Errorf("id sets left after the pass: %v", sets)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// ScriptFallbackOptions configures falling back to a non-atomic implementation of the delayed
+// queue script when the script can't be run
+type ScriptFallbackOptions struct {
+	// Threshold is the number of consecutive failures to run the script after which the
+	// fallback is used (0 disables the fallback)
+	Threshold int
+	// Retry is how long the fallback is used before the script is tried again
+	Retry time.Duration
+}
+
+// scriptFallback keeps track of failures to run the delayed queue script, e.g. because scripts
+// were flushed or the cluster is resharding, and switches to degraded mode after consecutive
+// failures so that queue movement never fully stops. In degraded mode the script is retried
+// after a while, and degraded mode is left when it succeeds.
+type scriptFallback struct {
+	threshold int
+	retry     time.Duration
+
+	mu            sync.Mutex
+	failures      int
+	degradedSince time.Time
+}
+
+func newScriptFallback(opts ScriptFallbackOptions) *scriptFallback {
+	if opts.Threshold <= 0 {
+		return nil
+	}
+	return &scriptFallback{
+		threshold: opts.Threshold,
+		retry:     opts.Retry,
+	}
+}
+
+// degraded returns true if the fallback should be used instead of trying the script
+func (f *scriptFallback) degraded() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.degradedSince.IsZero() {
+		return false
+	}
+	if time.Since(f.degradedSince) >= f.retry {
+		// let the next attempt try the script, and stay degraded if it fails again
+		f.degradedSince = time.Now()
+		return false
+	}
+	return true
+}
+
+// record records the result of running the script and returns true if the fallback should be used
+func (f *scriptFallback) record(err error) bool {
+	if f == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		f.failures = 0
+		if !f.degradedSince.IsZero() {
+			log.Info().Str("component", "redis").Msg("Delayed queue script recovered, leaving degraded mode")
+			f.degradedSince = time.Time{}
+			metrics.RedisScriptDegraded.Set(0)
+		}
+		return false
+	}
+	f.failures++
+	metrics.RedisScriptFailures.Inc()
+	if f.failures < f.threshold {
+		return false
+	}
+	if f.degradedSince.IsZero() {
+		log.Warn().Str("component", "redis").Err(err).Int("failures", f.failures).Dur("retry", f.retry).
+			Msg("Failed to run delayed queue script, entering degraded mode")
+		metrics.RedisScriptDegraded.Set(1)
+	}
+	f.degradedSince = time.Now()
+	return true
+}
+
+// moveDue moves the members of the sorted set fromQueue that are due at nowMillis to the list toQueue
+// in score order and returns the number of members moved. It is the equivalent of the delayed
+// queue script without scripting: the due members are read while the sorted set is watched, then
+// removed and pushed in a transaction that fails if the sorted set changed in between, in which
+// case nothing is moved.
+func moveDue(ctx context.Context, client redis.UniversalClient, fromQueue string, toQueue string, nowMillis int64) (int, error) {
+	moved := 0
+	err := client.Watch(ctx, func(tx *redis.Tx) error {
+		due, err := tx.ZRangeByScore(ctx, fromQueue, &redis.ZRangeBy{Min: "0", Max: strconv.FormatInt(nowMillis, 10)}).Result()
+		if err != nil || len(due) == 0 {
+			return err
+		}
+		members := make([]interface{}, len(due))
+		for i, member := range due {
+			members[i] = member
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZRem(ctx, fromQueue, members...)
+			pipe.RPush(ctx, toQueue, members...)
+			return nil
+		})
+		if err == nil {
+			moved = len(due)
+		}
+		return err
+	}, fromQueue)
+	if err == redis.TxFailedErr {
+		// another client moved or added members, leave them for the next pass
+		return 0, nil
+	}
+	return moved, err
+}
+
+// moveDueAcrossSlots moves the members of the sorted set fromQueue that are due at nowMillis to
+// the list toQueue when the queues are in different slots of a cluster, where neither scripts
+// nor transactions can span both. Each member is pushed only by the client that removed it,
+// so members are never moved twice, but a member removed by a client that dies before pushing
+// it is lost.
+func moveDueAcrossSlots(ctx context.Context, client redis.UniversalClient, fromQueue string, toQueue string, nowMillis int64) (int, error) {
+	due, err := client.ZRangeByScore(ctx, fromQueue, &redis.ZRangeBy{Min: "0", Max: strconv.FormatInt(nowMillis, 10)}).Result()
+	if err != nil || len(due) == 0 {
+		return 0, err
+	}
+	pipe := client.Pipeline()
+	removed := make([]*redis.IntCmd, len(due))
+	for i, member := range due {
+		removed[i] = pipe.ZRem(ctx, fromQueue, member)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	var members []interface{}
+	for i, member := range due {
+		if removed[i].Val() == 1 {
+			members = append(members, member)
+		}
+	}
+	if len(members) == 0 {
+		return 0, nil
+	}
+	if err := client.RPush(ctx, toQueue, members...).Err(); err != nil {
+		return 0, fmt.Errorf("failed to push %d member(s) removed from %s: %w", len(members), fromQueue, err)
+	}
+	return len(members), nil
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/lua"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// Script verification modes
+const (
+	ScriptVerifyNone    = "none"
+	ScriptVerifyWarn    = "warn"
+	ScriptVerifyEnforce = "enforce"
+)
+
+// ErrScriptMismatch is returned when a redis lua script doesn't match the script bundled at build time
+var ErrScriptMismatch = errors.New("redis lua script doesn't match the bundled script")
+
+// pinnedScriptSha returns the SHA1 digest of the named script bundled into the binary at build time
+func pinnedScriptSha(name string) (string, error) {
+	bytes, err := fs.ReadFile(lua.Scripts, name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// verifyScript checks that the named script has the SHA1 digest of the bundled script, which
+// fails if it was overridden by an incompatible version (see Options.ScriptPath). Scripts in
+// redis are run by their digest, so they can't be replaced there without changing it.
+//
+// A mismatch is logged in warn mode and returned as ErrScriptMismatch in enforce mode.
+func verifyScript(mode string, name string, script *redis.Script) error {
+	switch mode {
+	case "", ScriptVerifyNone:
+		return nil
+	case ScriptVerifyWarn, ScriptVerifyEnforce:
+	default:
+		return fmt.Errorf("unknown script verification mode: %s", mode)
+	}
+	pinned, err := pinnedScriptSha(name)
+	if err != nil {
+		return err
+	}
+	if script.Hash() == pinned {
+		return nil
+	}
+	if mode == ScriptVerifyEnforce {
+		return fmt.Errorf("%w: %s has SHA %s, expected %s", ErrScriptMismatch, name, script.Hash(), pinned)
+	}
+	log.Warn().Str("component", "redis").Str("script", name).Str("sha", script.Hash()).Str("expected", pinned).
+		Msg("Redis lua script doesn't match the bundled script")
+	return nil
+}
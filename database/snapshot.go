@@ -0,0 +1,88 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"io"
+
+	frontierV1 "github.com/nlnwa/veidemann-api/go/frontier/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// JobExecutionSnapshot returns the current job execution stats in redis as job execution statuses
+func (d *database) JobExecutionSnapshot(ctx context.Context) ([]*frontierV1.JobExecutionStatus, error) {
+	var snapshot []*frontierV1.JobExecutionStatus
+	for _, k := range d.layouts {
+		if !k.owns(k.jobExecutionPrefix) {
+			continue
+		}
+		err := forEachJobExecutionStatus(ctx, d.redis, k.jobExecutionPrefix, nil, func(jes map[string]interface{}) error {
+			snapshot = append(snapshot, toJobExecutionStatus(jes))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+// toJobExecutionStatus converts job execution stats as returned by forEachJobExecutionStatus to a job execution status
+func toJobExecutionStatus(jes map[string]interface{}) *frontierV1.JobExecutionStatus {
+	stat := func(name string) int64 {
+		v, _ := jes[name].(int64)
+		return v
+	}
+	status := &frontierV1.JobExecutionStatus{
+		Id:                  jes["id"].(string),
+		ExecutionsState:     make(map[string]int32),
+		DocumentsCrawled:    stat("documentsCrawled"),
+		BytesCrawled:        stat("bytesCrawled"),
+		UrisCrawled:         stat("urisCrawled"),
+		DocumentsFailed:     stat("documentsFailed"),
+		DocumentsOutOfScope: stat("documentsOutOfScope"),
+		DocumentsRetried:    stat("documentsRetried"),
+		DocumentsDenied:     stat("documentsDenied"),
+	}
+	if executionsState, ok := jes["executionsState"].([]map[string]int64); ok {
+		for _, state := range executionsState {
+			for k, v := range state {
+				status.ExecutionsState[k] = int32(v)
+			}
+		}
+	}
+	return status
+}
+
+// WriteDelimited writes messages to w, each prefixed with its size as a varint
+func WriteDelimited(w io.Writer, messages []*frontierV1.JobExecutionStatus) error {
+	for _, m := range messages {
+		b, err := proto.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(protowire.AppendVarint(nil, uint64(len(b)))); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
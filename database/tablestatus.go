@@ -0,0 +1,106 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// tableStatusTTL is how long the availability of a table is cached
+const tableStatusTTL = time.Second
+
+// tableStatus is the part of the document returned by r.Table(...).Status() that we care about
+type tableStatus struct {
+	Status struct {
+		AllReplicasReady bool `rethinkdb:"all_replicas_ready"`
+		ReadyForWrites   bool `rethinkdb:"ready_for_writes"`
+	} `rethinkdb:"status"`
+}
+
+// tableAvailability caches the status of tables
+type tableAvailability struct {
+	mu      sync.Mutex
+	status  map[string]tableStatus
+	checked map[string]time.Time
+}
+
+// tableReady returns true if all replicas of table are ready.
+//
+// Batch operations on a table whose shards are being rebalanced tend to time out and be
+// retried, which makes the rebalancing take longer, so they should be deferred instead.
+func (c *RethinkDbConnection) tableReady(ctx context.Context, table string) (bool, error) {
+	status, err := c.tableStatus(ctx, table)
+	if err != nil {
+		return false, err
+	}
+	return status.Status.AllReplicasReady && status.Status.ReadyForWrites, nil
+}
+
+// TableAvailable returns true if table is ready for writes, which it is not while a
+// reconfiguration is in progress or after losing the nodes of a shard
+func (c *RethinkDbConnection) TableAvailable(ctx context.Context, table string) (bool, error) {
+	status, err := c.tableStatus(ctx, table)
+	if err != nil {
+		return false, err
+	}
+	return status.Status.ReadyForWrites, nil
+}
+
+// tableStatus returns the status of table, which is cached for tableStatusTTL
+func (c *RethinkDbConnection) tableStatus(ctx context.Context, table string) (tableStatus, error) {
+	c.tables.mu.Lock()
+	defer c.tables.mu.Unlock()
+
+	if time.Since(c.tables.checked[table]) < tableStatusTTL {
+		return c.tables.status[table], nil
+	}
+
+	term := r.Table(table).Status()
+	cursor, err := c.execRead(ctx, "table-status", &term, 1)
+	if err != nil {
+		return tableStatus{}, err
+	}
+	var status tableStatus
+	if err := cursor.One(&status); err != nil {
+		return tableStatus{}, err
+	}
+
+	if c.tables.status == nil {
+		c.tables.status = make(map[string]tableStatus)
+		c.tables.checked = make(map[string]time.Time)
+	}
+	previous, ok := c.tables.status[table]
+	if available := status.Status.ReadyForWrites; !ok || available != previous.Status.ReadyForWrites {
+		if available {
+			metrics.RethinkDbTableAvailable.WithLabelValues(table).Set(1)
+			if ok {
+				c.logger.Info().Str("table", table).Msg("Table is available again")
+			}
+		} else {
+			metrics.RethinkDbTableAvailable.WithLabelValues(table).Set(0)
+			c.logger.Warn().Str("table", table).Msg("Table is unavailable")
+		}
+	}
+	c.tables.status[table] = status
+	c.tables.checked[table] = time.Now()
+	return status, nil
+}
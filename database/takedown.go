@@ -0,0 +1,296 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// AuditOperationTakedown is the audit operation of queueing uris for removal by a takedown request
+const AuditOperationTakedown = "takedown"
+
+// rethinkDbTableSeeds is the table of seeds, where the url of a seed is its meta.name
+const rethinkDbTableSeeds = "config_seeds"
+
+// takedownPushBatchSize is the max number of uri ids pushed to the remove queue per command
+const takedownPushBatchSize = 1000
+
+// secondary indexes used to find the queued uris of a seed
+const (
+	rethinkDbIndexCrawlExecutionsSeedId = "seedId"
+	rethinkDbIndexUriQueueExecutionId   = "executionId"
+)
+
+// takedownPushScript pushes the given uri ids that haven't been pushed before to the remove queue
+// and returns the ids pushed. The ids pushed are remembered in a set so that a read of the
+// matches that is retried after some were pushed doesn't push them again.
+var takedownPushScript = redis.NewScript(`
+local pushed = {}
+for i = 2, #ARGV do
+    if redis.call('SADD', KEYS[2], ARGV[i]) == 1 then
+        pushed[#pushed + 1] = ARGV[i]
+    end
+end
+if #pushed > 0 then
+    redis.call('RPUSH', KEYS[1], unpack(pushed))
+end
+redis.call('PEXPIRE', KEYS[2], ARGV[1])
+return pushed
+`)
+
+// ErrInvalidTakedown is returned when a takedown request is invalid
+var ErrInvalidTakedown = errors.New("invalid takedown request")
+
+// ErrUnknownTakedown is returned when a takedown record is not found
+var ErrUnknownTakedown = errors.New("unknown takedown")
+
+// TakedownRequest requests removal of all queued uris of a seed or matching a uri pattern
+type TakedownRequest struct {
+	// SeedUrl is the url of the seed whose queued uris should be removed
+	SeedUrl string `json:"seedUrl,omitempty"`
+	// UriPattern is a regular expression matching the queued uris that should be removed, which is
+	// matched against every queued uri in a single scan of the uri queue table
+	UriPattern string `json:"uriPattern,omitempty"`
+	// RequestedBy identifies who requested the takedown
+	RequestedBy string `json:"requestedBy"`
+	// Reason is why the takedown was requested, e.g. a case number
+	Reason string `json:"reason"`
+}
+
+// TakedownRecord is the auditable record of a takedown request and proof of its removal
+type TakedownRecord struct {
+	Id          string    `rethinkdb:"id,omitempty" json:"id"`
+	SeedUrl     string    `rethinkdb:"seedUrl,omitempty" json:"seedUrl,omitempty"`
+	UriPattern  string    `rethinkdb:"uriPattern,omitempty" json:"uriPattern,omitempty"`
+	RequestedBy string    `rethinkdb:"requestedBy" json:"requestedBy"`
+	Reason      string    `rethinkdb:"reason" json:"reason"`
+	RequestedAt time.Time `rethinkdb:"requestedAt" json:"requestedAt"`
+	// Queued is the number of queued uris queued for removal
+	Queued int `rethinkdb:"queued" json:"queued"`
+	// VerifiedAt is when the number of remaining matching queued uris was last counted
+	VerifiedAt time.Time `rethinkdb:"verifiedAt,omitempty" json:"verifiedAt,omitempty"`
+	// Remaining is the number of matching queued uris remaining at VerifiedAt
+	Remaining int `rethinkdb:"remaining" json:"remaining"`
+	// CompletedAt is when no matching queued uris were first found to remain
+	CompletedAt time.Time `rethinkdb:"completedAt,omitempty" json:"completedAt,omitempty"`
+}
+
+// Takedown queues all queued uris matching request for removal in the high priority lane of
+// the REMURI queue and stores an auditable record of the request.
+func (d *database) Takedown(ctx context.Context, request TakedownRequest) (TakedownRecord, error) {
+	record := TakedownRecord{
+		SeedUrl:     request.SeedUrl,
+		UriPattern:  request.UriPattern,
+		RequestedBy: request.RequestedBy,
+		Reason:      request.Reason,
+		RequestedAt: time.Now().UTC(),
+	}
+	if (record.SeedUrl == "") == (record.UriPattern == "") {
+		return record, fmt.Errorf("%w: exactly one of seedUrl and uriPattern is required", ErrInvalidTakedown)
+	}
+	if record.RequestedBy == "" || record.Reason == "" {
+		return record, fmt.Errorf("%w: requestedBy and reason are required", ErrInvalidTakedown)
+	}
+	if record.UriPattern != "" {
+		if _, err := regexp.Compile(record.UriPattern); err != nil {
+			return record, fmt.Errorf("%w: %v", ErrInvalidTakedown, err)
+		}
+	}
+	if d.takedownTable == "" {
+		return record, errors.New("takedown table is not configured")
+	}
+
+	matches, err := d.takedownMatches(ctx, record)
+	if err != nil {
+		return record, fmt.Errorf("failed to find queued uris to take down: %w", err)
+	}
+
+	// queue for removal in the layout the frontier is migrating to, if any
+	queue := d.layouts[len(d.layouts)-1].removeUriHighQueue
+	if d.dryRun {
+		n, err := d.countTakedownMatches(ctx, matches)
+		if err != nil {
+			return record, fmt.Errorf("failed to count queued uris to take down: %w", err)
+		}
+		d.wouldDo(ctx, AuditOperationTakedown, queue, n)
+		record.Queued = n
+		record.Remaining = n
+		return record, nil
+	}
+
+	// the record is stored before any uris are queued so that every takedown is accounted for
+	term := r.Table(d.takedownTable).Insert(record)
+	wr, err := d.rethinkDB.execWrite(ctx, "insert-takedown-record", &term, 1)
+	if err != nil {
+		return record, fmt.Errorf("failed to store takedown record: %w", err)
+	}
+	if len(wr.GeneratedKeys) > 0 {
+		record.Id = wr.GeneratedKeys[0]
+	}
+
+	queued := 0
+	if matches != nil {
+		// the set of pushed ids shares the hash tag of the queue so that the script can use both
+		pushed := newIdSet(d.redis, idSetKeyPrefix(queue))
+		defer func() {
+			_ = pushed.delete(ctx)
+		}()
+		push := func(batch []interface{}) error {
+			args := append([]interface{}{idSetTtl.Milliseconds()}, batch...)
+			ids, err := takedownPushScript.Run(ctx, d.redis, []string{queue, pushed.key}, args...).StringSlice()
+			if err != nil {
+				return err
+			}
+			queued += len(ids)
+			if len(ids) > 0 {
+				d.audit(ctx, AuditOperationTakedown, len(ids), ids...)
+			}
+			return nil
+		}
+		err = d.rethinkDB.execReadEach(ctx, "get-takedown-queued-uris", matches, 0, func(cursor *r.Cursor) error {
+			batch := make([]interface{}, 0, takedownPushBatchSize)
+			var id string
+			for cursor.Next(&id) {
+				batch = append(batch, id)
+				if len(batch) == takedownPushBatchSize {
+					if err := push(batch); err != nil {
+						return err
+					}
+					batch = batch[:0]
+				}
+			}
+			if err := cursor.Err(); err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				return nil
+			}
+			return push(batch)
+		})
+	}
+	if err != nil {
+		return record, fmt.Errorf("takedown %s queued %d uris for removal: %w", record.Id, queued, err)
+	}
+	record.Queued = queued
+	record.Remaining = queued
+
+	term = r.Table(d.takedownTable).Get(record.Id).Update(map[string]interface{}{
+		"queued":    record.Queued,
+		"remaining": record.Remaining,
+	})
+	if _, err := d.rethinkDB.execWrite(ctx, "update-takedown-record", &term, 1); err != nil {
+		return record, fmt.Errorf("queued %d uris for removal but failed to update takedown record %s: %w", queued, record.Id, err)
+	}
+	return record, nil
+}
+
+// TakedownStatus counts the queued uris still matching a takedown request and records the result as proof of removal
+func (d *database) TakedownStatus(ctx context.Context, id string) (TakedownRecord, error) {
+	var record TakedownRecord
+	if d.takedownTable == "" {
+		return record, errors.New("takedown table is not configured")
+	}
+
+	term := r.Table(d.takedownTable).Get(id)
+	cursor, err := d.rethinkDB.execRead(ctx, "get-takedown-record", &term, 1)
+	if err != nil {
+		return record, err
+	}
+	if err := cursor.One(&record); errors.Is(err, r.ErrEmptyResult) {
+		return record, fmt.Errorf("%w: %s", ErrUnknownTakedown, id)
+	} else if err != nil {
+		return record, err
+	}
+
+	matches, err := d.takedownMatches(ctx, record)
+	if err == nil {
+		record.Remaining, err = d.countTakedownMatches(ctx, matches)
+	}
+	if err != nil {
+		return record, fmt.Errorf("failed to count remaining queued uris: %w", err)
+	}
+	record.VerifiedAt = time.Now().UTC()
+	if record.Remaining == 0 && record.CompletedAt.IsZero() {
+		record.CompletedAt = record.VerifiedAt
+	}
+
+	if d.dryRun {
+		return record, nil
+	}
+	term = r.Table(d.takedownTable).Get(id).Update(record)
+	if _, err := d.rethinkDB.execWrite(ctx, "update-takedown-record", &term, 1); err != nil {
+		return record, err
+	}
+	return record, nil
+}
+
+// takedownMatches returns a term selecting the ids of the queued uris matching a takedown, or nil
+// if none can match. The queued uris of a seed are found by way of the crawl executions of the
+// seed using secondary indexes, while a uri pattern is matched against every queued uri in a
+// full scan of the uri queue table, which is read in batches so that it isn't held in memory.
+func (d *database) takedownMatches(ctx context.Context, record TakedownRecord) (*r.Term, error) {
+	var term r.Term
+	if record.SeedUrl != "" {
+		seeds := r.Table(rethinkDbTableSeeds).Filter(r.Row.Field("meta").Field("name").Eq(record.SeedUrl)).Field("id")
+		var seedIds []string
+		if err := d.rethinkDB.execReadAll(ctx, "get-takedown-seeds", &seeds, 1, &seedIds); err != nil {
+			return nil, err
+		}
+		if len(seedIds) == 0 {
+			return nil, nil
+		}
+		executions := r.Table(rethinkDbTableCrawlExecutions).
+			GetAll(r.Args(seedIds)).OptArgs(r.GetAllOpts{Index: rethinkDbIndexCrawlExecutionsSeedId}).
+			Field("id")
+		var ceids []string
+		if err := d.rethinkDB.execReadAll(ctx, "get-takedown-crawl-executions", &executions, len(seedIds), &ceids); err != nil {
+			return nil, err
+		}
+		if len(ceids) == 0 {
+			return nil, nil
+		}
+		term = r.Table(rethinkDbTableUriQueue).
+			GetAll(r.Args(ceids)).OptArgs(r.GetAllOpts{Index: rethinkDbIndexUriQueueExecutionId}).
+			Field("id")
+	} else {
+		term = r.Table(rethinkDbTableUriQueue).Filter(r.Row.Field("uri").Match(record.UriPattern)).Field("id")
+	}
+	return &term, nil
+}
+
+// countTakedownMatches counts the queued uris selected by a term returned by takedownMatches
+func (d *database) countTakedownMatches(ctx context.Context, matches *r.Term) (int, error) {
+	if matches == nil {
+		return 0, nil
+	}
+	term := matches.Count()
+	var count []int
+	if err := d.rethinkDB.execReadAll(ctx, "count-takedown-queued-uris", &term, 1, &count); err != nil {
+		return 0, err
+	}
+	if len(count) == 0 {
+		return 0, nil
+	}
+	return count[0], nil
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+const testTakedownTable = "takedowns"
+
+func TestTakedown(t *testing.T) {
+	ctx := context.Background()
+	seedRequest := TakedownRequest{SeedUrl: "http://seed/", RequestedBy: "me", Reason: "case 1"}
+	seeds := r.Table(rethinkDbTableSeeds).Filter(r.Row.Field("meta").Field("name").Eq(seedRequest.SeedUrl)).Field("id")
+	executions := r.Table(rethinkDbTableCrawlExecutions).
+		GetAll(r.Args([]string{"s1"})).OptArgs(r.GetAllOpts{Index: rethinkDbIndexCrawlExecutionsSeedId}).
+		Field("id")
+	seedUris := r.Table(rethinkDbTableUriQueue).
+		GetAll(r.Args([]string{"ce1"})).OptArgs(r.GetAllOpts{Index: rethinkDbIndexUriQueueExecutionId}).
+		Field("id")
+	patternRequest := TakedownRequest{UriPattern: "^http://a/", RequestedBy: "me", Reason: "case 2"}
+	patternUris := r.Table(rethinkDbTableUriQueue).Filter(r.Row.Field("uri").Match(patternRequest.UriPattern)).Field("id")
+	insert := r.Table(testTakedownTable).Insert(r.MockAnything())
+	inserted := []interface{}{map[string]interface{}{"inserted": 1, "generated_keys": []string{"td1"}}}
+	update := func(queued int) r.Term {
+		return r.Table(testTakedownTable).Get("td1").Update(map[string]interface{}{"queued": queued, "remaining": queued})
+	}
+	replaced := []interface{}{map[string]interface{}{"replaced": 1}}
+
+	tests := []struct {
+		name       string
+		request    TakedownRequest
+		mock       func(mock *r.Mock)
+		wantErr    bool
+		wantQueued []string
+	}{
+		{
+			name:    "seed",
+			request: seedRequest,
+			mock: func(mock *r.Mock) {
+				mock.On(seeds).Return([]interface{}{"s1"}, nil)
+				mock.On(executions).Return([]interface{}{"ce1"}, nil)
+				mock.On(insert).Return(inserted, nil)
+				mock.On(seedUris).Return([]interface{}{"u1", "u2"}, nil)
+				mock.On(update(2)).Return(replaced, nil)
+			},
+			wantQueued: []string{"u1", "u2"},
+		},
+		{
+			name:    "uri pattern",
+			request: patternRequest,
+			mock: func(mock *r.Mock) {
+				mock.On(insert).Return(inserted, nil)
+				mock.On(patternUris).Return([]interface{}{"u3"}, nil)
+				mock.On(update(1)).Return(replaced, nil)
+			},
+			wantQueued: []string{"u3"},
+		},
+		{
+			name:    "unknown seed is recorded",
+			request: seedRequest,
+			mock: func(mock *r.Mock) {
+				mock.On(seeds).Return([]interface{}{}, nil)
+				mock.On(insert).Return(inserted, nil)
+				mock.On(update(0)).Return(replaced, nil)
+			},
+		},
+		{
+			name:    "nothing is queued unless the record is stored",
+			request: seedRequest,
+			mock: func(mock *r.Mock) {
+				mock.On(seeds).Return([]interface{}{"s1"}, nil)
+				mock.On(executions).Return([]interface{}{"ce1"}, nil)
+				mock.On(insert).Return(nil, errors.New("insert failed"))
+			},
+			wantErr: true,
+		},
+		{
+			name:    "invalid request",
+			request: TakedownRequest{SeedUrl: "http://seed/", UriPattern: "^http://a/", RequestedBy: "me", Reason: "both"},
+			mock:    func(mock *r.Mock) {},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := newTestScript(t)
+			conn := NewMockConnection()
+			mock := conn.GetMock()
+			tt.mock(mock)
+			db, err := NewDatabase(ctx, client, conn.RethinkDbConnection, Options{TakedownTable: testTakedownTable})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			record, err := db.Takedown(ctx, tt.request)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Takedown() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			mock.AssertExpectations(t)
+			if queue, _ := client.LRange(ctx, redisRemoveUriHighQueue, 0, -1).Result(); !equalStrings(queue, tt.wantQueued) {
+				t.Errorf("queued for removal = %v, want %v", queue, tt.wantQueued)
+			}
+			if sets, _ := client.Keys(ctx, "*:idset:*").Result(); len(sets) > 0 {
+				t.Errorf("sets of pushed ids left: %v", sets)
+			}
+			if tt.wantErr {
+				return
+			}
+			if record.Id != "td1" || record.Queued != len(tt.wantQueued) {
+				t.Errorf("record id = %q, queued = %d, want td1 and %d", record.Id, record.Queued, len(tt.wantQueued))
+			}
+		})
+	}
+}
+
+// TestTakedownPushSkipsPushedIds checks that the uri ids pushed again by a retried read of the
+// matches of a takedown are only queued once
+func TestTakedownPushSkipsPushedIds(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestScript(t)
+	pushed := newIdSet(client, idSetKeyPrefix(redisRemoveUriHighQueue))
+
+	batches := [][]string{{"u1", "u2"}, {"u1", "u2", "u3"}}
+	wantPushed := [][]string{{"u1", "u2"}, {"u3"}}
+	for i, batch := range batches {
+		args := append([]interface{}{idSetTtl.Milliseconds()}, toValues(batch)...)
+		ids, err := takedownPushScript.Run(ctx, client, []string{redisRemoveUriHighQueue, pushed.key}, args...).StringSlice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalStrings(ids, wantPushed[i]) {
+			t.Errorf("pushed %v, want %v", ids, wantPushed[i])
+		}
+	}
+	if queue, _ := client.LRange(ctx, redisRemoveUriHighQueue, 0, -1).Result(); !equalStrings(queue, []string{"u1", "u2", "u3"}) {
+		t.Errorf("queued for removal = %v, want [u1 u2 u3]", queue)
+	}
+	if ttl, _ := client.PTTL(ctx, pushed.key).Result(); ttl <= 0 {
+		t.Errorf("set of pushed ids has no ttl: %v", ttl)
+	}
+}
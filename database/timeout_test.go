@@ -0,0 +1,227 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	frontierV1 "github.com/nlnwa/veidemann-api/go/frontier/v1"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/clock"
+	"github.com/redis/go-redis/v9"
+	r "gopkg.in/rethinkdb/rethinkdb-go.v6"
+)
+
+// stubIdempotencyTokens makes newIdempotencyToken return token-1, token-2, ... for the duration of the test
+func stubIdempotencyTokens(t *testing.T) {
+	t.Helper()
+	n := 0
+	original := newIdempotencyToken
+	newIdempotencyToken = func() string {
+		n++
+		return "token-" + strconv.Itoa(n)
+	}
+	t.Cleanup(func() {
+		newIdempotencyToken = original
+	})
+}
+
+// lpopCountHook emulates LPOP with a count and LMPOP, which the miniredis version used doesn't
+// support, with LRANGE and LTRIM on a client without the hook
+type lpopCountHook struct {
+	client *redis.Client
+	// lmpops counts the LMPOP commands emulated
+	lmpops *int
+}
+
+func (h lpopCountHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h lpopCountHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if mpop, ok := cmd.(*redis.KeyValuesCmd); ok && mpop.Name() == "lmpop" {
+			return h.lmpop(ctx, mpop)
+		}
+		pop, ok := cmd.(*redis.StringSliceCmd)
+		if !ok || pop.Name() != "lpop" || len(pop.Args()) != 3 {
+			return next(ctx, cmd)
+		}
+		key := pop.Args()[1].(string)
+		count := pop.Args()[2].(int)
+		items, err := h.client.LRange(ctx, key, 0, int64(count)-1).Result()
+		if err == nil {
+			err = h.client.LTrim(ctx, key, int64(len(items)), -1).Err()
+		}
+		if err == nil && len(items) == 0 {
+			err = redis.Nil
+		}
+		pop.SetVal(items)
+		pop.SetErr(err)
+		return err
+	}
+}
+
+// lmpop pops from the first of the keys of an LMPOP LEFT command that isn't empty
+func (h lpopCountHook) lmpop(ctx context.Context, cmd *redis.KeyValuesCmd) error {
+	*h.lmpops++
+	args := cmd.Args()
+	numKeys := args[1].(int)
+	count := args[len(args)-1].(int64)
+	for _, key := range args[2 : 2+numKeys] {
+		items, err := h.client.LRange(ctx, key.(string), 0, count-1).Result()
+		if err == nil && len(items) > 0 {
+			err = h.client.LTrim(ctx, key.(string), int64(len(items)), -1).Err()
+		}
+		if err != nil || len(items) > 0 {
+			cmd.SetVal(key.(string), items)
+			cmd.SetErr(err)
+			return err
+		}
+	}
+	cmd.SetErr(redis.Nil)
+	return redis.Nil
+}
+
+func (h lpopCountHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// withLPopCount adds lpopCountHook to client and returns the number of LMPOP commands emulated
+func withLPopCount(t *testing.T, client *redis.Client) *int {
+	t.Helper()
+	plain := redis.NewClient(client.Options())
+	t.Cleanup(func() {
+		_ = plain.Close()
+	})
+	lmpops := new(int)
+	client.AddHook(lpopCountHook{client: plain, lmpops: lmpops})
+	return lmpops
+}
+
+// timeoutTerm returns the batch write of setCrawlExecutionsStateAbortedTimeout for a single crawl execution
+func timeoutTerm(ceid string, token string) r.Term {
+	return r.Expr([]r.Term{
+		r.Table(rethinkDbTableCrawlExecutions).Get(ceid).Update(
+			func(doc r.Term) interface{} {
+				return r.Branch(
+					doc.HasFields("endTime"),
+					nil,
+					doc.Field(crawlExecutionTimeoutTokenField).Default("").Eq(token),
+					nil,
+					map[string]string{
+						"desiredState":                  frontierV1.CrawlExecutionStatus_ABORTED_TIMEOUT.String(),
+						crawlExecutionTimeoutTokenField: token,
+					})
+			}),
+	})
+}
+
+// TestTimeoutCrawlExecutionsAmbiguousFailure checks that a timeout that was applied although its
+// write failed is retried with the same token and only counted and announced once
+func TestTimeoutCrawlExecutionsAmbiguousFailure(t *testing.T) {
+	ctx := context.Background()
+	stubIdempotencyTokens(t)
+	client, _ := newTestScript(t)
+	withLPopCount(t, client)
+	conn := NewMockConnection()
+	mock := conn.GetMock()
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	db, err := NewDatabase(ctx, client, conn.RethinkDbConnection, Options{Clock: clock.NewFake(now)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ceid = "ce1"
+	if err := client.RPush(ctx, redisCrawlExecutionTimeoutQueue, ceid).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first write is applied but fails, the retry finds it applied
+	mock.On(timeoutTerm(ceid, "token-1")).Return(nil, errors.New("connection reset")).Once()
+	mock.On(timeoutTerm(ceid, "token-1")).Return([]interface{}{map[string]interface{}{"unchanged": 1}}, nil).Once()
+	mock.On(r.Table(rethinkDbTableCrawlExecutions).GetAll(r.Args([]string{ceid})).Pluck("id", crawlExecutionTimeoutTokenField)).
+		Return([]interface{}{map[string]interface{}{"id": ceid, crawlExecutionTimeoutTokenField: "token-1"}}, nil).Once()
+
+	if n, err := db.TimeoutCrawlExecutions(ctx); err != nil || n != 0 {
+		t.Fatalf("TimeoutCrawlExecutions() with failing write = %d, %v, want 0, nil", n, err)
+	}
+	if queue, _ := client.LRange(ctx, redisCrawlExecutionTimeoutQueue, 0, -1).Result(); !equalStrings(queue, []string{ceid}) {
+		t.Fatalf("timeout queue after failing write = %v, want [%s]", queue, ceid)
+	}
+
+	if n, err := db.TimeoutCrawlExecutions(ctx); err != nil || n != 1 {
+		t.Fatalf("TimeoutCrawlExecutions() retry = %d, %v, want 1, nil", n, err)
+	}
+	mock.AssertExpectations(t)
+
+	events, err := client.XRange(ctx, redisCrawlExecutionAbortedStream, "-", "+").Result()
+	if err != nil || len(events) != 1 {
+		t.Fatalf("aborted events = %v, %v, want 1", events, err)
+	}
+	if timestamp := events[0].Values["timestamp"]; timestamp != now.Format(time.RFC3339Nano) {
+		t.Errorf("aborted event timestamp = %v, want %v", timestamp, now.Format(time.RFC3339Nano))
+	}
+	if queue, _ := client.LLen(ctx, redisCrawlExecutionTimeoutQueue).Result(); queue != 0 {
+		t.Errorf("timeout queue length = %d, want 0", queue)
+	}
+	if tokens, _ := client.HLen(ctx, timeoutTokensKey(redisCrawlExecutionTimeoutQueue)).Result(); tokens != 0 {
+		t.Errorf("stored tokens = %d, want 0", tokens)
+	}
+}
+
+// TestTimeoutCrawlExecutionsLMPop checks that the crawl execution timeout queues of all key
+// layouts are popped together with LMPOP until they are all empty
+func TestTimeoutCrawlExecutionsLMPop(t *testing.T) {
+	ctx := context.Background()
+	stubIdempotencyTokens(t)
+	client, _ := newTestScript(t)
+	lmpops := withLPopCount(t, client)
+	conn := NewMockConnection()
+	mock := conn.GetMock()
+	db, err := NewDatabase(ctx, client, conn.RethinkDbConnection, Options{
+		KeyMapping: KeyMappingOptions{Mapping: map[string]string{redisCrawlExecutionTimeoutQueue: "ceid_timeout2"}},
+		LMPop:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for queue, ceid := range map[string]string{redisCrawlExecutionTimeoutQueue: "ce1", "ceid_timeout2": "ce2"} {
+		if err := client.RPush(ctx, queue, ceid).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mock.On(r.MockAnything()).Return([]interface{}{map[string]interface{}{"replaced": 1}}, nil).Twice()
+
+	if n, err := db.TimeoutCrawlExecutions(ctx); err != nil || n != 2 {
+		t.Fatalf("TimeoutCrawlExecutions() = %d, %v, want 2, nil", n, err)
+	}
+	mock.AssertExpectations(t)
+	// one pop per queue and one finding both empty
+	if *lmpops != 3 {
+		t.Errorf("popped with %d LMPOP commands, want 3", *lmpops)
+	}
+	for _, queue := range []string{redisCrawlExecutionTimeoutQueue, "ceid_timeout2"} {
+		if n, _ := client.LLen(ctx, queue).Result(); n != 0 {
+			t.Errorf("length of %s = %d, want 0", queue, n)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// redisWorkerLockPrefix is the key prefix of the lock of each worker
+const redisWorkerLockPrefix = "frontier:qw:lock:"
+
+// WorkerLocksOptions configures WorkerLocks
+type WorkerLocksOptions struct {
+	// Owner identifies the replica in its tokens, e.g. the host name
+	Owner string
+	// Ttl is the TTL of each lock key. Another replica takes over a worker at most Ttl after
+	// the replica holding its lock died.
+	Ttl time.Duration
+	// Max is the max number of locks held by this replica (0 for no limit). Without a limit the
+	// first replica to start takes all locks, so to spread the workers it should be about the
+	// number of workers divided by the number of replicas, rounded up.
+	Max int
+}
+
+// WorkerLocks spreads workers over several replicas by only letting the replica holding the
+// lock of a worker run it. Each lock is a Redis key set with SET NX and a TTL, which the holder
+// renews every third of the TTL and deletes when it stops.
+type WorkerLocks struct {
+	opts   WorkerLocksOptions
+	names  []string
+	leases map[string]*lease
+}
+
+// NewWorkerLocks returns WorkerLocks for the named workers, which are acquired when Run is called
+func NewWorkerLocks(redisClient redis.UniversalClient, names []string, opts WorkerLocksOptions) *WorkerLocks {
+	leases := make(map[string]*lease)
+	for _, name := range names {
+		leases[name] = newLease(redisClient, redisWorkerLockPrefix+name, opts.Owner, opts.Ttl)
+	}
+	return &WorkerLocks{
+		opts:   opts,
+		names:  names,
+		leases: leases,
+	}
+}
+
+// Held returns true if this replica holds the lock of the named worker or the worker is not locked
+func (w *WorkerLocks) Held(name string) bool {
+	l, ok := w.leases[name]
+	return !ok || l.held()
+}
+
+// Run acquires and renews locks until ctx is done, then releases them
+func (w *WorkerLocks) Run(ctx context.Context) {
+	log.Info().Int("max", w.opts.Max).Dur("ttl", w.opts.Ttl).Msg("Acquiring worker locks")
+	ticker := time.NewTicker(w.opts.Ttl / 3)
+	defer ticker.Stop()
+	for {
+		w.Acquire(ctx)
+		select {
+		case <-ctx.Done():
+			w.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Acquire renews the locks held by this replica and takes free locks up to the max number of
+// locks, trying them in random order so that replicas don't compete for the same workers
+func (w *WorkerLocks) Acquire(ctx context.Context) {
+	held := 0
+	for _, l := range w.leases {
+		if l.held() {
+			held++
+		}
+	}
+	for _, i := range rand.Perm(len(w.names)) {
+		name := w.names[i]
+		l := w.leases[name]
+		if !l.held() && w.opts.Max > 0 && held >= w.opts.Max {
+			continue
+		}
+		was, is, err := l.acquire(ctx)
+		switch {
+		case err != nil:
+			log.Warn().Err(err).Bool("held", was).Msgf("Failed to acquire lock of worker: %s", name)
+			if was && !is {
+				log.Error().Msgf("Failed to renew lock in time, stopping worker: %s", name)
+			}
+		case is && !was:
+			log.Info().Msgf("Acquired lock of worker: %s", name)
+		case was && !is:
+			log.Error().Msgf("Lost lock of worker to another replica: %s", name)
+		}
+		if is && !was {
+			held++
+			metrics.WorkerLockHeld.WithLabelValues(name).Set(1)
+		} else if was && !is {
+			held--
+			metrics.WorkerLockHeld.WithLabelValues(name).Set(0)
+		}
+	}
+}
+
+// release deletes the keys of the locks held by this replica, letting other replicas take over
+// their workers without waiting for the keys to expire
+func (w *WorkerLocks) release() {
+	for _, name := range w.names {
+		held, err := w.leases[name].release(context.Background())
+		if !held {
+			continue
+		}
+		metrics.WorkerLockHeld.WithLabelValues(name).Set(0)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Failed to release lock of worker, it is handed over when the lock expires: %s", name)
+		}
+	}
+	log.Info().Msg("Released worker locks")
+}
@@ -0,0 +1,99 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Exit codes of terminal errors, which let orchestration and alerting tell them apart
+const (
+	exitCodeInternal             = 1
+	exitCodeConfig               = 2
+	exitCodeRedisUnavailable     = 3
+	exitCodeRethinkDbUnavailable = 4
+	exitCodeRethinkDbAuth        = 5
+	exitCodeWorkerFatal          = 6
+	exitCodeRedisAuth            = 7
+)
+
+// terminalError is an error that terminates the process with the exit code of its class
+type terminalError struct {
+	class string
+	code  int
+	err   error
+}
+
+func (e *terminalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *terminalError) Unwrap() error {
+	return e.err
+}
+
+// configError classifies err as an invalid configuration
+func configError(err error) error {
+	return &terminalError{class: "config", code: exitCodeConfig, err: err}
+}
+
+// workerFatalError classifies err as a worker giving up
+func workerFatalError(err error) error {
+	return &terminalError{class: "worker-fatal", code: exitCodeWorkerFatal, err: err}
+}
+
+// classify returns the class and exit code of a terminal error
+func classify(err error) (string, int) {
+	var terminal *terminalError
+	switch {
+	case errors.As(err, &terminal):
+		return terminal.class, terminal.code
+	case errors.Is(err, database.ErrRethinkDbAuth):
+		return "rethinkdb-auth", exitCodeRethinkDbAuth
+	case errors.Is(err, database.ErrRethinkDbUnavailable):
+		return "rethinkdb-unavailable", exitCodeRethinkDbUnavailable
+	case errors.Is(err, database.ErrRedisAuth):
+		return "redis-auth", exitCodeRedisAuth
+	case errors.Is(err, database.ErrRedisUnavailable):
+		return "redis-unavailable", exitCodeRedisUnavailable
+	default:
+		return "internal", exitCodeInternal
+	}
+}
+
+// exitOnPanic recovers from a panic in main, logs a final record with the class of the
+// terminal error and exits with its exit code. It must be deferred first in main so that
+// all other deferred functions have run when it exits.
+func exitOnPanic() {
+	v := recover()
+	if v == nil {
+		return
+	}
+	err, ok := v.(error)
+	if !ok {
+		err = fmt.Errorf("%v", v)
+	}
+	class, code := classify(err)
+	log.WithLevel(zerolog.FatalLevel).Err(err).Str("class", class).Int("exitCode", code).Msg("Terminated")
+	os.Exit(code)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/worker"
+)
+
+// removalRateSmoothing is the weight of the latest sample in the smoothed uri removal rate
+const removalRateSmoothing = 0.3
+
+// frontierLag computes the composite frontier queue lag from successive samples
+type frontierLag struct {
+	// removed returns the total number of removed queued uris
+	removed func() int64
+
+	lastSample         time.Time
+	lastRemoved        int64
+	removalRate        float64
+	timeoutsSince      time.Time
+	removeBacklogSince time.Time
+}
+
+// frontierLagWorker returns a worker that computes and exports the frontier queue lag.
+//
+// The lag is the max of:
+//   - how long the oldest crawl host group in the wait queue is overdue
+//   - how long the timeout queues have been non-empty
+//   - the estimated time to drain the REMURI queue at the current removal rate
+func frontierLagWorker(db database.Database, removed func() int64) worker.Func {
+	l := &frontierLag{removed: removed}
+	return func(ctx context.Context) (int, error) {
+		sample, err := db.LagSample(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to sample frontier lag: %w", err)
+		}
+		l.observe(sample, time.Now())
+		return 0, nil
+	}
+}
+
+func (l *frontierLag) observe(sample database.LagSample, now time.Time) {
+	removed := l.removed()
+	if !l.lastSample.IsZero() {
+		if elapsed := now.Sub(l.lastSample).Seconds(); elapsed > 0 {
+			rate := float64(removed-l.lastRemoved) / elapsed
+			l.removalRate = removalRateSmoothing*rate + (1-removalRateSmoothing)*l.removalRate
+		}
+	}
+	l.lastSample = now
+	l.lastRemoved = removed
+
+	var waitOverdue float64
+	if !sample.OldestWaitDeadline.IsZero() && now.After(sample.OldestWaitDeadline) {
+		waitOverdue = now.Sub(sample.OldestWaitDeadline).Seconds()
+	}
+
+	timeoutAge := nonEmptyFor(&l.timeoutsSince, sample.TimeoutQueueLength, now)
+
+	removeEta := nonEmptyFor(&l.removeBacklogSince, sample.RemoveUriQueueLength, now)
+	if sample.RemoveUriQueueLength > 0 && l.removalRate > 0 {
+		removeEta = float64(sample.RemoveUriQueueLength) / l.removalRate
+	}
+
+	metrics.FrontierLagComponent.WithLabelValues("wait_overdue").Set(waitOverdue)
+	metrics.FrontierLagComponent.WithLabelValues("timeout_age").Set(timeoutAge)
+	metrics.FrontierLagComponent.WithLabelValues("remove_eta").Set(removeEta)
+	metrics.FrontierLag.Set(maxOf(waitOverdue, timeoutAge, removeEta))
+}
+
+// nonEmptyFor returns for how many seconds a queue has been non-empty, tracking when it became non-empty in since
+func nonEmptyFor(since *time.Time, length int64, now time.Time) float64 {
+	if length == 0 {
+		*since = time.Time{}
+		return 0
+	}
+	if since.IsZero() {
+		*since = now
+	}
+	return now.Sub(*since).Seconds()
+}
+
+func maxOf(values ...float64) float64 {
+	m := 0.0
+	for _, v := range values {
+		if v > m {
+			m = v
+		}
+	}
+	return m
+}
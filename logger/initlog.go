@@ -19,41 +19,32 @@ package logger
 import (
 	stdlog "log"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// InitLog configures the global logger. The log level can be changed later with SetLevel.
 func InitLog(level string, format string, logCaller bool) {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
-	switch strings.ToLower(level) {
-	case "panic":
-		log.Logger = log.Level(zerolog.PanicLevel)
-	case "fatal":
-		log.Logger = log.Level(zerolog.FatalLevel)
-	case "error":
-		log.Logger = log.Level(zerolog.ErrorLevel)
-	case "warn":
-		log.Logger = log.Level(zerolog.WarnLevel)
-	case "info":
-		log.Logger = log.Level(zerolog.InfoLevel)
-	case "debug":
-		log.Logger = log.Level(zerolog.DebugLevel)
-	case "trace":
-		log.Logger = log.Level(zerolog.TraceLevel)
-	}
+	_ = SetLevel(level)
 
-	if format == "logfmt" {
+	switch format {
+	case "logfmt":
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+	case "console":
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: "15:04:05.000"})
 	}
 
 	if logCaller {
 		log.Logger = log.With().Caller().Logger()
 	}
 
+	unfiltered = log.Logger
+	log.Logger = log.Hook(levelHook{})
+
 	stdlog.SetFlags(0)
 	stdlog.SetOutput(log.Logger)
 
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+// level is the log level of the global logger, which can be changed at runtime with SetLevel
+var level = int32(zerolog.TraceLevel)
+
+// unfiltered is the global logger without the level filter
+var unfiltered zerolog.Logger
+
+// SetLevel sets the log level of the global logger
+func SetLevel(l string) error {
+	parsed, err := zerolog.ParseLevel(strings.ToLower(l))
+	if err != nil || parsed == zerolog.NoLevel {
+		return fmt.Errorf("invalid log level: %s", l)
+	}
+	atomic.StoreInt32(&level, int32(parsed))
+	return nil
+}
+
+// Unfiltered returns the global logger without the log level set with SetLevel, for loggers that
+// override the log level
+func Unfiltered() zerolog.Logger {
+	return unfiltered
+}
+
+// levelHook discards events below the log level set with SetLevel
+type levelHook struct{}
+
+func (levelHook) Run(e *zerolog.Event, l zerolog.Level, _ string) {
+	if l < zerolog.Level(atomic.LoadInt32(&level)) {
+		e.Discard()
+	}
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// ParseLevelOverrides parses log level overrides on the form "name=level,name2=level2"
+func ParseLevelOverrides(s string) (map[string]zerolog.Level, error) {
+	overrides := make(map[string]zerolog.Level)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid log level override: %s", pair)
+		}
+		level, err := zerolog.ParseLevel(strings.ToLower(strings.TrimSpace(value)))
+		if err != nil || level == zerolog.NoLevel {
+			return nil, fmt.Errorf("invalid log level in log level override: %s", pair)
+		}
+		overrides[name] = level
+	}
+	return overrides, nil
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logger
+
+import (
+	"context"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/rs/zerolog"
+	"github.com/uber/jaeger-client-go"
+)
+
+// traceHook adds trace and span id to log events
+type traceHook struct {
+	traceId string
+	spanId  string
+}
+
+func (h traceHook) Run(e *zerolog.Event, _ zerolog.Level, _ string) {
+	e.Str("traceId", h.traceId).Str("spanId", h.spanId)
+}
+
+var noopHook = zerolog.HookFunc(func(*zerolog.Event, zerolog.Level, string) {})
+
+// TraceHook returns a hook that adds the trace and span id of the active span in ctx to log events.
+func TraceHook(ctx context.Context) zerolog.Hook {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return noopHook
+	}
+	sc, ok := span.Context().(jaeger.SpanContext)
+	if !ok {
+		return noopHook
+	}
+	return traceHook{
+		traceId: sc.TraceID().String(),
+		spanId:  sc.SpanID().String(),
+	}
+}
+
+// WithTrace returns a copy of ctx associated with l hooked to add the trace
+// and span id of the active span in ctx to every log event.
+//
+// Use zerolog's log.Ctx to get the logger back out of the context.
+func WithTrace(ctx context.Context, l zerolog.Logger) context.Context {
+	l = l.Hook(TraceHook(ctx))
+	return l.WithContext(ctx)
+}
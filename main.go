@@ -20,17 +20,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"golang.org/x/sync/errgroup"
-	"io"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/nlnwa/veidemann-frontier-queue-workers/admin"
 	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
 	"github.com/nlnwa/veidemann-frontier-queue-workers/logger"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/reconciler"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/report"
 	"github.com/nlnwa/veidemann-frontier-queue-workers/telemetry"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/worker"
 	"github.com/opentracing/opentracing-go"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/pflag"
@@ -40,42 +47,238 @@ import (
 func main() {
 	pflag.String("db-host", "rethinkdb-proxy", "RethinkDB host")
 	pflag.Int("db-port", 28015, "RethinkDB port")
+	pflag.StringSlice("db-addresses", nil, "Comma separated list of host:port addresses of RethinkDB servers or proxies, which are failed over between on connection errors and used instead of db-host and db-port")
 	pflag.String("db-name", "veidemann", "RethinkDB database name")
 	pflag.String("db-user", "", "RethinkDB username")
 	pflag.String("db-password", "", "RethinkDB password")
+	pflag.Bool("db-tls", false, "Connect to RethinkDB with TLS")
+	pflag.String("db-tls-ca-cert", "", "Path to a PEM file of CA certificates used to verify the RethinkDB server instead of the system roots (TLS)")
+	pflag.String("db-tls-cert", "", "Path to a PEM file of the client certificate presented to the RethinkDB server (TLS)")
+	pflag.String("db-tls-key", "", "Path to a PEM file of the key of the client certificate (TLS)")
+	pflag.String("db-tls-server-name", "", "Name used to verify the RethinkDB server certificate instead of the host name (TLS)")
+	pflag.Bool("db-tls-insecure-skip-verify", false, "Don't verify the RethinkDB server certificate (TLS)")
 	pflag.Duration("db-query-timeout", 10*time.Second, "RethinkDB query timeout")
+	pflag.Duration("db-connect-timeout", 10*time.Second, "Timeout of connecting to a RethinkDB server")
+	pflag.Int("db-connect-retries", 10, "Number of times connecting to a RethinkDB server is retried")
+	pflag.Duration("db-wait-timeout", 60*time.Second, "How long to wait for the RethinkDB tables to be ready after a query timed out")
 	pflag.Int("db-max-retries", 3, "Max retries when query fails")
 	pflag.Int("db-max-open-conn", 10, "Max open connections")
 	pflag.Bool("db-use-opentracing", false, "Use opentracing for queries")
+	pflag.Duration("db-slow-query-threshold", 0, "Log queries taking longer than this duration (0 disables slow query logging)")
+	pflag.Duration("db-write-coalesce-window", 0, "How long small writes wait to be batched with writes from other workers into a single query, adding up to this latency to each write (0 disables write coalescing)")
+	pflag.Int("db-write-coalesce-max-batch", 100, "Max number of writes in a coalesced batch")
+	pflag.Float64("db-write-rate-limit", 0, "Max number of documents written to RethinkDB per second, shared by all workers (0 for no limit)")
+	pflag.Int("db-write-rate-burst", 1000, "Max number of documents written to RethinkDB in a burst above the write rate limit")
+	pflag.String("db-durability", database.DurabilitySoft, "Durability of RethinkDB writes, available values are soft (acknowledged when in memory) and hard (acknowledged when committed to disk)")
+	pflag.String("db-operation-durability", "", "Durability of RethinkDB writes by operation on the form \"operation=hard,operation2=soft\" overriding db-durability, e.g. set-crawl-execution-state-aborted-timeout=hard (batches of coalesced writes are named coalesced-write)")
+	pflag.Int("db-breaker-threshold", 0, "Number of consecutive failed RethinkDB operations after which DB-dependent work is skipped until the breaker half-opens (0 disables the circuit breaker)")
+	pflag.Duration("db-breaker-cooldown", 30*time.Second, "How long the RethinkDB circuit breaker stays open before letting a probe through")
+	pflag.Duration("db-health-check-interval", 0, "Delay between RethinkDB health checks, which reconnect when a cheap query fails (0 disables health checks)")
+	pflag.Bool("db-query-tags", false, "Tag each RethinkDB query with version, worker and operation, visible in the rethinkdb.jobs system table")
+	pflag.Duration("load-shedding-latency", 0, "Moving average RethinkDB query latency above which iterations of non-critical workers (update-job-executions) are skipped so that uri removal and timeouts keep their database capacity (0 disables load shedding)")
+	pflag.Float64("redis-memory-pressure-threshold", 0, "Ratio (0-1) of used memory to maxmemory of a redis master above which a warning is logged and iterations of workers that don't drain a queue (update-job-executions) are skipped (0 disables the check)")
+	pflag.Bool("db-rebalance-guard", false, "Defer batch operations on RethinkDB tables while their shards are being rebalanced")
+	pflag.Bool("db-table-pausing", false, "Pause the workers using a RethinkDB table while it is unavailable, e.g. during a reconfiguration or after losing nodes, and resume them when it is ready for writes again")
 
 	pflag.String("redis-host", "redis-veidemann-frontier-master", "Redis host")
 	pflag.Int("redis-port", 6379, "Redis port")
-	pflag.String("redis-script-path", "./lua", "Path to redis lua scripts")
+	pflag.String("redis-network", "tcp", "Network type used to connect to redis, available values are tcp and unix")
+	pflag.String("redis-socket", "", "Path to the redis unix socket, which is connected to instead of redis-host and redis-port (unix network)")
+	pflag.Int("redis-db", 0, "Redis logical database the frontier keys live in (must be 0 in cluster mode)")
+	pflag.String("redis-sentinel-master", "", "Name of the redis master monitored by Redis Sentinel, which is connected to instead of redis-host and redis-port")
+	pflag.StringSlice("redis-sentinel-addrs", nil, "Comma separated list of host:port addresses of the Redis Sentinels (sentinel mode)")
+	pflag.StringSlice("redis-cluster-addrs", nil, "Comma separated list of host:port addresses of Redis Cluster nodes, which are connected to instead of redis-host and redis-port (the replication check is not supported in cluster mode)")
+	pflag.String("redis-username", "", "Redis ACL username (the default user if empty)")
+	pflag.String("redis-username-file", "", "Path to a file containing the redis ACL username")
+	pflag.String("redis-password", "", "Redis password")
+	pflag.String("redis-password-file", "", "Path to a file containing the redis password")
+	pflag.Bool("redis-tls", false, "Connect to redis with TLS")
+	pflag.String("redis-tls-ca-cert", "", "Path to a PEM file of CA certificates used to verify the redis server instead of the system roots (TLS)")
+	pflag.String("redis-tls-cert", "", "Path to a PEM file of the client certificate presented to the redis server (TLS)")
+	pflag.String("redis-tls-key", "", "Path to a PEM file of the key of the client certificate (TLS)")
+	pflag.String("redis-tls-server-name", "", "Name used to verify the redis server certificate instead of the host name (TLS)")
+	pflag.Bool("redis-tls-insecure-skip-verify", false, "Don't verify the redis server certificate (TLS)")
+	pflag.Duration("redis-dial-timeout", 5*time.Second, "Timeout for establishing new connections to redis")
+	pflag.Duration("redis-read-timeout", 3*time.Second, "Timeout for reading a reply from redis, extended by the timeout of blocking commands")
+	pflag.Duration("redis-write-timeout", 3*time.Second, "Timeout for writing a command to redis")
+	pflag.String("redis-script-path", "", "Path to a directory of redis lua scripts overriding the bundled scripts")
+	pflag.String("redis-key-mapping", "", "Comma separated list of old=new redis key names to operate on during frontier key migrations, e.g. chg_busy{chg}=chg_busy{chg2}")
+	pflag.Bool("redis-key-mapping-only", false, "Operate on the mapped redis key names only instead of both old and new key names")
+	pflag.String("redis-key-prefix", "", "Prefix of the names of the queue and JEID keys, e.g. staging: for staging:REMURI, so several environments can share a redis (the frontier must use the same prefix)")
+	pflag.Bool("redis-jeid-client-caching", false, "Track changes to the JEID hashes with Redis client side caching so that only changed job execution stats are read and written to RethinkDB (requires Redis 6, not supported in cluster mode)")
+	pflag.Int("redis-chg-shards", 0, "Number of shards chg_wait{chg0}..chg_wait{chgN-1} etc. the crawl host group queues are spread over (0 for the unsharded queues)")
+	pflag.Bool("redis-enqueue-sources", false, "Log the enqueue source of REMURI and ceid_timeout items that fail to be processed, read from the companion hashes <queue>:source")
+	pflag.Bool("redis-remuri-job-throttle", false, "Take turns removing queued uris of different job executions, read from the companion hashes <queue>:jeid, so one enormous job doesn't starve removal for smaller jobs")
+	pflag.Int("redis-remuri-job-max-per-pass", 0, "Max number of queued uris of a single job execution removed per pass (0 for no limit)")
+	pflag.Int("redis-remuri-job-lookahead", 5, "Number of batches of the remove queue considered when selecting a fair batch")
+	pflag.Bool("redis-remuri-blocking", false, "Block on the remove queue with BLMOVE and wake the remuri-queue worker when uris arrive instead of polling")
+	pflag.Duration("redis-remuri-block-timeout", 5*time.Second, "Max time the remuri-queue worker blocks on the remove queue before polling it (rounded to whole seconds)")
+	pflag.Bool("redis-remuri-stream", false, "Also consume the remove queue as the Redis Stream REMURI_STREAM with a consumer group, whose entries hold the uri id in the field id (requires Redis 6.2)")
+	pflag.String("redis-remuri-stream-group", "veidemann-frontier-queue-workers", "Consumer group of the remove stream shared by all queue worker instances")
+	pflag.String("redis-script-verify", database.ScriptVerifyWarn, "How to handle redis lua scripts whose SHA doesn't match the scripts bundled at build time, available values are none, warn and enforce (refuse to start)")
+	pflag.Bool("redis-script-eval", false, "Run the delayed queue lua script with EVAL instead of loading it with SCRIPT LOAD, for redis services that don't permit SCRIPT commands (enabled automatically if loading the script is denied)")
+	pflag.Bool("redis-lmpop", false, "Pop the crawl execution timeout queues of all key layouts with a single LMPOP (requires Redis 7) instead of one LPOP per queue")
+	pflag.Int("redis-script-fallback-threshold", 0, "Number of consecutive failures to run the delayed queue lua script after which queues are moved by an equivalent non-atomic implementation (0 disables the fallback)")
+	pflag.Duration("redis-script-fallback-retry", time.Minute, "How long queues are moved by the fallback before the delayed queue lua script is tried again")
+	pflag.String("redis-replication-check", database.ReplicationCheckNone, "how to check redis replication after queue operations, available values are none, warn and wait")
+	pflag.Int64("redis-replication-max-lag", 1024*1024, "Replication offset lag in bytes above which a warning is logged (warn mode)")
+	pflag.Int("redis-replication-replicas", 1, "Number of replicas that must acknowledge queue operations (wait mode)")
+	pflag.Duration("redis-replication-timeout", 100*time.Millisecond, "How long to wait for replicas to acknowledge queue operations (wait mode)")
+
+	pflag.StringSlice("reporters", []string{report.SinkHistory, report.SinkMetrics}, "Comma separated list of sinks worker iteration summaries are reported to, available values are log, metrics, history and webhook")
+	pflag.String("reporter-webhook-url", "", "Url iteration summaries are posted to (webhook reporter)")
+	pflag.Duration("reporter-webhook-timeout", 2*time.Second, "Timeout of each request to the webhook url (webhook reporter)")
+
+	pflag.Bool("one-shot", false, "Run each enabled worker until an iteration processes nothing, then exit (non-zero if a worker failed), e.g. as a Kubernetes CronJob")
+	pflag.Int("one-shot-max-iterations", 0, "Max number of iterations of each worker in one-shot mode (0 for no limit)")
+	pflag.Bool("dry-run", false, "Read the queues and log and export what the workers would do, but write nothing to Redis or RethinkDB (disables heartbeats, run history, rollout safe mode and blocking remove queue mode)")
+	pflag.Bool("rollout-safe-mode", false, "During rolling upgrades only let instances of the newest version process correctness-critical queues, older instances fall back to read-only")
+	pflag.Bool("frontier-pause", false, "Hold off workers while the crawler is paused by the frontier's global pause flag (the redis key frontier:paused)")
+	pflag.StringSlice("frontier-pause-workers", []string{"wait-queue"}, "Comma separated list of workers held off while the crawler is paused, any of wait-queue, busy-queue, ceid-running-queue and ceid-timeout-queue")
+	pflag.Duration("frontier-pause-check-interval", time.Second, "Min delay between checks of the frontier's global pause flag")
+	pflag.Bool("leader-election", false, "Elect a leader among replicas with a redis key, only the leader runs the workers while the others stand by (ignored in one-shot and dry-run mode)")
+	pflag.String("leader-election-id", "", "Identity of this replica in the leader, worker lock and in-flight remove queue keys (defaults to the host name)")
+	pflag.Duration("leader-election-ttl", 10*time.Second, "TTL of the leader key, the max time before a standby replica takes over from a dead leader")
+	pflag.Bool("worker-locks", false, "Spread the workers over replicas by only running a worker while holding its redis lock, as an alternative to leader election (ignored in one-shot and dry-run mode)")
+	pflag.Int("worker-locks-max", 0, "Max number of worker locks held by this replica, e.g. the number of workers divided by the number of replicas rounded up (0 for no limit)")
+	pflag.Duration("worker-locks-ttl", 10*time.Second, "TTL of each worker lock key, the max time before another replica takes over the workers of a dead replica")
+	pflag.Duration("rollout-key-ttl", 30*time.Second, "TTL of the redis key coordinating which version may process correctness-critical queues (rollout safe mode)")
+
+	pflag.String("shutdown-report-file", "", "Path of a JSON file the per-worker totals since startup are written to at exit, in addition to the shutdown report log entry")
+
+	pflag.Int("history-size", 100, "Number of iterations that processed items or failed to keep in the persisted run history of each worker (0 disables history)")
+
+	pflag.Duration("heartbeat-interval", 5*time.Second, "Interval between updates of each worker's heartbeat key in redis")
+	pflag.Duration("heartbeat-ttl", 30*time.Second, "TTL of each worker's heartbeat key in redis (0 disables heartbeats)")
+
+	pflag.String("audit-sink", database.AuditSinkNone, "where to write audit records of state changing operations, available values are none, log and rethinkdb")
+	pflag.String("audit-table", "queue_workers_audit", "RethinkDB table used by the rethinkdb audit sink")
+	pflag.String("takedown-table", "queue_workers_takedowns", "RethinkDB table takedown records are stored in")
+
+	pflag.String("metrics-backend", metrics.BackendPrometheus, "metrics backend, available values are prometheus and statsd")
+	pflag.Int("metrics-port", 9153, "Port to expose metrics on (prometheus backend)")
+	pflag.String("metrics-path", "/metrics", "Path to expose metrics on (prometheus backend)")
+	pflag.String("statsd-host", "localhost", "StatsD agent host (statsd backend)")
+	pflag.Int("statsd-port", 8125, "StatsD agent port (statsd backend)")
+	pflag.String("statsd-prefix", "", "Prefix of metric names sent to the StatsD agent (statsd backend)")
+	pflag.Duration("statsd-interval", 10*time.Second, "Interval between pushes to the StatsD agent (statsd backend)")
+
+	pflag.Int("admin-grpc-port", 0, "Port to expose the admin gRPC service on (0 disables the service)")
+	pflag.String("admin-grpc-token", "", "Bearer token required in the authorization metadata of calls to the admin gRPC service")
+	pflag.Int("admin-http-port", 0, "Port to expose the admin HTTP API on (0 disables the API)")
+	pflag.String("admin-http-token", "", "Bearer token required to access the admin HTTP API")
+	pflag.Int("queue-position-http-port", 0, "Port to expose the read-only queue position API on, which requires no token (0 disables the API)")
+	pflag.String("admin-snapshot-dir", os.TempDir(), "Directory job execution snapshots are written to by the admin HTTP API")
+
+	pflag.Duration("interval-update-job-executions", 5*time.Second, "Delay between iterations of the update-job-executions worker")
+	pflag.Duration("interval-ceid-timeout-queue", 1100*time.Millisecond, "Delay between iterations of the ceid-timeout-queue worker")
+	pflag.Duration("interval-remuri-queue", 200*time.Millisecond, "Delay between iterations of the remuri-queue worker")
+	pflag.Duration("interval-busy-queue", 50*time.Millisecond, "Delay between iterations of the busy-queue worker")
+	pflag.Duration("interval-wait-queue", 50*time.Millisecond, "Delay between iterations of the wait-queue worker")
+	pflag.Duration("interval-ceid-running-queue", 50*time.Millisecond, "Delay between iterations of the ceid-running-queue worker")
+	pflag.Duration("interval-ready-queue-metrics", 1*time.Second, "Delay between iterations of the ready-queue-metrics worker")
+	pflag.Duration("interval-frontier-lag", 5*time.Second, "Delay between iterations of the frontier-lag worker")
+	pflag.Duration("interval-queue-anomalies", 10*time.Second, "Delay between iterations of the queue-anomalies worker")
+	pflag.Duration("interval-burst-mode", 10*time.Second, "Delay between iterations of the burst-mode worker")
+
+	pflag.Float64("interval-jitter", 0, "Max fraction of each delay between worker iterations that is randomly added or subtracted, e.g. 0.1 for +/-10%")
+	pflag.Duration("worker-backoff", time.Second, "Backoff before retrying a worker after its first consecutive failure, doubled on each further failure")
+	pflag.Duration("worker-backoff-max", time.Minute, "Max backoff before retrying a failed worker")
+	pflag.Int("worker-max-failures", 0, "Number of consecutive failures of a worker after which the process exits (0 to keep retrying)")
+
+	pflag.Bool("startup-drain", false, "At startup, run the remuri-queue and ceid-timeout-queue workers until the removal and timeout queues are empty before starting the other workers, e.g. to work off the backlog left by a crash")
+	pflag.Duration("startup-drain-timeout", 10*time.Minute, "Max time spent draining the removal and timeout queues at startup")
+	pflag.Duration("iteration-timeout", 0, "Deadline of each worker iteration (0 for no deadline)")
+	pflag.Duration("drain-timeout", 30*time.Second, "Time in-flight worker iterations are given to finish their batch at shutdown before they are cancelled")
+	pflag.Bool("burst-mode", false, "Raise batch sizes and concurrency while queues hold a backlog, e.g. after downtime")
+	pflag.Int64("burst-remuri-threshold", 100000, "REMURI queue length at which burst mode is entered (left when below half)")
+	pflag.Int64("burst-timeout-threshold", 10000, "Timeout queue length at which burst mode is entered (left when below half)")
+	pflag.Int("remuri-batch-size", database.RemoveUriQueueBatchSize, fmt.Sprintf("Max number of uri ids read from the REMURI queue and deleted from RethinkDB in a single query per pass of the remuri-queue worker (at most %d), lower it if the deletes exceed db-query-timeout", database.MaxRemoveUriQueueBatchSize))
+	pflag.Int("burst-remuri-batch-size", 5*database.RemoveUriQueueBatchSize, "Batch size of the remuri-queue worker in burst mode")
+	pflag.String("burst-concurrency", "", "Comma separated list of worker=n concurrent instances of workers in burst mode, e.g. remuri-queue=8")
+	pflag.String("worker-concurrency", "", "Comma separated list of worker=n concurrent instances of workers supporting it, e.g. remuri-queue=4")
+	pflag.String("worker-schedules", "", "Semicolon separated list of worker=cron expression running workers on a schedule instead of with an interval, e.g. 'update-job-executions=*/10 * 6-22 * * *;...' (optional leading seconds field)")
+
+	pflag.Bool("adaptive-polling", false, "Skip or shorten the delay between iterations of workers with a backlog and back off toward a max delay when idle")
+	pflag.Int("adaptive-polling-factor", 10, "Factor the delay between iterations may be shortened or lengthened by relative to the configured interval (adaptive polling)")
+
+	pflag.Float64("anomaly-threshold", 4, "Number of standard deviations from the moving average a queue length or throughput sample must be to be flagged as an anomaly")
+	pflag.Float64("anomaly-smoothing", 0.1, "Weight of the latest sample in the moving average and variance of queue length and throughput series")
+	pflag.Int("anomaly-warmup", 30, "Number of samples of a series observed before anomalies are flagged")
+
+	pflag.StringSlice("enable-workers", nil, "Comma separated list of workers to run (defaults to all workers)")
+	pflag.StringSlice("disable-workers", nil, "Comma separated list of workers not to run")
+
+	pflag.Bool("trace-empty-iterations", false, "Record trace spans of worker iterations that processed no items")
 
 	pflag.String("log-level", "info", "log level, available levels are panic, fatal, error, warn, info, debug and trace")
-	pflag.String("log-formatter", "logfmt", "log formatter, available values are logfmt and json")
+	pflag.String("log-formatter", "logfmt", "log formatter, available values are logfmt, console and json")
 	pflag.Bool("log-method", false, "log method names")
+	pflag.String("log-level-override", "", "Comma separated list of worker=level log level overrides, e.g. busy-queue=trace,remuri-queue=warn")
+
+	pflag.String("config-file", "", "Config file with settings overriding the defaults (any format supported by viper, e.g. yaml). Log levels, worker intervals and batch sizes are reloaded on SIGHUP")
+	pflag.Bool("config-watch", false, "Reload log levels, worker intervals and batch sizes when the config file changes")
+
+	pflag.Bool("expire-job-executions", false, "Run the expire-job-executions worker, which expires the JEID hashes of job executions that have ended in RethinkDB")
+	pflag.Duration("expire-job-executions-ttl", time.Hour, "How long the JEID hash of an ended job execution is kept (0 to delete it at once)")
+	pflag.Duration("interval-expire-job-executions", time.Minute, "Delay between iterations of the expire-job-executions worker")
+	pflag.Bool("sync-tables", false, "Run the sync-tables worker, which flushes the soft durability writes to the uri_queue, executions and job_executions tables to disk, bounding the writes lost if RethinkDB crashes")
+	pflag.Duration("interval-sync-tables", time.Minute, "Delay between iterations of the sync-tables worker")
+	pflag.Bool("watch-crawl-executions", false, "Run the watch-crawl-executions worker, which follows a RethinkDB changefeed of crawl executions and removes those that have ended or are being aborted from the running queue")
+	pflag.Duration("watch-crawl-executions-listen", 30*time.Second, "How long each iteration of the watch-crawl-executions worker follows the changefeed")
+	pflag.Duration("interval-watch-crawl-executions", time.Second, "Delay between iterations of the watch-crawl-executions worker")
+	pflag.Bool("reconcile-running-crawl-executions", false, "Run the reconcile-running-crawl-executions worker, which removes crawl executions that have ended in RethinkDB from the running queue")
+	pflag.Duration("interval-reconcile-running-crawl-executions", 10*time.Minute, "Delay between iterations of the reconcile-running-crawl-executions worker")
+	pflag.Int("reconciler-page-size", 100, "Max number of candidates listed per page by the reconciler workers")
+	pflag.Float64("reconciler-repairs-per-second", 0, "Max number of repairs per second done by each reconciler worker (0 means no limit)")
+	pflag.Bool("reconciler-maintenance-lock", false, "Take the maintenance lock shared with the frontier, pausing its scheduling, before the first repair of each reconciler pass")
+	pflag.Duration("maintenance-lock-ttl", 30*time.Second, "TTL of the maintenance lock, which is refreshed while it is held")
+	pflag.Duration("maintenance-lock-ack-timeout", 10*time.Second, "How long to wait for the frontier to acknowledge the maintenance lock before giving up the repairs (0 to not wait)")
+	pflag.Duration("interval-redis-memory", 15*time.Second, "Delay between iterations of the redis-memory worker")
+
+	pflag.String("watch-chg", "", "Id of a crawl host group whose transitions between the wait, ready, busy and timeout queues are recorded to a timeline")
+	pflag.String("watch-chg-output", "", "Path of the JSON lines timeline of the watched crawl host group (defaults to chg-<id>-timeline.jsonl)")
+	pflag.Duration("interval-watch-chg", 50*time.Millisecond, "Delay between iterations of the watch-chg worker")
+
+	pflag.String("support-bundle-output", "", "Path of the tar.gz archive written by the support-bundle command (defaults to support-bundle-<timestamp>.tar.gz)")
+
+	pflag.String("alert-rules-output", "-", "Path of the Prometheus rule file written by the alert-rules command (- for stdout)")
+	pflag.Float64("alert-rules-objective", 0.99, "Target fraction of successful worker iterations the error budget burn rate alerts of the alert-rules command are derived from")
+	pflag.Duration("alert-rules-max-frontier-lag", 15*time.Minute, "Frontier queue lag above which the alert-rules command's lag alert fires (0 disables the alert)")
 
+	pflag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [%s|%s]\n", os.Args[0], supportBundleCommand, alertRulesCommand)
+		pflag.PrintDefaults()
+	}
 	pflag.Parse()
 
+	defer exitOnPanic()
+
+	start := time.Now()
+	command := pflag.Arg(0)
+	if command != "" && command != supportBundleCommand && command != alertRulesCommand {
+		pflag.Usage()
+		os.Exit(exitCodeConfig)
+	}
+
 	// setup viper
 	replacer := strings.NewReplacer("-", "_")
 	viper.SetEnvKeyReplacer(replacer)
 	viper.AutomaticEnv()
 	err := viper.BindPFlags(pflag.CommandLine)
 	if err != nil {
-		panic(err)
+		panic(configError(err))
+	}
+	if path := viper.GetString("config-file"); path != "" {
+		viper.SetConfigFile(path)
+		if err := viper.ReadInConfig(); err != nil {
+			panic(configError(fmt.Errorf("failed to read config file: %w", err)))
+		}
 	}
 
 	// setup logging
 	logger.InitLog(viper.GetString("log-level"), viper.GetString("log-formatter"), viper.GetBool("log-method"))
 
-	defer func() {
-		if err := recover(); err != nil {
-			log.Fatal().Msgf("%v", err)
-		}
-	}()
-
 	// setup telemetry
 	if tracer, closer := telemetry.InitTracer("Scope checker", logger.NewJaegerLogger()); tracer != nil {
 		opentracing.SetGlobalTracer(tracer)
@@ -85,26 +288,130 @@ func main() {
 	}
 
 	// setup rethinkdb connection
+	var queryTag string
+	if viper.GetBool("db-query-tags") {
+		queryTag = "veidemann-frontier-queue-workers/" + version
+	}
+	switch viper.GetString("db-durability") {
+	case database.DurabilitySoft, database.DurabilityHard:
+	default:
+		panic(configError(fmt.Errorf("unknown write durability: %s", viper.GetString("db-durability"))))
+	}
+	operationDurability, err := database.ParseWriteDurability(viper.GetString("db-operation-durability"))
+	if err != nil {
+		panic(configError(err))
+	}
+	rethinkDbTLS, err := database.TLSOptions{
+		Enabled:            viper.GetBool("db-tls"),
+		CaCert:             viper.GetString("db-tls-ca-cert"),
+		Cert:               viper.GetString("db-tls-cert"),
+		Key:                viper.GetString("db-tls-key"),
+		ServerName:         viper.GetString("db-tls-server-name"),
+		InsecureSkipVerify: viper.GetBool("db-tls-insecure-skip-verify"),
+	}.Config()
+	if err != nil {
+		panic(configError(err))
+	}
 	rethinkDbConnection := database.NewRethinkDbConnection(
 		database.RethinkDbOptions{
-			Address:            fmt.Sprintf("%s:%d", viper.GetString("db-host"), viper.GetInt("db-port")),
-			Username:           viper.GetString("db-user"),
-			Password:           viper.GetString("db-password"),
-			Database:           viper.GetString("db-name"),
-			QueryTimeout:       viper.GetDuration("db-query-timeout"),
-			MaxOpenConnections: viper.GetInt("db-max-open-conn"),
-			MaxRetries:         viper.GetInt("db-max-retries"),
-			UseOpenTracing:     viper.GetBool("db-use-opentracing"),
+			Address:               fmt.Sprintf("%s:%d", viper.GetString("db-host"), viper.GetInt("db-port")),
+			Username:              viper.GetString("db-user"),
+			Password:              viper.GetString("db-password"),
+			Addresses:             viper.GetStringSlice("db-addresses"),
+			TLSConfig:             rethinkDbTLS,
+			ConnectTimeout:        viper.GetDuration("db-connect-timeout"),
+			ConnectRetries:        viper.GetInt("db-connect-retries"),
+			WaitTimeout:           viper.GetDuration("db-wait-timeout"),
+			WriteDurability:       viper.GetString("db-durability"),
+			OperationDurability:   operationDurability,
+			Database:              viper.GetString("db-name"),
+			QueryTimeout:          viper.GetDuration("db-query-timeout"),
+			MaxOpenConnections:    viper.GetInt("db-max-open-conn"),
+			MaxRetries:            viper.GetInt("db-max-retries"),
+			UseOpenTracing:        viper.GetBool("db-use-opentracing"),
+			SlowQueryThreshold:    viper.GetDuration("db-slow-query-threshold"),
+			WriteCoalesceWindow:   viper.GetDuration("db-write-coalesce-window"),
+			WriteCoalesceMaxBatch: viper.GetInt("db-write-coalesce-max-batch"),
+			RebalanceGuard:        viper.GetBool("db-rebalance-guard"),
+			QueryTag:              queryTag,
+			BreakerThreshold:      viper.GetInt("db-breaker-threshold"),
+			BreakerCooldown:       viper.GetDuration("db-breaker-cooldown"),
+			WriteRateLimit:        viper.GetFloat64("db-write-rate-limit"),
+			WriteRateBurst:        viper.GetInt("db-write-rate-burst"),
 		},
 	)
-	if err := rethinkDbConnection.Connect(); err != nil {
-		panic(err)
+	// commands should work even when rethinkdb is unavailable
+	if command == "" {
+		if err := rethinkDbConnection.Connect(); err != nil {
+			panic(err)
+		}
 	}
 	defer func() {
 		_ = rethinkDbConnection.Close()
 	}()
 
-	redisClient, err := database.NewRedisClient(viper.GetString("redis-host"), viper.GetInt("redis-port"))
+	if viper.GetString("redis-sentinel-master") != "" && len(viper.GetStringSlice("redis-sentinel-addrs")) == 0 {
+		panic(configError(errors.New("redis sentinel mode requires the addresses of the sentinels")))
+	}
+	if viper.GetString("redis-sentinel-master") != "" && len(viper.GetStringSlice("redis-cluster-addrs")) > 0 {
+		panic(configError(errors.New("redis sentinel and cluster mode can't both be enabled")))
+	}
+	switch viper.GetString("redis-network") {
+	case "tcp":
+	case "unix":
+		if viper.GetString("redis-socket") == "" {
+			panic(configError(errors.New("redis unix network requires the path of the socket")))
+		}
+		if viper.GetString("redis-sentinel-master") != "" || len(viper.GetStringSlice("redis-cluster-addrs")) > 0 {
+			panic(configError(errors.New("redis unix network is not supported in sentinel or cluster mode")))
+		}
+	default:
+		panic(configError(fmt.Errorf("unknown redis network: %s", viper.GetString("redis-network"))))
+	}
+	if viper.GetBool("redis-jeid-client-caching") && len(viper.GetStringSlice("redis-cluster-addrs")) > 0 {
+		panic(configError(errors.New("redis client side caching of job executions is not supported in cluster mode")))
+	}
+	if viper.GetInt("redis-db") != 0 && len(viper.GetStringSlice("redis-cluster-addrs")) > 0 {
+		panic(configError(errors.New("redis cluster mode only supports database 0")))
+	}
+	if threshold := viper.GetFloat64("redis-memory-pressure-threshold"); threshold < 0 || threshold > 1 {
+		panic(configError(fmt.Errorf("redis memory pressure threshold must be between 0 and 1: %v", threshold)))
+	}
+	redisTLS, err := database.TLSOptions{
+		Enabled:            viper.GetBool("redis-tls"),
+		CaCert:             viper.GetString("redis-tls-ca-cert"),
+		Cert:               viper.GetString("redis-tls-cert"),
+		Key:                viper.GetString("redis-tls-key"),
+		ServerName:         viper.GetString("redis-tls-server-name"),
+		InsecureSkipVerify: viper.GetBool("redis-tls-insecure-skip-verify"),
+	}.Config()
+	if err != nil {
+		panic(configError(err))
+	}
+	redisUsername, err := secret("redis-username")
+	if err != nil {
+		panic(configError(err))
+	}
+	redisPassword, err := secret("redis-password")
+	if err != nil {
+		panic(configError(err))
+	}
+	redisClient, err := database.NewRedisClient(context.Background(), database.RedisOptions{
+		Network:        viper.GetString("redis-network"),
+		Host:           viper.GetString("redis-host"),
+		Port:           viper.GetInt("redis-port"),
+		Socket:         viper.GetString("redis-socket"),
+		SentinelMaster: viper.GetString("redis-sentinel-master"),
+		SentinelAddrs:  viper.GetStringSlice("redis-sentinel-addrs"),
+		ClusterAddrs:   viper.GetStringSlice("redis-cluster-addrs"),
+		TLSConfig:      redisTLS,
+		Username:       redisUsername,
+		Password:       redisPassword,
+		DB:             viper.GetInt("redis-db"),
+		DialTimeout:    viper.GetDuration("redis-dial-timeout"),
+		ReadTimeout:    viper.GetDuration("redis-read-timeout"),
+		WriteTimeout:   viper.GetDuration("redis-write-timeout"),
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -112,13 +419,465 @@ func main() {
 		_ = redisClient.Close()
 	}()
 
-	db, err := database.NewDatabase(redisClient, rethinkDbConnection, viper.GetString("redis-script-path"))
+	auditor, err := database.NewAuditor(viper.GetString("audit-sink"), rethinkDbConnection, viper.GetString("audit-table"))
 	if err != nil {
+		panic(configError(err))
+	}
+
+	keyMapping, err := database.ParseKeyMapping(viper.GetString("redis-key-mapping"))
+	if err != nil {
+		panic(configError(err))
+	}
+
+	dryRun := viper.GetBool("dry-run")
+	if dryRun {
+		log.Warn().Msg("Dry run: no writes to Redis or RethinkDB will be performed")
+	}
+	// identifies this replica in leader election, worker locks and in-flight lists
+	replicaId := viper.GetString("leader-election-id")
+	if replicaId == "" {
+		replicaId, _ = os.Hostname()
+	}
+	db, err := database.NewDatabase(context.Background(), redisClient, rethinkDbConnection, database.Options{
+		ScriptPath: viper.GetString("redis-script-path"),
+		Owner:      replicaId,
+		Auditor:    auditor,
+		Replication: database.ReplicationOptions{
+			Mode:     viper.GetString("redis-replication-check"),
+			MaxLag:   viper.GetInt64("redis-replication-max-lag"),
+			Replicas: viper.GetInt("redis-replication-replicas"),
+			Timeout:  viper.GetDuration("redis-replication-timeout"),
+		},
+		KeyMapping: database.KeyMappingOptions{
+			Mapping:    keyMapping,
+			MappedOnly: viper.GetBool("redis-key-mapping-only"),
+		},
+		KeyPrefix:         viper.GetString("redis-key-prefix"),
+		ChgShards:         viper.GetInt("redis-chg-shards"),
+		JobExecutionCache: viper.GetBool("redis-jeid-client-caching"),
+		EnqueueSources:    viper.GetBool("redis-enqueue-sources"),
+		TakedownTable:     viper.GetString("takedown-table"),
+		JobThrottle: database.JobThrottleOptions{
+			Enabled:   viper.GetBool("redis-remuri-job-throttle"),
+			MaxPerJob: viper.GetInt("redis-remuri-job-max-per-pass"),
+			Lookahead: viper.GetInt("redis-remuri-job-lookahead"),
+		},
+		RemoveUriStream: database.RemoveUriStreamOptions{
+			Enabled: viper.GetBool("redis-remuri-stream"),
+			Group:   viper.GetString("redis-remuri-stream-group"),
+		},
+		ScriptVerification: viper.GetString("redis-script-verify"),
+		ScriptEval:         viper.GetBool("redis-script-eval"),
+		LMPop:              viper.GetBool("redis-lmpop"),
+		ScriptFallback: database.ScriptFallbackOptions{
+			Threshold: viper.GetInt("redis-script-fallback-threshold"),
+			Retry:     viper.GetDuration("redis-script-fallback-retry"),
+		},
+		DryRun: dryRun,
+	})
+	if errors.Is(err, database.ErrScriptMismatch) {
+		panic(configError(err))
+	} else if err != nil {
 		panic(err)
 	}
 
+	logLevels, err := logger.ParseLevelOverrides(viper.GetString("log-level-override"))
+	if err != nil {
+		panic(configError(err))
+	}
+
+	historySize := viper.GetInt("history-size")
+	heartbeatTtl := viper.GetDuration("heartbeat-ttl")
+	if dryRun {
+		historySize = 0
+		heartbeatTtl = 0
+	}
+	history := database.NewHistory(redisClient, historySize)
+
+	if command == supportBundleCommand {
+		path := viper.GetString("support-bundle-output")
+		if path == "" {
+			path = fmt.Sprintf("support-bundle-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+		}
+		if err := writeSupportBundle(context.Background(), path, db, history); err != nil {
+			panic(fmt.Errorf("failed to write support bundle: %w", err))
+		}
+		log.Info().Msgf("Wrote support bundle to %s", path)
+		return
+	}
+
+	reporter, err := report.New(report.Options{
+		Sinks:          viper.GetStringSlice("reporters"),
+		History:        history,
+		WebhookUrl:     viper.GetString("reporter-webhook-url"),
+		WebhookTimeout: viper.GetDuration("reporter-webhook-timeout"),
+	})
+	if err != nil {
+		panic(configError(err))
+	}
+
+	adaptivePollingFactor := 1
+	if viper.GetBool("adaptive-polling") {
+		adaptivePollingFactor = viper.GetInt("adaptive-polling-factor")
+	}
+
+	concurrency, err := parseWorkerConcurrency(viper.GetString("worker-concurrency"))
+	if err != nil {
+		panic(configError(err))
+	}
+	burstConcurrency, err := parseWorkerConcurrency(viper.GetString("burst-concurrency"))
+	if err != nil {
+		panic(configError(err))
+	}
+	schedules, err := parseWorkerSchedules(viper.GetString("worker-schedules"))
+	if err != nil {
+		panic(configError(err))
+	}
+	var burst *worker.Burst
+	if viper.GetBool("burst-mode") {
+		burst = new(worker.Burst)
+	}
+
+	schedulerOpts := worker.Options{
+		Reporter:              iterationReporter{reporter: reporter},
+		Heartbeat:             database.NewHeartbeat(redisClient, viper.GetDuration("heartbeat-interval"), heartbeatTtl),
+		TraceEmpty:            viper.GetBool("trace-empty-iterations"),
+		LogLevels:             logLevels,
+		AdaptivePollingFactor: adaptivePollingFactor,
+		Jitter:                viper.GetFloat64("interval-jitter"),
+		Backoff:               viper.GetDuration("worker-backoff"),
+		BackoffMax:            viper.GetDuration("worker-backoff-max"),
+		MaxFailures:           viper.GetInt("worker-max-failures"),
+		Transient:             database.IsTransient,
+		Context:               database.WithWorkerName,
+		IterationTimeout:      viper.GetDuration("iteration-timeout"),
+		DrainTimeout:          viper.GetDuration("drain-timeout"),
+		OneShot:               viper.GetBool("one-shot"),
+		MaxIterations:         viper.GetInt("one-shot-max-iterations"),
+		Concurrency:           concurrency,
+		Burst:                 burst,
+		BurstConcurrency:      burstConcurrency,
+		Schedules:             schedules,
+	}
+	// replicas coordinate which of them run the workers by leader election or worker locks
+	if viper.GetBool("leader-election") && viper.GetBool("worker-locks") {
+		panic(configError(errors.New("leader election and worker locks can't both be enabled")))
+	}
+	coordinated := !viper.GetBool("one-shot") && !dryRun
+	var election *database.LeaderElection
+	if viper.GetBool("leader-election") && coordinated {
+		election = database.NewLeaderElection(redisClient, database.LeaderElectionOptions{
+			Owner: replicaId,
+			Ttl:   viper.GetDuration("leader-election-ttl"),
+		})
+		schedulerOpts.Active = func(string) bool { return election.IsLeader() }
+	}
+	// the worker locks are created when the enabled workers are known
+	var locks *database.WorkerLocks
+	useWorkerLocks := viper.GetBool("worker-locks") && coordinated
+	if useWorkerLocks {
+		schedulerOpts.Active = func(name string) bool { return locks.Held(name) }
+	}
+	r := worker.NewScheduler(schedulerOpts)
+
+	settings := new(tunables)
+	settingsReloader := &reloader{scheduler: r, tunables: settings}
+
+	// critical wraps workers processing correctness-critical queues
+	critical := func(fn worker.Func) worker.Func { return fn }
+	if viper.GetBool("rollout-safe-mode") && !dryRun {
+		gate, err := database.NewVersionGate(redisClient, version, time.Second, viper.GetDuration("rollout-key-ttl"))
+		if err != nil {
+			panic(configError(err))
+		}
+		critical = func(fn worker.Func) worker.Func { return versionGated(gate, fn) }
+	}
+
+	// held wraps workers that hold off while the crawler is paused by the frontier
+	held := func(name string, fn worker.Func) worker.Func { return fn }
+	if viper.GetBool("frontier-pause") {
+		flag := database.NewPauseFlag(redisClient, viper.GetDuration("frontier-pause-check-interval"))
+		holdWorkers := make(map[string]bool)
+		for _, name := range viper.GetStringSlice("frontier-pause-workers") {
+			switch name {
+			case "wait-queue", "busy-queue", "ceid-running-queue", "ceid-timeout-queue":
+				holdWorkers[name] = true
+			default:
+				panic(configError(fmt.Errorf("worker can't be held off while the crawler is paused: %s", name)))
+			}
+		}
+		held = func(name string, fn worker.Func) worker.Func {
+			if !holdWorkers[name] {
+				return fn
+			}
+			return pauseGated(flag, fn)
+		}
+	}
+
+	// sheddable wraps non-critical workers that are suspended while RethinkDB is under pressure
+	sheddable := func(name string, fn worker.Func) worker.Func { return fn }
+	if threshold := viper.GetDuration("load-shedding-latency"); threshold > 0 {
+		sheddable = func(name string, fn worker.Func) worker.Func {
+			return loadShed(rethinkDbConnection, threshold, name, fn)
+		}
+	}
+
+	// gated wraps workers that pause while a RethinkDB table they use is unavailable
+	gated := func(name string, fn worker.Func) worker.Func { return fn }
+	if viper.GetBool("db-table-pausing") && !dryRun {
+		gated = func(name string, fn worker.Func) worker.Func {
+			if tables := workerTables[name]; len(tables) > 0 {
+				return tableGated(rethinkDbConnection, tables, fn)
+			}
+			return fn
+		}
+	}
+
+	// yielding wraps workers that don't drain a queue, which are suspended while Redis is under memory pressure
+	yielding := func(name string, fn worker.Func) worker.Func { return fn }
+	var memoryMonitor *database.MemoryMonitor
+	if threshold := viper.GetFloat64("redis-memory-pressure-threshold"); threshold > 0 {
+		memoryMonitor = database.NewMemoryMonitor(redisClient, threshold)
+		yielding = func(name string, fn worker.Func) worker.Func {
+			return memoryYield(memoryMonitor, name, fn)
+		}
+	}
+
+	remuriOpts := []worker.Option{worker.WithBatchSize(settings.RemoveUriBatchSize), worker.WithPartitioning()}
+	if viper.GetBool("redis-remuri-blocking") && !dryRun {
+		timeout := viper.GetDuration("redis-remuri-block-timeout")
+		remuriOpts = append(remuriOpts, worker.WithWait(func(ctx context.Context) (bool, error) {
+			return db.WaitForRemoveUriQueue(ctx, timeout)
+		}))
+	}
+	workers := []worker.Worker{
+		worker.New("update-job-executions", viper.GetDuration("interval-update-job-executions"), critical(gated("update-job-executions", yielding("update-job-executions", sheddable("update-job-executions", updateJobExecutions(db)))))),
+		worker.New("ceid-timeout-queue", viper.GetDuration("interval-ceid-timeout-queue"), critical(gated("ceid-timeout-queue", held("ceid-timeout-queue", crawlExecutionTimeoutQueueWorker(db))))),
+		worker.New("remuri-queue", viper.GetDuration("interval-remuri-queue"), critical(gated("remuri-queue", removeUriQueueWorker(db, burst, settings.RemoveUriBatchSize, settings.BurstRemoveUriBatchSize))), remuriOpts...),
+		worker.New("busy-queue", viper.GetDuration("interval-busy-queue"), critical(held("busy-queue", chgBusyQueueWorker(db)))),
+		worker.New("wait-queue", viper.GetDuration("interval-wait-queue"), critical(held("wait-queue", chgWaitQueueWorker(db)))),
+		worker.New("ceid-running-queue", viper.GetDuration("interval-ceid-running-queue"), critical(held("ceid-running-queue", crawlExecutionRunningQueueWorker(db)))),
+		worker.New("ready-queue-metrics", viper.GetDuration("interval-ready-queue-metrics"), readyQueueMetricsWorker(db), worker.AsSampler()),
+		worker.New("frontier-lag", viper.GetDuration("interval-frontier-lag"), frontierLagWorker(db, func() int64 { return r.Processed("remuri-queue") }), worker.AsSampler()),
+		worker.New("queue-anomalies", viper.GetDuration("interval-queue-anomalies"), anomalyWorker(db, r.ProcessedByWorker, anomalyOptions{
+			smoothing: viper.GetFloat64("anomaly-smoothing"),
+			threshold: viper.GetFloat64("anomaly-threshold"),
+			warmup:    viper.GetInt("anomaly-warmup"),
+		}), worker.AsSampler()),
+	}
+
+	if burst != nil {
+		workers = append(workers, worker.New("burst-mode", viper.GetDuration("interval-burst-mode"), burstWorker(db, burst, burstOptions{
+			removeUriThreshold: viper.GetInt64("burst-remuri-threshold"),
+			timeoutThreshold:   viper.GetInt64("burst-timeout-threshold"),
+		}), worker.AsSampler()))
+	}
+	if memoryMonitor != nil {
+		workers = append(workers, worker.New("redis-memory", viper.GetDuration("interval-redis-memory"), memoryWorker(memoryMonitor), worker.AsSampler()))
+	}
+	if viper.GetBool("sync-tables") {
+		workers = append(workers, worker.New("sync-tables", viper.GetDuration("interval-sync-tables"), gated("sync-tables", syncTablesWorker(db)), worker.AsSampler()))
+	}
+	if viper.GetBool("watch-crawl-executions") {
+		workers = append(workers, worker.New("watch-crawl-executions", viper.GetDuration("interval-watch-crawl-executions"),
+			critical(gated("watch-crawl-executions", watchCrawlExecutionsWorker(db, viper.GetDuration("watch-crawl-executions-listen"))))))
+	}
+	reconcilerOpts := reconciler.Options{
+		PageSize:         viper.GetInt("reconciler-page-size"),
+		RepairsPerSecond: viper.GetFloat64("reconciler-repairs-per-second"),
+	}
+	if viper.GetBool("reconciler-maintenance-lock") && !dryRun {
+		if viper.GetDuration("maintenance-lock-ttl") <= 0 {
+			panic(configError(errors.New("the maintenance lock TTL must be positive")))
+		}
+		reconcilerOpts.Lock = database.NewMaintenanceLock(redisClient, database.MaintenanceLockOptions{
+			Owner:      replicaId,
+			Ttl:        viper.GetDuration("maintenance-lock-ttl"),
+			AckTimeout: viper.GetDuration("maintenance-lock-ack-timeout"),
+		})
+	}
+	if viper.GetBool("reconcile-running-crawl-executions") {
+		runner := reconciler.NewRunner(db.EndedRunningCrawlExecutions(), reconcilerOpts)
+		workers = append(workers, worker.New("reconcile-running-crawl-executions", viper.GetDuration("interval-reconcile-running-crawl-executions"),
+			gated("reconcile-running-crawl-executions", sheddable("reconcile-running-crawl-executions", reconcileWorker(runner)))))
+	}
+	if viper.GetBool("expire-job-executions") {
+		workers = append(workers, worker.New("expire-job-executions", viper.GetDuration("interval-expire-job-executions"),
+			gated("expire-job-executions", sheddable("expire-job-executions", expireJobExecutionsWorker(db, viper.GetDuration("expire-job-executions-ttl"))))))
+	}
+	if chg := viper.GetString("watch-chg"); chg != "" {
+		path := viper.GetString("watch-chg-output")
+		if path == "" {
+			path = fmt.Sprintf("chg-%s-timeline.jsonl", chg)
+		}
+		timeline, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			panic(fmt.Errorf("failed to open crawl host group timeline: %w", err))
+		}
+		defer func() {
+			_ = timeline.Close()
+		}()
+		log.Info().Str("chg", chg).Msgf("Recording crawl host group timeline to %s", path)
+		workers = append(workers, worker.New("watch-chg", viper.GetDuration("interval-watch-chg"), watchChgWorker(db, chg, timeline), worker.AsSampler()))
+	}
+	workers = append(workers, worker.Registered()...)
+
+	var names []string
+	for _, w := range workers {
+		names = append(names, w.Name())
+	}
+	enabled, err := enabledWorkers(names, viper.GetStringSlice("enable-workers"), viper.GetStringSlice("disable-workers"))
+	if err != nil {
+		panic(configError(err))
+	}
+	if err := checkWorkerNames(names, "worker-concurrency", workerNames(concurrency)); err != nil {
+		panic(configError(err))
+	}
+	if err := checkWorkerNames(names, "burst-concurrency", workerNames(burstConcurrency)); err != nil {
+		panic(configError(err))
+	}
+	if err := checkWorkerNames(names, "worker-schedules", workerNames(schedules)); err != nil {
+		panic(configError(err))
+	}
+	if err := checkWorkerNames(names, "log-level-override", workerNames(logLevels)); err != nil {
+		panic(configError(err))
+	}
+	settingsReloader.workers = names
+	for _, w := range workers {
+		if !enabled[w.Name()] {
+			log.Info().Msgf("Worker disabled: %s", w.Name())
+			continue
+		}
+		if err := r.Register(w); err != nil {
+			panic(configError(err))
+		}
+	}
+	if useWorkerLocks {
+		var locked []string
+		for _, name := range names {
+			if enabled[name] {
+				locked = append(locked, name)
+			}
+		}
+		locks = database.NewWorkerLocks(redisClient, locked, database.WorkerLocksOptions{
+			Owner: replicaId,
+			Ttl:   viper.GetDuration("worker-locks-ttl"),
+			Max:   viper.GetInt("worker-locks-max"),
+		})
+	}
+
+	if command == alertRulesCommand {
+		var rulesWorkers []worker.Worker
+		for _, w := range workers {
+			if enabled[w.Name()] {
+				rulesWorkers = append(rulesWorkers, w)
+			}
+		}
+		if err := writeAlertRules(viper.GetString("alert-rules-output"), rulesWorkers, schedules); err != nil {
+			panic(fmt.Errorf("failed to write alert rules: %w", err))
+		}
+		return
+	}
+
+	// commands return before this, as the in-flight lists belong to the running workers
+	if n, err := db.RecoverRemoveUriQueue(log.Logger.WithContext(context.Background())); err != nil {
+		log.Warn().Err(err).Msg("Failed to recover in-flight uri ids of the remove queues")
+	} else if n > 0 {
+		log.Info().Msgf("Recovered %d in-flight uri ids of the remove queues", n)
+	}
+
+	defer func() {
+		reportShutdown(viper.GetString("shutdown-report-file"), start, r.Workers())
+	}()
+
 	ctx, stop := context.WithCancel(context.Background())
 
+	// setup metrics
+	switch viper.GetString("metrics-backend") {
+	case metrics.BackendPrometheus:
+		metricsServer := metrics.NewServer(viper.GetInt("metrics-port"), viper.GetString("metrics-path"))
+		go func() {
+			log.Info().Msgf("Metrics server listening on %s", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Err(err).Msg("Metrics server failed")
+			}
+		}()
+		defer func() {
+			_ = metricsServer.Close()
+		}()
+	case metrics.BackendStatsd:
+		exporter, err := metrics.NewStatsdExporter(
+			viper.GetString("statsd-host"),
+			viper.GetInt("statsd-port"),
+			viper.GetString("statsd-prefix"),
+			viper.GetDuration("statsd-interval"),
+		)
+		if err != nil {
+			panic(err)
+		}
+		log.Info().Msgf("Pushing metrics to StatsD agent at %s:%d", viper.GetString("statsd-host"), viper.GetInt("statsd-port"))
+		go exporter.Run(ctx)
+		defer func() {
+			_ = exporter.Close()
+		}()
+	default:
+		panic(configError(fmt.Errorf("unknown metrics backend: %s", viper.GetString("metrics-backend"))))
+	}
+
+	// setup admin gRPC service
+	if port := viper.GetInt("admin-grpc-port"); port > 0 {
+		grpcServer, err := admin.NewGrpcServer(viper.GetString("admin-grpc-token"), r, db)
+		if err != nil {
+			panic(err)
+		}
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			log.Info().Msgf("Admin gRPC service listening on %s", listener.Addr())
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Error().Err(err).Msg("Admin gRPC service failed")
+			}
+		}()
+		defer grpcServer.Stop()
+	}
+
+	// setup admin HTTP API
+	if port := viper.GetInt("admin-http-port"); port > 0 {
+		adminServer, err := admin.NewHttpServer(admin.HttpOptions{
+			Port:        port,
+			Token:       viper.GetString("admin-http-token"),
+			SnapshotDir: viper.GetString("admin-snapshot-dir"),
+		}, r, db, db, db)
+		if err != nil {
+			panic(err)
+		}
+		go func() {
+			log.Info().Msgf("Admin HTTP API listening on %s", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Err(err).Msg("Admin HTTP API failed")
+			}
+		}()
+		defer func() {
+			_ = adminServer.Close()
+		}()
+	}
+
+	// setup read-only queue position API
+	if port := viper.GetInt("queue-position-http-port"); port > 0 {
+		positionServer := admin.NewQueuePositionServer(port, db)
+		go func() {
+			log.Info().Msgf("Queue position API listening on %s", positionServer.Addr)
+			if err := positionServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().Err(err).Msg("Queue position API failed")
+			}
+		}()
+		defer func() {
+			_ = positionServer.Close()
+		}()
+	}
+
 	go func() {
 		signals := make(chan os.Signal, 1)
 		defer signal.Stop(signals)
@@ -128,41 +887,57 @@ func main() {
 		stop()
 	}()
 
-	wg := new(errgroup.Group)
-
-	for _, v := range []struct {
-		name  string
-		delay time.Duration
-		fn    worker
-	}{
-		{"update-job-executions", 5 * time.Second, updateJobExecutions(db)},
-		{"ceid-timeout-queue", 1100 * time.Millisecond, crawlExecutionTimeoutQueueWorker(db)},
-		{"remuri-queue", 200 * time.Millisecond, removeUriQueueWorker(db)},
-		{"busy-queue", 50 * time.Millisecond, chgBusyQueueWorker(db)},
-		{"wait-queue", 50 * time.Millisecond, chgWaitQueueWorker(db)},
-		{"ceid-running-queue", 50 * time.Millisecond, crawlExecutionRunningQueueWorker(db)},
-	} {
-		t := v
-		log.Info().Dur("delayMs", t.delay).Msgf("Starting worker: %s", t.name)
-
-		wg.Go(func() error {
-			defer stop()
-			for {
-				// io.EOF can be returned by the go-redis driver but
-				// is to be seen as transient
-				if err := t.fn(); err != nil && !errors.Is(err, io.EOF) {
-					return fmt.Errorf("%s: %w", t.name, err)
-				}
-				select {
-				case <-ctx.Done():
-					return nil
-				case <-time.After(t.delay):
-				}
+	// seed jitter so that replicas don't draw the same delays
+	rand.Seed(time.Now().UnixNano())
+
+	if err := settingsReloader.reload(); err != nil {
+		panic(configError(err))
+	}
+	go settingsReloader.watch(ctx, viper.GetBool("config-watch"))
+
+	// hand over leadership and worker locks before the redis client is closed
+	var coordinators sync.WaitGroup
+	defer func() {
+		stop()
+		coordinators.Wait()
+	}()
+	if interval := viper.GetDuration("db-health-check-interval"); interval > 0 {
+		go rethinkDbConnection.CheckHealth(ctx, interval)
+	}
+	if election != nil {
+		election.Campaign(ctx)
+		coordinators.Add(1)
+		go func() {
+			defer coordinators.Done()
+			election.Run(ctx)
+		}()
+	}
+	if locks != nil {
+		locks.Acquire(ctx)
+		coordinators.Add(1)
+		go func() {
+			defer coordinators.Done()
+			locks.Run(ctx)
+		}()
+	}
+
+	if viper.GetBool("startup-drain") && !viper.GetBool("one-shot") {
+		var drainers []worker.Worker
+		for _, w := range workers {
+			active := schedulerOpts.Active == nil || schedulerOpts.Active(w.Name())
+			if enabled[w.Name()] && startupDrainWorkers[w.Name()] && active {
+				drainers = append(drainers, w)
 			}
-		})
+		}
+		if err := drainBacklog(ctx, schedulerOpts, drainers, viper.GetDuration("startup-drain-timeout")); err != nil {
+			log.Warn().Err(err).Msg("Failed to drain backlog at startup, starting all workers")
+		}
 	}
 
-	if err := wg.Wait(); err != nil {
-		panic(err)
+	if err := r.Run(ctx); err != nil {
+		panic(workerFatalError(err))
+	}
+	if viper.GetBool("one-shot") {
+		log.Info().Msg("All workers done")
 	}
 }
@@ -0,0 +1,96 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// commandArgsEnv holds the arguments main is run with in the subprocess started by runCommand
+const commandArgsEnv = "QUEUE_WORKERS_TEST_ARGS"
+
+// TestMain runs main instead of the tests when started by runCommand, so that the exit code of
+// a command can be checked
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv(commandArgsEnv); ok {
+		s, err := miniredis.Run()
+		if err != nil {
+			panic(err)
+		}
+		defer s.Close()
+		os.Args = append([]string{"veidemann-frontier-queue-workers", "--redis-host", s.Host(), "--redis-port", s.Port()}, strings.Fields(args)...)
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runCommand runs main with args in a subprocess connected to a miniredis server and returns
+// its exit code
+func runCommand(t *testing.T, args ...string) int {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), commandArgsEnv+"="+strings.Join(args, " "))
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		t.Logf("output:\n%s", out)
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		command string
+		output  string
+	}{
+		{
+			name:    "support bundle",
+			command: supportBundleCommand,
+			output:  "support-bundle-output",
+		},
+		{
+			name:    "alert rules",
+			command: alertRulesCommand,
+			output:  "alert-rules-output",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.command)
+			if code := runCommand(t, "--"+tt.output, path, tt.command); code != 0 {
+				t.Errorf("%s exited with %d, want 0", tt.command, code)
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("%s didn't write its output: %v", tt.command, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// readyQueueGrowthWindow is the time window the ready queue growth rate is computed over
+const readyQueueGrowthWindow = time.Minute
+
+// ReadyQueueLength is the number of crawl host groups in the ready queue
+var ReadyQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "chg_ready_queue_length",
+	Help:      "Number of crawl host groups ready to be fetched",
+})
+
+// ReadyQueueGrowthRate is the growth rate of the ready queue in crawl host groups per second
+var ReadyQueueGrowthRate = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "chg_ready_queue_growth_rate",
+	Help:      "Growth rate of the ready queue in crawl host groups per second",
+})
+
+type readyQueueSample struct {
+	length int64
+	time   time.Time
+}
+
+// readyQueue holds recent samples of the ready queue length
+var readyQueue struct {
+	sync.Mutex
+	samples []readyQueueSample
+}
+
+// ObserveReadyQueue records a sample of the ready queue length and updates the growth rate.
+func ObserveReadyQueue(length int64, now time.Time) {
+	readyQueue.Lock()
+	defer readyQueue.Unlock()
+
+	readyQueue.samples = append(readyQueue.samples, readyQueueSample{length: length, time: now})
+	i := 0
+	for i < len(readyQueue.samples)-1 && now.Sub(readyQueue.samples[i].time) > readyQueueGrowthWindow {
+		i++
+	}
+	readyQueue.samples = readyQueue.samples[i:]
+
+	ReadyQueueLength.Set(float64(length))
+	ReadyQueueGrowthRate.Set(growthRate(readyQueue.samples))
+}
+
+// growthRate returns the change per second between the oldest and newest sample
+func growthRate(samples []readyQueueSample) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	oldest, newest := samples[0], samples[len(samples)-1]
+	elapsed := newest.time.Sub(oldest.time).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(newest.length-oldest.length) / elapsed
+}
+
+// readyQueueHandler serves the ready queue length and growth rate as JSON
+// for use as a Kubernetes HPA external metric.
+func readyQueueHandler(w http.ResponseWriter, _ *http.Request) {
+	readyQueue.Lock()
+	var body struct {
+		Length     int64     `json:"length"`
+		GrowthRate float64   `json:"growthRate"`
+		Timestamp  time.Time `json:"timestamp"`
+	}
+	if n := len(readyQueue.samples); n > 0 {
+		body.Length = readyQueue.samples[n-1].length
+		body.Timestamp = readyQueue.samples[n-1].time
+		body.GrowthRate = growthRate(readyQueue.samples)
+	}
+	readyQueue.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	namespace = "veidemann"
+	subsystem = "frontier_queue_workers"
+)
+
+// RethinkDbSlowQueries counts RethinkDB operations exceeding the slow query threshold
+var RethinkDbSlowQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "rethinkdb_slow_queries_total",
+	Help:      "Number of RethinkDB operations exceeding the slow query threshold",
+}, []string{"operation"})
+
+// RethinkDbWriteThrottle counts the time RethinkDB writes waited for the write rate limit
+var RethinkDbWriteThrottle = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "rethinkdb_write_throttle_seconds_total",
+	Help:      "Time RethinkDB writes waited for the write rate limit",
+}, []string{"operation"})
+
+// RethinkDbLatency is the moving average of the duration of RethinkDB queries
+var RethinkDbLatency = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "rethinkdb_latency_seconds",
+	Help:      "Moving average of the duration of RethinkDB queries",
+})
+
+// WorkerShedIterations counts iterations of non-critical workers skipped because of database pressure
+var WorkerShedIterations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "worker_shed_iterations_total",
+	Help:      "Number of iterations of non-critical workers skipped because RethinkDB latency exceeded the load shedding threshold",
+}, []string{"worker"})
+
+// RethinkDbConnected is 1 while the RethinkDB health check succeeds, 0 otherwise
+var RethinkDbConnected = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "rethinkdb_connected",
+	Help:      "Whether the last RethinkDB health check succeeded (1) or not (0)",
+})
+
+// RethinkDbTableAvailable is 1 while a RethinkDB table is ready for writes, 0 otherwise
+var RethinkDbTableAvailable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "rethinkdb_table_available",
+	Help:      "Whether a RethinkDB table is ready for writes (1) or not (0)",
+}, []string{"table"})
+
+// RethinkDbCircuitState is the state of the RethinkDB circuit breaker
+var RethinkDbCircuitState = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "rethinkdb_circuit_state",
+	Help:      "State of the RethinkDB circuit breaker (0 closed, 1 open, 2 half-open)",
+})
+
+// RethinkDbCircuitSkips counts operations skipped while the RethinkDB circuit breaker is open
+var RethinkDbCircuitSkips = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "rethinkdb_circuit_skips_total",
+	Help:      "Number of operations skipped while the RethinkDB circuit breaker is open",
+}, []string{"operation"})
+
+// ReconcilerCandidates counts candidates listed by reconcilers
+var ReconcilerCandidates = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "reconciler_candidates_total",
+	Help:      "Number of candidates listed by reconcilers",
+}, []string{"reconciler"})
+
+// ReconcilerRepairs counts candidates repaired by reconcilers
+var ReconcilerRepairs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "reconciler_repairs_total",
+	Help:      "Number of candidates repaired by reconcilers",
+}, []string{"reconciler"})
+
+// ReconcilerErrors counts failed reconciler passes
+var ReconcilerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "reconciler_errors_total",
+	Help:      "Number of reconciler passes that failed",
+}, []string{"reconciler"})
+
+// WorkerIterations counts worker iterations by result
+var WorkerIterations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "worker_iterations_total",
+	Help:      "Number of worker iterations by result",
+}, []string{"worker", "result"})
+
+// WorkerProcessed counts items processed by workers
+var WorkerProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "worker_processed_total",
+	Help:      "Number of items processed by workers",
+}, []string{"worker"})
+
+// WorkerIterationDuration observes the duration of worker iterations
+var WorkerIterationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "worker_iteration_duration_seconds",
+	Help:      "Duration of worker iterations",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+}, []string{"worker"})
+
+// WorkerConsecutiveFailures is the number of consecutive failed iterations of each worker
+var WorkerConsecutiveFailures = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "worker_consecutive_failures",
+	Help:      "Number of consecutive failed iterations of each worker",
+}, []string{"worker"})
+
+// WorkerIterationTimeouts counts worker iterations exceeding the iteration deadline
+var WorkerIterationTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "worker_iteration_timeouts_total",
+	Help:      "Number of worker iterations exceeding the iteration deadline",
+}, []string{"worker"})
+
+// WorkerPanics counts worker iterations that panicked
+var WorkerPanics = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "worker_panics_total",
+	Help:      "Number of worker iterations that panicked",
+}, []string{"worker"})
+
+// WorkerPaused is 1 if a worker is paused, 0 otherwise
+var WorkerPaused = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "worker_paused",
+	Help:      "Whether a worker is paused (1) or not (0)",
+}, []string{"worker"})
+
+// Leader is 1 while this replica is the elected leader, 0 otherwise
+var Leader = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "leader",
+	Help:      "Whether this replica is the elected leader running the workers (1) or a standby (0)",
+})
+
+// WorkerLockHeld is 1 while this replica holds the lock of a worker, 0 otherwise
+var WorkerLockHeld = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "worker_lock_held",
+	Help:      "Whether this replica holds the lock of the worker (1) or not (0)",
+}, []string{"worker"})
+
+// RedisMemoryUsage is the highest ratio of used memory to maxmemory of the Redis masters
+var RedisMemoryUsage = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "redis_memory_usage_ratio",
+	Help:      "Highest ratio of used memory to maxmemory of the Redis masters (0 if maxmemory is unset)",
+})
+
+// WorkerYieldedIterations counts iterations of non-draining workers skipped because of Redis memory pressure
+var WorkerYieldedIterations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "worker_yielded_iterations_total",
+	Help:      "Number of iterations of non-draining workers skipped because Redis memory usage exceeded the memory pressure threshold",
+}, []string{"worker"})
+
+// FrontierPaused is 1 while the crawler is paused by the frontier's global pause flag, 0 otherwise
+var FrontierPaused = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "frontier_paused",
+	Help:      "Whether the crawler is paused by the frontier's global pause flag (1) or not (0)",
+})
+
+// BurstMode is 1 while burst mode is active, 0 otherwise
+var BurstMode = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "burst_mode",
+	Help:      "Whether burst mode is active (1) or not (0)",
+})
+
+// BurstTransitions counts transitions into burst and steady mode
+var BurstTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "burst_transitions_total",
+	Help:      "Number of transitions into burst and steady mode",
+}, []string{"mode"})
+
+// AnomalyScore is the distance in standard deviations of the latest sample of a series from its moving average
+var AnomalyScore = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "anomaly_score",
+	Help:      "Distance in standard deviations of the latest sample of a queue length or throughput series from its moving average",
+}, []string{"series"})
+
+// Anomalies counts abnormal spikes and drops in queue length and throughput series
+var Anomalies = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "anomalies_total",
+	Help:      "Number of abnormal spikes and drops in queue length and throughput series",
+}, []string{"series", "direction"})
+
+// QueueItemsDequeued counts items leaving each queue by reason, so that changes in queue
+// length can be explained by the sum of items dequeued and enqueued
+var QueueItemsDequeued = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "queue_items_dequeued_total",
+	Help:      "Number of items leaving each queue by reason (processed, evicted-missing-doc, duplicate)",
+}, []string{"queue", "reason"})
+
+// DryRunItems counts items operations would have processed if not in dry-run mode
+var DryRunItems = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "dry_run_items_total",
+	Help:      "Number of items operations would have processed if not in dry-run mode",
+}, []string{"operation"})
+
+// RedisReplicationLag is the max replication offset lag in bytes of any redis replica
+var RedisReplicationLag = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "redis_replication_lag_bytes",
+	Help:      "Max replication offset lag in bytes of any redis replica",
+})
+
+// RedisReplicationWarnings counts queue operations done while redis replicas were lagging behind
+var RedisReplicationWarnings = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "redis_replication_warnings_total",
+	Help:      "Number of queue operations done while redis replicas were lagging behind",
+}, []string{"operation"})
+
+// RedisScriptDegraded is 1 while queues are moved without the delayed queue script, 0 otherwise
+var RedisScriptDegraded = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "redis_script_degraded",
+	Help:      "Whether queues are moved by the non-atomic fallback because the delayed queue script can't be run (1) or not (0)",
+})
+
+// RedisScriptFailures counts failures to run the delayed queue script
+var RedisScriptFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "redis_script_failures_total",
+	Help:      "Number of failures to run the delayed queue script",
+})
+
+// FrontierLag is the composite frontier queue lag in seconds, the max of its components
+var FrontierLag = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "frontier_queue_lag_seconds",
+	Help:      "Composite frontier queue lag in seconds, the max of all lag components",
+})
+
+// FrontierLagComponent is each component of the frontier queue lag in seconds
+var FrontierLagComponent = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Subsystem: subsystem,
+	Name:      "frontier_queue_lag_component_seconds",
+	Help:      "Components of the frontier queue lag in seconds",
+}, []string{"component"})
+
+// NewServer returns a http server exposing metrics on the given port and path
+func NewServer(port int, path string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.Handler())
+	mux.HandleFunc("/autoscaling/chg-ready", readyQueueHandler)
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: mux,
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// burnRateWindow is a pair of windows the error budget burn rate must exceed a factor over
+// for a burn rate alert to fire, as recommended by the Google SRE workbook
+type burnRateWindow struct {
+	long     time.Duration
+	short    time.Duration
+	factor   float64
+	pending  time.Duration
+	severity string
+}
+
+var burnRateWindows = []burnRateWindow{
+	{long: time.Hour, short: 5 * time.Minute, factor: 14.4, pending: 2 * time.Minute, severity: "critical"},
+	{long: 6 * time.Hour, short: 30 * time.Minute, factor: 6, pending: 15 * time.Minute, severity: "warning"},
+}
+
+// minStallWindow is the shortest window without iterations after which a worker is considered stalled
+const minStallWindow = 5 * time.Minute
+
+// RuleWorker is a worker alerting rules are generated for
+type RuleWorker struct {
+	Name string
+	// Interval is the delay between iterations, zero if the worker runs on a schedule
+	Interval time.Duration
+}
+
+// RulesOptions configures the generated alerting and recording rules
+type RulesOptions struct {
+	// Workers are the enabled workers
+	Workers []RuleWorker
+	// Objective is the target fraction of successful worker iterations, e.g. 0.99
+	Objective float64
+	// MaxFailures is the number of consecutive failures of a worker after which the process exits (0 if it keeps retrying)
+	MaxFailures int
+	// MaxFrontierLag is the frontier queue lag above which an alert fires (0 disables the alert)
+	MaxFrontierLag time.Duration
+	// CircuitBreaker is true if the RethinkDB circuit breaker is enabled
+	CircuitBreaker bool
+}
+
+// RuleFile is a Prometheus rule file
+type RuleFile struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is a group of Prometheus rules
+type RuleGroup struct {
+	Name  string `yaml:"name"`
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule is a Prometheus alerting or recording rule
+type Rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// fqName returns the fully qualified name of a metric exported by this package
+func fqName(name string) string {
+	return prometheus.BuildFQName(namespace, subsystem, name)
+}
+
+// promDuration formats d as a Prometheus duration
+func promDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", (d+time.Second-1)/time.Second)
+	}
+}
+
+// errorRatioRecord returns the name of the recording rule of the ratio of failed iterations over window
+func errorRatioRecord(window time.Duration) string {
+	return fmt.Sprintf("worker:%s:error_ratio_rate%s", fqName("worker_iterations"), promDuration(window))
+}
+
+// Rules returns alerting and recording rules for the enabled workers: multi-window burn rate
+// alerts on the error budget of worker iterations, alerts on stalled, failing and panicking
+// workers, and alerts on frontier queue lag and the RethinkDB circuit breaker if enabled.
+func Rules(opts RulesOptions) RuleFile {
+	var names []string
+	for _, w := range opts.Workers {
+		names = append(names, w.Name)
+	}
+	sort.Strings(names)
+	selector := fmt.Sprintf(`worker=~"%s"`, strings.Join(names, "|"))
+	iterations := fqName("worker_iterations_total")
+	budget := 1 - opts.Objective
+
+	var records []Rule
+	windows := make(map[time.Duration]bool)
+	for _, w := range burnRateWindows {
+		for _, window := range []time.Duration{w.long, w.short} {
+			if windows[window] {
+				continue
+			}
+			windows[window] = true
+			records = append(records, Rule{
+				Record: errorRatioRecord(window),
+				Expr: fmt.Sprintf(`sum by (worker) (rate(%s{%s,result="error"}[%s])) / sum by (worker) (rate(%s{%s}[%s]))`,
+					iterations, selector, promDuration(window), iterations, selector, promDuration(window)),
+			})
+		}
+	}
+
+	var alerts []Rule
+	for _, w := range burnRateWindows {
+		threshold := strconv.FormatFloat(w.factor*budget, 'g', 6, 64)
+		alerts = append(alerts, Rule{
+			Alert: "FrontierQueueWorkerErrorBudgetBurn",
+			Expr: fmt.Sprintf("%s > %s and %s > %s",
+				errorRatioRecord(w.long), threshold, errorRatioRecord(w.short), threshold),
+			For:    promDuration(w.pending),
+			Labels: map[string]string{"severity": w.severity},
+			Annotations: map[string]string{
+				"summary":     "Worker {{ $labels.worker }} is burning its error budget",
+				"description": fmt.Sprintf("Worker {{ $labels.worker }} is failing iterations at %gx the rate allowed by the %s%% objective over the last %s.", w.factor, strconv.FormatFloat(opts.Objective*100, 'g', 6, 64), promDuration(w.long)),
+			},
+		})
+	}
+
+	for _, w := range opts.Workers {
+		// scheduled workers may go a long time between iterations
+		if w.Interval <= 0 {
+			continue
+		}
+		window := 10 * w.Interval
+		if window < minStallWindow {
+			window = minStallWindow
+		}
+		alerts = append(alerts, Rule{
+			Alert:  "FrontierQueueWorkerStalled",
+			Expr:   fmt.Sprintf(`sum by (worker) (increase(%s{worker="%s"}[%s])) == 0`, iterations, w.Name, promDuration(window)),
+			For:    promDuration(minStallWindow),
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "Worker {{ $labels.worker }} is stalled",
+				"description": fmt.Sprintf("Worker {{ $labels.worker }} has not run an iteration in %s.", promDuration(window)),
+			},
+		})
+	}
+
+	failures := 5
+	if opts.MaxFailures > 1 {
+		failures = (opts.MaxFailures + 1) / 2
+	}
+	alerts = append(alerts, Rule{
+		Alert:  "FrontierQueueWorkerFailing",
+		Expr:   fmt.Sprintf("max by (worker) (%s{%s}) >= %d", fqName("worker_consecutive_failures"), selector, failures),
+		For:    "1m",
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary":     "Worker {{ $labels.worker }} is failing",
+			"description": "Worker {{ $labels.worker }} has failed {{ $value }} consecutive iterations.",
+		},
+	}, Rule{
+		Alert:  "FrontierQueueWorkerPanicked",
+		Expr:   fmt.Sprintf("sum by (worker) (increase(%s{%s}[15m])) > 0", fqName("worker_panics_total"), selector),
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary":     "Worker {{ $labels.worker }} panicked",
+			"description": "An iteration of worker {{ $labels.worker }} panicked in the last 15 minutes.",
+		},
+	})
+
+	if opts.MaxFrontierLag > 0 {
+		alerts = append(alerts, Rule{
+			Alert:  "FrontierQueueLagHigh",
+			Expr:   fmt.Sprintf("max(%s) > %g", fqName("frontier_queue_lag_seconds"), opts.MaxFrontierLag.Seconds()),
+			For:    "10m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Frontier queue lag is high",
+				"description": fmt.Sprintf("Frontier queue lag is {{ $value | humanizeDuration }}, above %s.", opts.MaxFrontierLag),
+			},
+		})
+	}
+	if opts.CircuitBreaker {
+		alerts = append(alerts, Rule{
+			Alert:  "FrontierQueueWorkerRethinkDbCircuitOpen",
+			Expr:   fmt.Sprintf("max(%s) == 1", fqName("rethinkdb_circuit_state")),
+			For:    "5m",
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "RethinkDB circuit breaker is open",
+				"description": "DB-dependent work of the frontier queue workers has been skipped for 5 minutes.",
+			},
+		})
+	}
+
+	return RuleFile{Groups: []RuleGroup{
+		{Name: subsystem + ".rules", Rules: records},
+		{Name: subsystem + ".alerts", Rules: alerts},
+	}}
+}
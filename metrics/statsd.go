@@ -0,0 +1,170 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog/log"
+)
+
+// metrics backends
+const (
+	BackendPrometheus = "prometheus"
+	BackendStatsd     = "statsd"
+)
+
+// maxStatsdPacketSize is the max size of a statsd packet sent over UDP
+const maxStatsdPacketSize = 1432
+
+// StatsdExporter periodically pushes registered metrics to a StatsD (or Datadog) agent.
+//
+// Counters are sent as deltas since the previous push, gauges as their current
+// value and histograms as their sample count and sum. Labels are sent as
+// Datadog style tags.
+type StatsdExporter struct {
+	conn     net.Conn
+	prefix   string
+	interval time.Duration
+	gatherer prometheus.Gatherer
+	counters map[string]float64
+}
+
+// NewStatsdExporter returns an exporter sending metrics to the StatsD agent at host:port
+func NewStatsdExporter(host string, port int, prefix string, interval time.Duration) (*StatsdExporter, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd agent: %w", err)
+	}
+	return &StatsdExporter{
+		conn:     conn,
+		prefix:   prefix,
+		interval: interval,
+		gatherer: prometheus.DefaultGatherer,
+		counters: make(map[string]float64),
+	}, nil
+}
+
+// Run pushes metrics every interval until ctx is done.
+func (e *StatsdExporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			_ = e.push()
+			return
+		case <-ticker.C:
+			if err := e.push(); err != nil {
+				log.Warn().Err(err).Str("component", "statsd").Msg("Failed to push metrics")
+			}
+		}
+	}
+}
+
+// Close closes the connection to the statsd agent
+func (e *StatsdExporter) Close() error {
+	return e.conn.Close()
+}
+
+// push gathers all metrics and sends them to the statsd agent
+func (e *StatsdExporter) push() error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, family := range families {
+		name := e.prefix + family.GetName()
+		for _, m := range family.GetMetric() {
+			tags := formatTags(m.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				key := name + tags
+				value := m.GetCounter().GetValue()
+				delta := value - e.counters[key]
+				e.counters[key] = value
+				if delta > 0 {
+					lines = append(lines, formatLine(name, delta, "c", tags))
+				}
+			case dto.MetricType_GAUGE:
+				lines = append(lines, formatLine(name, m.GetGauge().GetValue(), "g", tags))
+			case dto.MetricType_UNTYPED:
+				lines = append(lines, formatLine(name, m.GetUntyped().GetValue(), "g", tags))
+			case dto.MetricType_HISTOGRAM:
+				lines = append(lines,
+					formatLine(name+"_count", float64(m.GetHistogram().GetSampleCount()), "g", tags),
+					formatLine(name+"_sum", m.GetHistogram().GetSampleSum(), "g", tags))
+			case dto.MetricType_SUMMARY:
+				lines = append(lines,
+					formatLine(name+"_count", float64(m.GetSummary().GetSampleCount()), "g", tags),
+					formatLine(name+"_sum", m.GetSummary().GetSampleSum(), "g", tags))
+			}
+		}
+	}
+	return e.send(lines)
+}
+
+// send writes lines to the statsd agent, packing as many lines as possible into each packet
+func (e *StatsdExporter) send(lines []string) error {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > maxStatsdPacketSize {
+			if _, err := e.conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		if _, err := e.conn.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatLine(name string, value float64, metricType string, tags string) string {
+	return name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + metricType + tags
+}
+
+// formatTags formats labels as Datadog style tags
+func formatTags(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(labels))
+	for _, label := range labels {
+		tags = append(tags, label.GetName()+":"+label.GetValue())
+	}
+	sort.Strings(tags)
+	return "|#" + strings.Join(tags, ",")
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package reconciler provides a framework for periodic tasks that compare
+// desired and actual state of a set of candidates and repair any differences.
+package reconciler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// Reconciler lists candidates, checks whether their actual state differs from
+// the desired state and repairs those that do.
+type Reconciler interface {
+	// Name identifies the reconciler in logs and metrics.
+	Name() string
+	// List returns up to limit candidates starting at cursor together with the
+	// cursor of the next page. An empty next cursor means there are no more pages.
+	List(ctx context.Context, cursor string, limit int) (candidates []string, next string, err error)
+	// Check reports whether the candidate needs to be repaired.
+	Check(ctx context.Context, candidate string) (bool, error)
+	// Repair brings the candidate to its desired state.
+	Repair(ctx context.Context, candidate string) error
+}
+
+// Locker takes a lock guaranteeing a consistent window for repairs, e.g. database.MaintenanceLock
+type Locker interface {
+	// Acquire takes the lock and returns a function releasing it
+	Acquire(ctx context.Context, reason string) (func(), error)
+}
+
+// Options configures a Runner
+type Options struct {
+	// Lock is taken before the first repair of a pass and released at the end of the pass (optional)
+	Lock Locker
+	// PageSize is the max number of candidates listed per page
+	PageSize int
+	// RepairsPerSecond limits the rate of repairs (0 means no limit)
+	RepairsPerSecond float64
+	// Burst is the max number of repairs done in a burst
+	Burst int
+}
+
+// Runner runs a Reconciler over all its candidates
+type Runner struct {
+	reconciler Reconciler
+	pageSize   int
+	limiter    *rate.Limiter
+	lock       Locker
+	// release releases the lock if taken during the current pass
+	release func()
+}
+
+// NewRunner returns a new Runner for the given reconciler
+func NewRunner(reconciler Reconciler, opts Options) *Runner {
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = 100
+	}
+	limit := rate.Inf
+	if opts.RepairsPerSecond > 0 {
+		limit = rate.Limit(opts.RepairsPerSecond)
+	}
+	burst := opts.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+	return &Runner{
+		reconciler: reconciler,
+		pageSize:   pageSize,
+		limiter:    rate.NewLimiter(limit, burst),
+		lock:       opts.Lock,
+	}
+}
+
+// Name returns the name of the reconciler
+func (r *Runner) Name() string {
+	return r.reconciler.Name()
+}
+
+// Run does a full pass over all candidates and returns the number of repaired candidates.
+func (r *Runner) Run(ctx context.Context) (int, error) {
+	defer func() {
+		if r.release != nil {
+			r.release()
+			r.release = nil
+		}
+	}()
+	name := r.reconciler.Name()
+	repaired := 0
+	cursor := ""
+	for {
+		candidates, next, err := r.reconciler.List(ctx, cursor, r.pageSize)
+		if err != nil {
+			metrics.ReconcilerErrors.WithLabelValues(name).Inc()
+			return repaired, fmt.Errorf("%s: failed to list candidates: %w", name, err)
+		}
+		metrics.ReconcilerCandidates.WithLabelValues(name).Add(float64(len(candidates)))
+
+		for _, candidate := range candidates {
+			ok, err := r.reconcile(ctx, candidate)
+			if err != nil {
+				metrics.ReconcilerErrors.WithLabelValues(name).Inc()
+				return repaired, fmt.Errorf("%s: failed to reconcile %s: %w", name, candidate, err)
+			}
+			if ok {
+				metrics.ReconcilerRepairs.WithLabelValues(name).Inc()
+				repaired++
+			}
+		}
+
+		if next == "" {
+			return repaired, nil
+		}
+		cursor = next
+	}
+}
+
+// reconcile checks a single candidate and repairs it if needed.
+// It returns true if the candidate was repaired.
+func (r *Runner) reconcile(ctx context.Context, candidate string) (bool, error) {
+	needsRepair, err := r.reconciler.Check(ctx, candidate)
+	if err != nil || !needsRepair {
+		return false, err
+	}
+	if err := r.limiter.Wait(ctx); err != nil {
+		return false, err
+	}
+	if r.lock != nil && r.release == nil {
+		release, err := r.lock.Acquire(ctx, "reconciler "+r.reconciler.Name())
+		if err != nil {
+			return false, err
+		}
+		r.release = release
+	}
+	if err := r.reconciler.Repair(ctx, candidate); err != nil {
+		return false, err
+	}
+	log.Ctx(ctx).Debug().Str("reconciler", r.reconciler.Name()).Str("candidate", candidate).Msg("Repaired")
+	return true, nil
+}
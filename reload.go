@@ -0,0 +1,136 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/logger"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/worker"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// tunables holds the settings that can be reloaded at runtime without restarting
+type tunables struct {
+	removeUriBatchSize      int64
+	burstRemoveUriBatchSize int64
+}
+
+// RemoveUriBatchSize returns the batch size of the remuri-queue worker
+func (t *tunables) RemoveUriBatchSize() int {
+	return int(atomic.LoadInt64(&t.removeUriBatchSize))
+}
+
+// BurstRemoveUriBatchSize returns the batch size of the remuri-queue worker in burst mode
+func (t *tunables) BurstRemoveUriBatchSize() int {
+	return int(atomic.LoadInt64(&t.burstRemoveUriBatchSize))
+}
+
+// reloader applies reloadable settings to the scheduler and tunables
+type reloader struct {
+	mu        sync.Mutex
+	scheduler *worker.Scheduler
+	tunables  *tunables
+	// workers are the names of all workers, enabled or not, which log level overrides may name
+	workers []string
+}
+
+// reload applies the current log level, log level overrides, worker intervals and batch sizes.
+// Nothing is applied if any setting is invalid.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	level := viper.GetString("log-level")
+	logLevels, err := logger.ParseLevelOverrides(viper.GetString("log-level-override"))
+	if err != nil {
+		return err
+	}
+	if err := checkWorkerNames(r.workers, "log-level-override", workerNames(logLevels)); err != nil {
+		return err
+	}
+	batchSize := viper.GetInt("remuri-batch-size")
+	if batchSize <= 0 || batchSize > database.MaxRemoveUriQueueBatchSize {
+		return fmt.Errorf("invalid remuri-batch-size: %d (must be between 1 and %d)", batchSize, database.MaxRemoveUriQueueBatchSize)
+	}
+	burstBatchSize := viper.GetInt("burst-remuri-batch-size")
+	if burstBatchSize <= 0 || burstBatchSize > database.MaxRemoveUriQueueBatchSize {
+		return fmt.Errorf("invalid burst-remuri-batch-size: %d (must be between 1 and %d)", burstBatchSize, database.MaxRemoveUriQueueBatchSize)
+	}
+
+	if err := logger.SetLevel(level); err != nil {
+		return err
+	}
+	r.scheduler.SetLogLevels(logLevels)
+	for _, status := range r.scheduler.Workers() {
+		// only the built-in workers have interval flags
+		if interval := viper.GetDuration("interval-" + status.Name); interval > 0 {
+			if err := r.scheduler.SetInterval(status.Name, interval); err != nil {
+				return err
+			}
+		}
+	}
+	atomic.StoreInt64(&r.tunables.removeUriBatchSize, int64(batchSize))
+	atomic.StoreInt64(&r.tunables.burstRemoveUriBatchSize, int64(burstBatchSize))
+	return nil
+}
+
+// watch reloads settings on SIGHUP, rereading the config file if any, and when the config file
+// changes if watchConfig is set, until ctx is done
+func (r *reloader) watch(ctx context.Context, watchConfig bool) {
+	reload := func(trigger string) {
+		if err := r.reload(); err != nil {
+			log.Error().Err(err).Str("trigger", trigger).Msg("Failed to reload settings, keeping current settings")
+			return
+		}
+		log.Info().Str("trigger", trigger).Msg("Reloaded settings")
+	}
+
+	if watchConfig && viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(func(fsnotify.Event) {
+			reload("config-change")
+		})
+		viper.WatchConfig()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			if viper.ConfigFileUsed() != "" {
+				if err := viper.ReadInConfig(); err != nil {
+					log.Error().Err(err).Msg("Failed to read config file, keeping current settings")
+					continue
+				}
+			}
+			reload("SIGHUP")
+		}
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package report decouples what workers do from how the results of their iterations are reported.
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	SinkLog     = "log"
+	SinkMetrics = "metrics"
+	SinkHistory = "history"
+	SinkWebhook = "webhook"
+)
+
+// Reporter receives the summary of each worker iteration.
+//
+// The logger associated with ctx should be used for logging (see log.Ctx).
+type Reporter interface {
+	Report(ctx context.Context, summary database.IterationSummary)
+}
+
+// Options configures the reporters returned by New
+type Options struct {
+	// Sinks is the names of the reporters to use
+	Sinks []string
+	// History persists iteration summaries (history sink)
+	History *database.History
+	// WebhookUrl is the url iteration summaries are posted to (webhook sink)
+	WebhookUrl string
+	// WebhookTimeout is the timeout of each webhook request (webhook sink)
+	WebhookTimeout time.Duration
+}
+
+// New returns a Reporter reporting to each of the configured sinks
+func New(opts Options) (Reporter, error) {
+	var reporters multiReporter
+	for _, sink := range opts.Sinks {
+		switch strings.TrimSpace(sink) {
+		case "":
+		case SinkLog:
+			reporters = append(reporters, logReporter{})
+		case SinkMetrics:
+			reporters = append(reporters, metricsReporter{})
+		case SinkHistory:
+			reporters = append(reporters, historyReporter{history: opts.History})
+		case SinkWebhook:
+			if opts.WebhookUrl == "" {
+				return nil, fmt.Errorf("webhook reporter requires a webhook url")
+			}
+			reporters = append(reporters, &webhookReporter{
+				url:    opts.WebhookUrl,
+				client: &http.Client{Timeout: opts.WebhookTimeout},
+			})
+		default:
+			return nil, fmt.Errorf("unknown reporter: %s", sink)
+		}
+	}
+	return reporters, nil
+}
+
+// multiReporter reports to each of a list of reporters
+type multiReporter []Reporter
+
+func (m multiReporter) Report(ctx context.Context, summary database.IterationSummary) {
+	for _, reporter := range m {
+		reporter.Report(ctx, summary)
+	}
+}
+
+// logReporter logs iteration summaries that processed any items or failed
+type logReporter struct{}
+
+func (logReporter) Report(ctx context.Context, summary database.IterationSummary) {
+	if summary.Processed == 0 && summary.Error == "" {
+		return
+	}
+	event := log.Ctx(ctx).Debug()
+	if summary.Error != "" {
+		event = log.Ctx(ctx).Warn().Str("error", summary.Error)
+	}
+	event.Int("processed", summary.Processed).
+		Dur("duration", summary.Duration).
+		Msg("Worker iteration")
+}
+
+// metricsReporter counts iterations and processed items and observes the duration of iterations
+type metricsReporter struct{}
+
+func (metricsReporter) Report(_ context.Context, summary database.IterationSummary) {
+	result := "success"
+	if summary.Error != "" {
+		result = "error"
+	}
+	metrics.WorkerIterations.WithLabelValues(summary.Worker, result).Inc()
+	metrics.WorkerProcessed.WithLabelValues(summary.Worker).Add(float64(summary.Processed))
+	metrics.WorkerIterationDuration.WithLabelValues(summary.Worker).Observe(summary.Duration.Seconds())
+}
+
+// historyReporter persists the summaries of iterations that processed any items or failed
+type historyReporter struct {
+	history *database.History
+}
+
+func (h historyReporter) Report(ctx context.Context, summary database.IterationSummary) {
+	if h.history == nil || (summary.Processed == 0 && summary.Error == "") {
+		return
+	}
+	if err := h.history.Record(ctx, summary); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to record iteration in history")
+	}
+}
+
+// webhookReporter posts the JSON encoded summaries of iterations that processed any items or failed to an url
+type webhookReporter struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookReporter) Report(ctx context.Context, summary database.IterationSummary) {
+	if summary.Processed == 0 && summary.Error == "" {
+		return
+	}
+	b, err := json.Marshal(summary)
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Msg("Failed to encode iteration summary")
+		return
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("url", w.url).Msg("Failed to post iteration summary")
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Ctx(ctx).Warn().Int("status", resp.StatusCode).Str("url", w.url).Msg("Failed to post iteration summary")
+	}
+}
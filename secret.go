@@ -0,0 +1,42 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// secret returns the value of the named setting or, if the setting <name>-file is set, the
+// contents of that file without surrounding whitespace, e.g. a mounted Kubernetes secret
+func secret(name string) (string, error) {
+	path := viper.GetString(name + "-file")
+	if path == "" {
+		return viper.GetString(name), nil
+	}
+	if viper.GetString(name) != "" {
+		return "", fmt.Errorf("%s and %s-file can't both be set", name, name)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/admin"
+	"github.com/rs/zerolog/log"
+)
+
+// shutdownReport summarizes the work done by each worker since startup
+type shutdownReport struct {
+	Version string         `json:"version"`
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Uptime  float64        `json:"uptimeSeconds"`
+	Workers []workerTotals `json:"workers"`
+}
+
+// workerTotals are the totals of a worker since startup
+type workerTotals struct {
+	Name       string `json:"name"`
+	Iterations int64  `json:"iterations"`
+	Processed  int64  `json:"processed"`
+	Errors     int64  `json:"errors"`
+}
+
+// reportShutdown logs a summary of the totals of each worker since start and writes it as
+// JSON to path unless path is empty
+func reportShutdown(path string, start time.Time, workers []admin.WorkerStatus) {
+	end := time.Now()
+	report := shutdownReport{
+		Version: version,
+		Start:   start,
+		End:     end,
+		Uptime:  end.Sub(start).Seconds(),
+	}
+	for _, w := range workers {
+		report.Workers = append(report.Workers, workerTotals{
+			Name:       w.Name,
+			Iterations: w.Iterations,
+			Processed:  w.Processed,
+			Errors:     w.Errors,
+		})
+	}
+
+	log.Info().
+		Str("version", report.Version).
+		Time("start", report.Start).
+		Dur("uptime", end.Sub(start)).
+		Interface("workers", report.Workers).
+		Msg("Shutdown report")
+
+	if path == "" {
+		return
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, b, 0644)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("Failed to write shutdown report to %s", path)
+	}
+}
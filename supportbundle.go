@@ -0,0 +1,154 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/spf13/viper"
+)
+
+// supportBundleCommand is the name of the command writing a support bundle
+const supportBundleCommand = "support-bundle"
+
+// sensitiveSettings are substrings of setting names whose values are redacted in support bundles
+var sensitiveSettings = []string{"password", "token", "secret"}
+
+// writeSupportBundle writes a tar.gz archive to path with sanitized config, queue lengths,
+// recent worker errors, script SHAs and version info.
+func writeSupportBundle(ctx context.Context, path string, db database.Database, history *database.History) error {
+	files := make(map[string]interface{})
+
+	files["version.json"] = versionInfo()
+	files["config.json"] = sanitizedConfig()
+
+	if lengths, err := db.QueueLengths(ctx); err != nil {
+		files["queues.json"] = map[string]string{"error": err.Error()}
+	} else {
+		files["queues.json"] = lengths
+	}
+
+	if errs, err := recentErrors(ctx, history); err != nil {
+		files["errors.json"] = map[string]string{"error": err.Error()}
+	} else {
+		files["errors.json"] = errs
+	}
+
+	files["scripts.json"] = db.ScriptShas()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	now := time.Now()
+	for name, content := range files {
+		b, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			_ = f.Close()
+			return fmt.Errorf("failed to encode %s: %w", name, err)
+		}
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(b)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// versionInfo returns version and build information
+func versionInfo() map[string]interface{} {
+	info := map[string]interface{}{
+		"version":   version,
+		"goVersion": runtime.Version(),
+		"os":        runtime.GOOS,
+		"arch":      runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		deps := make(map[string]string)
+		for _, dep := range bi.Deps {
+			deps[dep.Path] = dep.Version
+		}
+		info["dependencies"] = deps
+	}
+	return info
+}
+
+// sanitizedConfig returns all settings with sensitive values redacted
+func sanitizedConfig() map[string]interface{} {
+	settings := viper.AllSettings()
+	for name := range settings {
+		for _, sensitive := range sensitiveSettings {
+			if strings.Contains(strings.ToLower(name), sensitive) && settings[name] != "" {
+				settings[name] = "REDACTED"
+			}
+		}
+	}
+	return settings
+}
+
+// recentErrors returns the failed iterations in the run history of each worker
+func recentErrors(ctx context.Context, history *database.History) (map[string][]database.IterationSummary, error) {
+	workers, err := history.Workers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	errs := make(map[string][]database.IterationSummary)
+	for _, worker := range workers {
+		summaries, err := history.List(ctx, worker)
+		if err != nil {
+			return nil, err
+		}
+		for _, summary := range summaries {
+			if summary.Error != "" {
+				errs[worker] = append(errs[worker], summary)
+			}
+		}
+	}
+	return errs, nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/worker"
+	"github.com/rs/zerolog/log"
+)
+
+// chgTransition is an observed change of the queues a crawl host group is in
+type chgTransition struct {
+	Time time.Time                      `json:"time"`
+	Chg  string                         `json:"chg"`
+	From []database.CrawlHostGroupState `json:"from"`
+	To   []database.CrawlHostGroupState `json:"to"`
+}
+
+// watchChgWorker returns a worker that records every observed transition of a crawl host group
+// between the wait, ready, busy and timeout queues to timeline as JSON lines.
+//
+// The queues are polled, so transitions shorter than the interval of the worker may be missed.
+// Changes of position in the ready and timeout queues are not transitions.
+func watchChgWorker(db database.Database, chg string, timeline io.Writer) worker.Func {
+	var last []database.CrawlHostGroupState
+	lastKey := "unobserved"
+	enc := json.NewEncoder(timeline)
+	return func(ctx context.Context) (int, error) {
+		states, err := db.CrawlHostGroupStates(ctx, chg)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get state of crawl host group %s: %w", chg, err)
+		}
+		key := chgStatesKey(states)
+		if key == lastKey {
+			return 0, nil
+		}
+
+		t := chgTransition{Time: time.Now().UTC(), Chg: chg, From: last, To: states}
+		if err := enc.Encode(t); err != nil {
+			return 0, fmt.Errorf("failed to write crawl host group timeline: %w", err)
+		}
+		log.Ctx(ctx).Info().Str("chg", chg).Str("from", lastKey).Str("to", key).Msg("Crawl host group transition")
+		last, lastKey = states, key
+		return 1, nil
+	}
+}
+
+// chgStatesKey returns a string identifying the queues of states and the due time in each
+func chgStatesKey(states []database.CrawlHostGroupState) string {
+	if len(states) == 0 {
+		return database.CrawlHostGroupIdle
+	}
+	keys := make([]string, 0, len(states))
+	for _, s := range states {
+		key := s.State + "(" + s.Queue
+		if !s.DueAt.IsZero() {
+			key += "@" + s.DueAt.Format(time.RFC3339Nano)
+		}
+		keys = append(keys, key+")")
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
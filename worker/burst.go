@@ -0,0 +1,42 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import "sync/atomic"
+
+// Burst switches burst mode on and off. While burst mode is active a Scheduler runs
+// the burst concurrency of workers (see Options.BurstConcurrency), and workers may
+// raise their batch sizes, to work off a backlog.
+//
+// A nil Burst is never active.
+type Burst struct {
+	active int32
+}
+
+// Active reports whether burst mode is active
+func (b *Burst) Active() bool {
+	return b != nil && atomic.LoadInt32(&b.active) == 1
+}
+
+// Set activates or deactivates burst mode and reports whether the mode changed
+func (b *Burst) Set(active bool) bool {
+	var v int32
+	if active {
+		v = 1
+	}
+	return atomic.SwapInt32(&b.active, v) != v
+}
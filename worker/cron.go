@@ -0,0 +1,179 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a cron schedule
+type Schedule struct {
+	expr   string
+	second bits
+	minute bits
+	hour   bits
+	dom    bits
+	month  bits
+	dow    bits
+	anyDom bool
+	anyDow bool
+}
+
+// bits is a set of values of a cron field
+type bits uint64
+
+func (b bits) has(v int) bool {
+	return b&(1<<uint(v)) != 0
+}
+
+// ParseSchedule parses a cron expression with the fields minute, hour, day of month, month and
+// day of week, optionally preceded by a seconds field. Each field is *, a value, a range a-b or
+// a comma separated list of those, any of which may be followed by a step /n. Days of week are
+// 0-7 where both 0 and 7 are sunday.
+func ParseSchedule(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("invalid cron expression, expected 5 or 6 fields: %s", expr)
+	}
+
+	s := &Schedule{expr: expr}
+	var err error
+	for i, f := range []struct {
+		field    *bits
+		min, max int
+	}{
+		{&s.second, 0, 59},
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	} {
+		if *f.field, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("invalid cron expression %s: %w", expr, err)
+		}
+	}
+	if s.dow.has(7) {
+		s.dow |= 1
+	}
+	s.anyDom = fields[3] == "*"
+	s.anyDow = fields[5] == "*"
+	if s.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("cron expression never matches: %s", expr)
+	}
+	return s, nil
+}
+
+// parseCronField parses a cron field with values between min and max
+func parseCronField(field string, min int, max int) (bits, error) {
+	var b bits
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		from, to := min, max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			i := strings.Index(rangePart, "-")
+			var err1, err2 error
+			from, err1 = strconv.Atoi(rangePart[:i])
+			to, err2 = strconv.Atoi(rangePart[i+1:])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range: %s", part)
+			}
+		default:
+			v, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value: %s", part)
+			}
+			from = v
+			if step == 1 {
+				to = v
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("value out of range %d-%d: %s", min, max, part)
+		}
+		for v := from; v <= to; v += step {
+			b |= 1 << uint(v)
+		}
+	}
+	return b, nil
+}
+
+// String returns the cron expression of the schedule
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// Next returns the first time after t matching the schedule, or the zero time if there is
+// none within five years
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, mo, d := t.Date()
+		h, mi, sec := t.Clock()
+		switch {
+		case !s.month.has(int(mo)):
+			t = time.Date(y, mo+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(y, mo, d+1, 0, 0, 0, 0, loc)
+		case !s.hour.has(h):
+			t = time.Date(y, mo, d, h+1, 0, 0, 0, loc)
+		case !s.minute.has(mi):
+			t = time.Date(y, mo, d, h, mi+1, 0, 0, loc)
+		case !s.second.has(sec):
+			t = t.Add(time.Second)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches reports whether the day of t matches the schedule. Like in cron, a day matches
+// either the day of month or the day of week field when both are restricted.
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom.has(t.Day())
+	dow := s.dow.has(int(t.Weekday()))
+	switch {
+	case s.anyDom && s.anyDow:
+		return true
+	case s.anyDom:
+		return dow
+	case s.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
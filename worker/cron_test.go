@@ -0,0 +1,115 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// a monday
+	from := time.Date(2021, 3, 1, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		expr     string
+		wantErr  bool
+		wantNext time.Time
+	}{
+		{
+			name:     "every minute",
+			expr:     "* * * * *",
+			wantNext: time.Date(2021, 3, 1, 10, 31, 0, 0, time.UTC),
+		},
+		{
+			name:     "leading seconds field",
+			expr:     "*/10 * * * * *",
+			wantNext: time.Date(2021, 3, 1, 10, 30, 20, 0, time.UTC),
+		},
+		{
+			name:     "step over a range",
+			expr:     "0 */10 6-22 * * *",
+			wantNext: time.Date(2021, 3, 1, 10, 40, 0, 0, time.UTC),
+		},
+		{
+			name:     "list of values",
+			expr:     "15,45 * * * *",
+			wantNext: time.Date(2021, 3, 1, 10, 45, 0, 0, time.UTC),
+		},
+		{
+			name:     "hours out of the window roll over to the next day",
+			expr:     "0 6-8 * * *",
+			wantNext: time.Date(2021, 3, 2, 6, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "day of week 7 is sunday",
+			expr:     "0 0 * * 7",
+			wantNext: time.Date(2021, 3, 7, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "day of month or day of week when both are restricted",
+			expr:     "0 0 15 * 3",
+			wantNext: time.Date(2021, 3, 3, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "too few fields",
+			expr:    "* * * *",
+			wantErr: true,
+		},
+		{
+			name:    "value out of range",
+			expr:    "0 24 * * *",
+			wantErr: true,
+		},
+		{
+			name:    "reversed range",
+			expr:    "0 10-5 * * *",
+			wantErr: true,
+		},
+		{
+			name:    "zero step",
+			expr:    "*/0 * * * *",
+			wantErr: true,
+		},
+		{
+			name:    "not a number",
+			expr:    "a * * * *",
+			wantErr: true,
+		},
+		{
+			name:    "never matches",
+			expr:    "0 0 31 2 *",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSchedule(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if next := s.Next(from); !next.Equal(tt.wantNext) {
+				t.Errorf("Next(%v) = %v, want %v", from, next, tt.wantNext)
+			}
+		})
+	}
+}
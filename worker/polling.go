@@ -0,0 +1,87 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"math/rand"
+	"time"
+)
+
+// pollInterval adapts the delay between iterations of a worker to the backlog.
+//
+// The delay is skipped after a full batch, shortened toward min while items are
+// processed and backed off toward max while there is nothing to process.
+type pollInterval struct {
+	base time.Duration
+	min  time.Duration
+	max  time.Duration
+	// batchSize is the number of processed items considered a full batch (0 if the worker has no batch size)
+	batchSize int
+	// jitter is the max fraction of the delay randomly added to or subtracted from it
+	jitter  float64
+	current time.Duration
+}
+
+// newPollInterval returns a pollInterval with the given base delay. The delay is adapted
+// within base/factor and base*factor; a factor of 1 or less disables adaptive polling.
+//
+// Each delay is randomly varied by up to the jitter fraction of it so that replicas and
+// workers hitting the same keys don't synchronize.
+func newPollInterval(base time.Duration, factor int, batchSize int, jitter float64) *pollInterval {
+	if factor < 1 {
+		factor = 1
+	}
+	return &pollInterval{
+		base:      base,
+		min:       base / time.Duration(factor),
+		max:       base * time.Duration(factor),
+		batchSize: batchSize,
+		jitter:    jitter,
+		current:   base,
+	}
+}
+
+// next returns the delay before the next iteration given the result of the last iteration
+func (p *pollInterval) next(processed int, err error) time.Duration {
+	switch {
+	case p.min == p.max:
+	case err != nil:
+		p.current = p.base
+	case p.batchSize > 0 && processed >= p.batchSize:
+		p.current = p.min
+		return 0
+	case processed > 0:
+		p.current /= 2
+		if p.current < p.min {
+			p.current = p.min
+		}
+	default:
+		p.current *= 2
+		if p.current > p.max {
+			p.current = p.max
+		}
+	}
+	return p.jittered(p.current)
+}
+
+// jittered returns d randomly varied by up to the jitter fraction of d
+func (p *pollInterval) jittered(d time.Duration) time.Duration {
+	if p.jitter <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*p.jitter*float64(d))
+}
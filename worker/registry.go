@@ -0,0 +1,51 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	registryMu sync.Mutex
+	registry   []Worker
+)
+
+// Register makes a custom worker available to be run by the queue workers alongside the
+// built-in workers, with the same supervision, metrics and shutdown. It is meant to be
+// called from the init function of a package implementing institution specific tasks,
+// and must be called before the scheduler is run.
+//
+// Register panics if a worker with the same name is already registered.
+func Register(w Worker) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	for _, registered := range registry {
+		if registered.Name() == w.Name() {
+			panic(fmt.Sprintf("worker: Register called twice for worker %s", w.Name()))
+		}
+	}
+	registry = append(registry, w)
+}
+
+// Registered returns the custom workers in the order they were registered
+func Registered() []Worker {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	return append([]Worker(nil), registry...)
+}
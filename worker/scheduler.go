@@ -0,0 +1,666 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/clock"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/logger"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// Hooks are called on worker lifecycle events. Any hook may be nil.
+type Hooks struct {
+	// OnStart is called when a worker starts
+	OnStart func(name string)
+	// OnFailure is called when an iteration of a worker fails
+	OnFailure func(name string, err error, failures int)
+	// OnStop is called when a worker stops, with the error that stopped it if any
+	OnStop func(name string, err error)
+}
+
+// ErrUnknownWorker is returned when a worker is not found
+var ErrUnknownWorker = errors.New("unknown worker")
+
+// Status is the status of a worker
+type Status struct {
+	Name          string    `json:"name"`
+	Paused        bool      `json:"paused"`
+	LastRun       time.Time `json:"lastRun"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime,omitempty"`
+	Iterations    int64     `json:"iterations"`
+	Processed     int64     `json:"processed"`
+	Errors        int64     `json:"errors"`
+}
+
+// Summary summarizes a single worker iteration
+type Summary struct {
+	Worker    string
+	Start     time.Time
+	Duration  time.Duration
+	Processed int
+	Error     string
+}
+
+// Reporter receives the summary of each iteration
+type Reporter interface {
+	Report(ctx context.Context, summary Summary)
+}
+
+// Heartbeat is beaten after each successful iteration of a worker
+type Heartbeat interface {
+	Beat(ctx context.Context, worker string) error
+}
+
+// Options configures a Scheduler
+type Options struct {
+	// Reporter receives the summary of each iteration (optional)
+	Reporter Reporter
+	// Heartbeat is beaten after each successful iteration (optional)
+	Heartbeat Heartbeat
+	// Context is applied to the context of each iteration of the named worker, e.g. to attribute
+	// the operations of the iteration to the worker (optional)
+	Context func(ctx context.Context, name string) context.Context
+	// TraceEmpty enables recording of spans for iterations that processed no items
+	TraceEmpty bool
+	// LogLevels overrides the log level of individual workers
+	LogLevels map[string]zerolog.Level
+	// AdaptivePollingFactor is the factor the delay between iterations may be shortened or
+	// lengthened by relative to the interval of a worker (1 or less disables adaptive polling)
+	AdaptivePollingFactor int
+	// Jitter is the max fraction of each delay randomly added to or subtracted from it
+	Jitter float64
+	// Backoff is the backoff after the first consecutive failure of a worker
+	Backoff time.Duration
+	// BackoffMax is the max backoff before retrying a failed worker
+	BackoffMax time.Duration
+	// MaxFailures is the number of consecutive failures after which Run returns (0 to keep retrying)
+	MaxFailures int
+	// Transient reports whether an error is transient, in which case the failure is retried with
+	// backoff without counting towards MaxFailures (optional)
+	Transient func(err error) bool
+	// IterationTimeout is the deadline of each iteration (0 for no deadline)
+	IterationTimeout time.Duration
+	// DrainTimeout is how long in-flight iterations are given to finish when Run is stopped
+	// before they are cancelled (0 to cancel them immediately)
+	DrainTimeout time.Duration
+	// Concurrency is the number of concurrent instances of individual workers, which must be partitioned (see Partitioner)
+	Concurrency map[string]int
+	// OneShot makes each worker run iterations back to back until an iteration processes nothing,
+	// after which it stops, and Run returns when all workers have stopped. A failed iteration
+	// stops all workers.
+	OneShot bool
+	// MaxIterations is the max number of iterations of each worker in one-shot mode (0 for no limit)
+	MaxIterations int
+	// Burst switches burst mode on and off (optional)
+	Burst *Burst
+	// BurstConcurrency is the number of concurrent instances of individual workers while burst
+	// mode is active, which must be partitioned (see Partitioner)
+	BurstConcurrency map[string]int
+	// Schedules runs individual workers at the times given by a cron schedule instead of with
+	// a delay between iterations. Failed iterations are still retried with backoff.
+	Schedules map[string]*Schedule
+	// Hooks are called on worker lifecycle events
+	Hooks Hooks
+	// Active reports whether this instance may run iterations of the named worker, e.g. while
+	// it is the elected leader of several replicas (optional). Iterations are skipped while it
+	// returns false.
+	Active func(name string) bool
+	// Clock times iterations and the delays between them (defaults to the wall clock)
+	Clock clock.Clock
+}
+
+// workerState holds a worker and its status
+type workerState struct {
+	worker Worker
+	// interval is the delay between iterations, which may be changed at runtime
+	interval time.Duration
+	mu       sync.Mutex
+	status   Status
+	trigger  chan struct{}
+}
+
+// Scheduler runs and supervises workers and keeps track of the status of each worker
+type Scheduler struct {
+	opts  Options
+	clock clock.Clock
+
+	mu        sync.RWMutex
+	names     []string
+	states    map[string]*workerState
+	logLevels map[string]zerolog.Level
+}
+
+// NewScheduler returns a Scheduler with no workers
+func NewScheduler(opts Options) *Scheduler {
+	return &Scheduler{
+		opts:      opts,
+		clock:     clock.OrReal(opts.Clock),
+		states:    make(map[string]*workerState),
+		logLevels: opts.LogLevels,
+	}
+}
+
+// Register adds a worker to the scheduler. Workers must be registered before Run is called.
+func (s *Scheduler) Register(w Worker) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.states[w.Name()]; ok {
+		return fmt.Errorf("worker already registered: %s", w.Name())
+	}
+	if s.instances(w.Name()) > 1 {
+		if p, ok := w.(Partitioner); !ok || !p.Partitioned() {
+			return fmt.Errorf("worker does not support concurrency: %s", w.Name())
+		}
+	}
+	s.names = append(s.names, w.Name())
+	s.states[w.Name()] = &workerState{
+		worker:   w,
+		interval: w.Interval(),
+		status:   Status{Name: w.Name()},
+		trigger:  make(chan struct{}, 1),
+	}
+	return nil
+}
+
+// Run runs all registered workers until ctx is done or a worker gives up after too many
+// consecutive failures, in which case all workers are stopped and the error is returned.
+// In one-shot mode Run also returns when all workers are done.
+//
+// When stopped, in-flight iterations are drained: they are allowed to finish their batch
+// within DrainTimeout before they are cancelled, and Run returns when all have returned.
+func (s *Scheduler) Run(ctx context.Context) error {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	drain, cancelDrain := context.WithCancel(context.Background())
+	defer cancelDrain()
+	go func() {
+		select {
+		case <-drain.Done():
+			return
+		case <-ctx.Done():
+		}
+		log.Info().Dur("timeout", s.opts.DrainTimeout).Msg("Draining in-flight iterations")
+		select {
+		case <-drain.Done():
+		case <-s.clock.After(s.opts.DrainTimeout):
+			log.Warn().Dur("timeout", s.opts.DrainTimeout).Msg("Drain timeout exceeded, cancelling in-flight iterations")
+			cancelDrain()
+		}
+	}()
+
+	s.mu.RLock()
+	states := make([]*workerState, 0, len(s.names))
+	for _, name := range s.names {
+		states = append(states, s.states[name])
+	}
+	s.mu.RUnlock()
+
+	wg := new(errgroup.Group)
+	for _, state := range states {
+		w := state.worker
+		for i := 0; i < s.instances(w.Name()); i++ {
+			index := i
+			wg.Go(func() error {
+				err := s.run(ctx, drain, w, index)
+				if err != nil || !s.opts.OneShot {
+					stop()
+				}
+				if s.opts.Hooks.OnStop != nil {
+					s.opts.Hooks.OnStop(w.Name(), err)
+				}
+				return err
+			})
+		}
+	}
+	return wg.Wait()
+}
+
+// concurrency returns the number of concurrent instances of the named worker
+func (s *Scheduler) concurrency(name string) int {
+	if s.opts.Burst.Active() {
+		if n := s.opts.BurstConcurrency[name]; n > 1 {
+			return n
+		}
+	}
+	if n := s.opts.Concurrency[name]; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// instances returns the max number of concurrent instances of the named worker, in or out of burst mode
+func (s *Scheduler) instances(name string) int {
+	n := 1
+	if c := s.opts.Concurrency[name]; c > n {
+		n = c
+	}
+	if s.opts.Burst != nil {
+		if c := s.opts.BurstConcurrency[name]; c > n {
+			n = c
+		}
+	}
+	return n
+}
+
+// run runs iterations of instance index of w until ctx is done or w gives up. Iterations are
+// run with drain as parent context so that they are not cancelled when ctx is done.
+//
+// Each iteration processes the partition given by index and the current concurrency of w.
+// Instances beyond the current concurrency are idle.
+func (s *Scheduler) run(ctx context.Context, drain context.Context, w Worker, index int) error {
+	name := w.Name()
+	schedule := s.opts.Schedules[name]
+	if schedule != nil {
+		log.Info().Stringer("schedule", schedule).Int("partition", index).Msgf("Starting worker: %s", name)
+	} else {
+		log.Info().Dur("delayMs", w.Interval()).Int("partition", index).Msgf("Starting worker: %s", name)
+	}
+	if s.opts.Hooks.OnStart != nil {
+		s.opts.Hooks.OnStart(name)
+	}
+
+	factor := s.opts.AdaptivePollingFactor
+	if sampler, ok := w.(Sampler); ok && sampler.Sampler() {
+		factor = 1
+	}
+	// the batch size may be reloaded, so it is read again before each delay
+	batcher, _ := w.(Batcher)
+	batchSize := func() int {
+		if batcher == nil {
+			return 0
+		}
+		return batcher.BatchSize()
+	}
+	interval := newPollInterval(w.Interval(), factor, batchSize(), s.opts.Jitter)
+	sup := &supervisor{
+		base:        s.opts.Backoff,
+		max:         s.opts.BackoffMax,
+		maxFailures: s.opts.MaxFailures,
+	}
+
+	var waiter Waiter
+	if wt, ok := w.(Waiter); ok && wt.Waits() && schedule == nil {
+		waiter = wt
+	}
+
+	triggered := false
+	// woken is true if the last iteration was run because the waiter reported items to process
+	woken := false
+	delay := interval.jittered(w.Interval())
+	iterations := 0
+	// a scheduled worker waits for the first time matching its schedule before running
+	waitForSchedule := schedule != nil && !s.opts.OneShot
+	for {
+		if base := s.interval(name); base != interval.base {
+			log.Info().Dur("delayMs", base).Int("partition", index).Msgf("Changed interval of worker: %s", name)
+			interval = newPollInterval(base, factor, batchSize(), s.opts.Jitter)
+		}
+		interval.batchSize = batchSize()
+		wait := false
+		p := partition{index: index, count: s.concurrency(name)}
+		if s.opts.OneShot && p.index >= p.count {
+			return nil
+		}
+		if p.index < p.count && s.active(name) && (triggered || !s.paused(name) && !waitForSchedule) {
+			processed, err := s.runIteration(drain, w, p)
+			iterations++
+			if s.opts.OneShot && err == nil {
+				if processed == 0 {
+					log.Info().Int("partition", index).Int("iterations", iterations).Msgf("Worker done: %s", name)
+					return nil
+				}
+				if s.opts.MaxIterations > 0 && iterations >= s.opts.MaxIterations {
+					log.Warn().Int("partition", index).Int("iterations", iterations).Msgf("Worker reached max iterations before its queue was empty: %s", name)
+					return nil
+				}
+			}
+			delay = interval.next(processed, err)
+			if s.opts.OneShot {
+				delay = 0
+			} else if waiter != nil && err == nil {
+				switch {
+				case processed > 0:
+					delay = 0
+				case !woken:
+					// the waiter is not consulted right after it woke up the worker without
+					// anything being processed, since it would just keep waking it up
+					wait = true
+				}
+			}
+			if err != nil {
+				transient := s.opts.Transient != nil && s.opts.Transient(err)
+				backoff, ok := sup.failed(transient)
+				metrics.WorkerConsecutiveFailures.WithLabelValues(name).Set(float64(sup.failures))
+				if s.opts.Hooks.OnFailure != nil {
+					s.opts.Hooks.OnFailure(name, err, sup.failures)
+				}
+				// in one-shot mode the first failure fails the run, which may be retried as a whole
+				if !ok || s.opts.OneShot {
+					return fmt.Errorf("%s: giving up after %d consecutive failures: %w", name, sup.failures, err)
+				}
+				log.Error().Err(err).Int("failures", sup.failures).Bool("transient", transient).Dur("backoff", backoff).Msgf("Worker failed: %s", name)
+				delay = backoff
+			} else {
+				sup.succeeded()
+				metrics.WorkerConsecutiveFailures.WithLabelValues(name).Set(0)
+			}
+		}
+		if schedule != nil && !s.opts.OneShot && sup.failures == 0 {
+			now := s.clock.Now()
+			delay = schedule.Next(now).Sub(now)
+		}
+		triggered = false
+		woken = false
+		waitForSchedule = false
+		var timer <-chan time.Time
+		var waited <-chan bool
+		if wait {
+			waited = s.wait(ctx, waiter, name)
+		} else {
+			timer = s.clock.After(delay)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer:
+		case woken = <-waited:
+		case <-s.triggered(name):
+			triggered = true
+		}
+	}
+}
+
+// wait calls waiter in the background and returns a channel that receives whether there
+// may be items to process when it returns
+func (s *Scheduler) wait(ctx context.Context, waiter Waiter, name string) <-chan bool {
+	waited := make(chan bool, 1)
+	go func() {
+		ok, err := waiter.Wait(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Warn().Err(err).Msgf("Failed waiting for items to process: %s", name)
+			<-s.clock.After(s.opts.Backoff)
+			ok = false
+		}
+		waited <- ok
+	}()
+	return waited
+}
+
+// triggered returns a channel that receives when an iteration of the named worker is triggered manually
+func (s *Scheduler) triggered(name string) <-chan struct{} {
+	state := s.state(name)
+	if state == nil {
+		return nil
+	}
+	return state.trigger
+}
+
+// state returns the state of the named worker or nil if it is not registered
+func (s *Scheduler) state(name string) *workerState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.states[name]
+}
+
+// active reports whether this instance may run iterations of the named worker
+func (s *Scheduler) active(name string) bool {
+	return s.opts.Active == nil || s.opts.Active(name)
+}
+
+// paused reports whether the named worker is paused
+func (s *Scheduler) paused(name string) bool {
+	state := s.state(name)
+	if state == nil {
+		return false
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.status.Paused
+}
+
+// setPaused pauses or resumes the named worker
+func (s *Scheduler) setPaused(name string, paused bool) error {
+	state := s.state(name)
+	if state == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownWorker, name)
+	}
+	state.mu.Lock()
+	state.status.Paused = paused
+	state.mu.Unlock()
+	if paused {
+		metrics.WorkerPaused.WithLabelValues(name).Set(1)
+		log.Info().Msgf("Paused worker: %s", name)
+	} else {
+		metrics.WorkerPaused.WithLabelValues(name).Set(0)
+		log.Info().Msgf("Resumed worker: %s", name)
+	}
+	return nil
+}
+
+// interval returns the delay between iterations of the named worker
+func (s *Scheduler) interval(name string) time.Duration {
+	state := s.state(name)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.interval
+}
+
+// SetInterval changes the delay between iterations of the named worker, which takes effect
+// after the next iteration
+func (s *Scheduler) SetInterval(name string, interval time.Duration) error {
+	state := s.state(name)
+	if state == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownWorker, name)
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.interval = interval
+	return nil
+}
+
+// SetLogLevels replaces the log level overrides of individual workers
+func (s *Scheduler) SetLogLevels(levels map[string]zerolog.Level) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logLevels = levels
+}
+
+// logLevel returns the log level override of the named worker, if any
+func (s *Scheduler) logLevel(name string) (zerolog.Level, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	level, ok := s.logLevels[name]
+	return level, ok
+}
+
+// Workers implements admin.Controller
+func (s *Scheduler) Workers() []Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	statuses := make([]Status, 0, len(s.names))
+	for _, name := range s.names {
+		state := s.states[name]
+		state.mu.Lock()
+		statuses = append(statuses, state.status)
+		state.mu.Unlock()
+	}
+	return statuses
+}
+
+// Pause implements admin.Controller
+func (s *Scheduler) Pause(name string) error {
+	return s.setPaused(name, true)
+}
+
+// Resume implements admin.Controller
+func (s *Scheduler) Resume(name string) error {
+	return s.setPaused(name, false)
+}
+
+// ProcessedByWorker returns the total number of items processed by each worker
+func (s *Scheduler) ProcessedByWorker() map[string]int64 {
+	processed := make(map[string]int64)
+	for _, status := range s.Workers() {
+		processed[status.Name] = status.Processed
+	}
+	return processed
+}
+
+// Processed returns the total number of items processed by the named worker
+func (s *Scheduler) Processed(name string) int64 {
+	state := s.state(name)
+	if state == nil {
+		return 0
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.status.Processed
+}
+
+// Trigger implements admin.Controller
+func (s *Scheduler) Trigger(name string) error {
+	state := s.state(name)
+	if state == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownWorker, name)
+	}
+	select {
+	case state.trigger <- struct{}{}:
+		log.Info().Msgf("Triggered worker: %s", name)
+	default:
+		// an iteration is already triggered
+	}
+	return nil
+}
+
+// record updates the status of the named worker with the result of an iteration
+func (s *Scheduler) record(name string, start time.Time, processed int, err error) {
+	state := s.state(name)
+	if state == nil {
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.status.LastRun = start
+	state.status.Iterations++
+	state.status.Processed += int64(processed)
+	if err != nil {
+		state.status.Errors++
+		state.status.LastError = err.Error()
+		state.status.LastErrorTime = s.clock.Now()
+	}
+}
+
+// ErrPanic is returned for iterations that panicked
+var ErrPanic = errors.New("worker panicked")
+
+// safeRun runs w, recovering from and returning an error for any panic so that the other
+// workers keep running. The panic is logged with its stack trace.
+func (s *Scheduler) safeRun(ctx context.Context, w Worker) (processed int, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			metrics.WorkerPanics.WithLabelValues(w.Name()).Inc()
+			log.Ctx(ctx).Error().Str("panic", fmt.Sprint(v)).Str("stack", string(debug.Stack())).Msg("Worker panicked")
+			processed, err = 0, fmt.Errorf("%w: %v", ErrPanic, v)
+		}
+	}()
+	return w.Run(ctx)
+}
+
+// runIteration runs a single iteration of a worker in a new span, with a logger
+// that adds the worker name to log events, correlates them with the span and
+// honors any log level override of the worker. The summary of each iteration is
+// reported to the reporter, and successful iterations beat the heartbeat of the worker.
+//
+// Iterations are cancelled when the IterationTimeout deadline is exceeded so that a
+// pathological batch can't block a worker indefinitely.
+//
+// Unless TraceEmpty is set, spans of iterations that processed no items and did
+// not fail are sampled out to avoid filling traces with noise.
+func (s *Scheduler) runIteration(parent context.Context, w Worker, p partition) (int, error) {
+	name := w.Name()
+	span, ctx := opentracing.StartSpanFromContext(parent, name)
+	defer span.Finish()
+	ctx = context.WithValue(ctx, partitionKey{}, p)
+	if s.opts.Context != nil {
+		ctx = s.opts.Context(ctx, name)
+	}
+	if s.opts.IterationTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.IterationTimeout)
+		defer cancel()
+	}
+
+	base := log.Logger
+	if level, ok := s.logLevel(name); ok {
+		base = logger.Unfiltered().Level(level)
+	}
+	l := base.With().Str("worker", name).Logger()
+	if p.count > 1 {
+		l = l.With().Int("partition", p.index).Logger()
+	}
+	ctx = logger.WithTrace(ctx, l)
+	start := s.clock.Now()
+	processed, err := s.safeRun(ctx, w)
+	if err != nil && errors.Is(parent.Err(), context.Canceled) {
+		log.Ctx(ctx).Warn().Err(err).Msg("Iteration cancelled at shutdown")
+	} else if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		metrics.WorkerIterationTimeouts.WithLabelValues(name).Inc()
+		log.Ctx(ctx).Warn().Err(err).Dur("timeout", s.opts.IterationTimeout).Msg("Iteration timed out")
+	}
+	if err != nil {
+		ext.LogError(span, err)
+	} else if processed == 0 && !s.opts.TraceEmpty {
+		ext.SamplingPriority.Set(span, 0)
+	} else {
+		span.SetTag("processed", processed)
+	}
+	s.record(name, start, processed, err)
+
+	summary := Summary{
+		Worker:    name,
+		Start:     start,
+		Duration:  s.clock.Now().Sub(start),
+		Processed: processed,
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	if s.opts.Reporter != nil {
+		s.opts.Reporter.Report(ctx, summary)
+	}
+
+	if err == nil && s.opts.Heartbeat != nil {
+		if err := s.opts.Heartbeat.Beat(ctx, name); err != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("Failed to set heartbeat")
+		}
+	}
+	return processed, err
+}
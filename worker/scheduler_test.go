@@ -0,0 +1,79 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nlnwa/veidemann-frontier-queue-workers/clock"
+)
+
+func TestSchedulerIntervalFakeClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	s := NewScheduler(Options{Clock: fake})
+
+	iterations := make(chan time.Time, 10)
+	if err := s.Register(New("test", time.Minute, func(ctx context.Context) (int, error) {
+		iterations <- fake.Now()
+		return 0, nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+
+	if got := <-iterations; !got.Equal(time.Unix(0, 0)) {
+		t.Errorf("first iteration at %v, want %v", got, time.Unix(0, 0))
+	}
+	for i := 1; i <= 3; i++ {
+		awaitWaiters(t, fake)
+		fake.Advance(30 * time.Second)
+		select {
+		case got := <-iterations:
+			t.Fatalf("iteration at %v before interval passed", got)
+		default:
+		}
+		fake.Advance(30 * time.Second)
+		want := time.Unix(int64(i*60), 0)
+		if got := <-iterations; !got.Equal(want) {
+			t.Errorf("iteration %d at %v, want %v", i, got, want)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// awaitWaiters waits until the scheduler waits on the fake clock
+func awaitWaiters(t *testing.T, fake *clock.Fake) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for fake.Waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for scheduler to wait on clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package worker
+
+import "time"
+
+// supervisor retries failed iterations of a worker with exponential backoff instead of
+// terminating the process, and gives up after too many consecutive failures.
+type supervisor struct {
+	// base is the backoff after the first failure
+	base time.Duration
+	// max is the max backoff
+	max time.Duration
+	// maxFailures is the number of consecutive failures after which to give up (0 to never give up)
+	maxFailures int
+	failures    int
+	// fatal is the number of consecutive failures that were not transient
+	fatal int
+}
+
+// failed records a failed iteration and returns how long to back off before retrying, or
+// false if the worker should give up. Transient failures are backed off from but never
+// make the worker give up.
+func (s *supervisor) failed(transient bool) (time.Duration, bool) {
+	s.failures++
+	if !transient {
+		s.fatal++
+	}
+	if s.maxFailures > 0 && s.fatal >= s.maxFailures {
+		return 0, false
+	}
+	backoff := s.base
+	for i := 1; i < s.failures && backoff < s.max; i++ {
+		backoff *= 2
+	}
+	if backoff > s.max {
+		backoff = s.max
+	}
+	return backoff, true
+}
+
+// succeeded records a successful iteration, resetting the backoff
+func (s *supervisor) succeeded() {
+	s.failures = 0
+	s.fatal = 0
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2021 National Library of Norway.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *       http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package worker schedules and supervises workers that periodically process frontier queues.
+package worker
+
+import (
+	"context"
+	"time"
+)
+
+// Func is a function that returns the number of items processed and an error.
+//
+// The logger associated with ctx should be used for logging (see log.Ctx).
+type Func func(ctx context.Context) (int, error)
+
+// Worker is a task run periodically by a Scheduler
+type Worker interface {
+	// Name uniquely identifies the worker
+	Name() string
+	// Interval is the delay between iterations
+	Interval() time.Duration
+	// Run runs a single iteration and returns the number of items processed
+	Run(ctx context.Context) (int, error)
+}
+
+// Batcher is implemented by workers that process items in batches. The delay is
+// skipped after a full batch when adaptive polling is enabled.
+type Batcher interface {
+	BatchSize() int
+}
+
+// Sampler is implemented by workers that sample rather than process items. The
+// delay between iterations of samplers is not adapted to the backlog.
+type Sampler interface {
+	Sampler() bool
+}
+
+// Partitioner is implemented by workers that only process the items belonging to the
+// partition of the iteration context (see Partition), which makes it safe to run
+// concurrent instances of them.
+type Partitioner interface {
+	Partitioned() bool
+}
+
+// Waiter is implemented by workers that can block until there are items to process. The
+// delay after an iteration that processed nothing is replaced by waiting, and iterations
+// are run back to back while items are processed.
+type Waiter interface {
+	// Waits reports whether the worker waits rather than polls
+	Waits() bool
+	// Wait blocks until there may be items to process or a timeout and reports whether
+	// there may be items to process
+	Wait(ctx context.Context) (bool, error)
+}
+
+type partitionKey struct{}
+
+type partition struct {
+	index int
+	count int
+}
+
+// Partition returns the index of the partition an iteration should process and the number of partitions
+func Partition(ctx context.Context) (index int, count int) {
+	if p, ok := ctx.Value(partitionKey{}).(partition); ok {
+		return p.index, p.count
+	}
+	return 0, 1
+}
+
+// Option configures a worker returned by New
+type Option func(*funcWorker)
+
+// WithBatchSize sets the function returning the number of processed items considered a full batch,
+// which is called before each delay so that the batch size can be reloaded
+func WithBatchSize(size func() int) Option {
+	return func(w *funcWorker) {
+		w.batchSize = size
+	}
+}
+
+// AsSampler marks a worker as sampling rather than processing items
+func AsSampler() Option {
+	return func(w *funcWorker) {
+		w.sampler = true
+	}
+}
+
+// WithPartitioning marks a worker as only processing the items of the partition of the iteration context
+func WithPartitioning() Option {
+	return func(w *funcWorker) {
+		w.partitioned = true
+	}
+}
+
+// WithWait makes the worker block on wait instead of polling while there is nothing to process (see Waiter)
+func WithWait(wait func(ctx context.Context) (bool, error)) Option {
+	return func(w *funcWorker) {
+		w.wait = wait
+	}
+}
+
+// New returns a Worker running fn every interval
+func New(name string, interval time.Duration, fn Func, opts ...Option) Worker {
+	w := &funcWorker{
+		name:     name,
+		interval: interval,
+		fn:       fn,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+type funcWorker struct {
+	name        string
+	interval    time.Duration
+	fn          Func
+	batchSize   func() int
+	sampler     bool
+	partitioned bool
+	wait        func(ctx context.Context) (bool, error)
+}
+
+func (w *funcWorker) Name() string {
+	return w.name
+}
+
+func (w *funcWorker) Interval() time.Duration {
+	return w.interval
+}
+
+func (w *funcWorker) Run(ctx context.Context) (int, error) {
+	return w.fn(ctx)
+}
+
+func (w *funcWorker) BatchSize() int {
+	if w.batchSize == nil {
+		return 0
+	}
+	return w.batchSize()
+}
+
+func (w *funcWorker) Sampler() bool {
+	return w.sampler
+}
+
+func (w *funcWorker) Partitioned() bool {
+	return w.partitioned
+}
+
+func (w *funcWorker) Waits() bool {
+	return w.wait != nil
+}
+
+func (w *funcWorker) Wait(ctx context.Context) (bool, error) {
+	return w.wait(ctx)
+}
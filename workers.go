@@ -18,83 +18,412 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/nlnwa/veidemann-frontier-queue-workers/database"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/metrics"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/reconciler"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/report"
+	"github.com/nlnwa/veidemann-frontier-queue-workers/worker"
 	"github.com/rs/zerolog/log"
 )
 
-// worker is a function that may return an error.
-type worker func() error
-
 // chgWaitQueueWorker returns a worker that moves crawl host groups from wait to ready queue.
-func chgWaitQueueWorker(db database.Database) worker {
-	return func() error {
-		if moved, err := db.MoveWaitToReady(); err != nil {
-			return fmt.Errorf("error moving crawl host groups from wait queue to ready queue: %w", err)
-		} else if moved > 0 {
-			log.Debug().Msgf("%d crawl host group(s) is ready", moved)
+func chgWaitQueueWorker(db database.Database) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		moved, err := db.MoveWaitToReady(ctx)
+		if err != nil {
+			return moved, fmt.Errorf("error moving crawl host groups from wait queue to ready queue: %w", err)
 		}
-		return nil
+		if moved > 0 {
+			log.Ctx(ctx).Debug().Msgf("%d crawl host group(s) is ready", moved)
+		}
+		return moved, nil
 	}
 }
 
 // chgBusyQueueWorker returns a worker that moves crawl host groups from busy to timeout queue.
-func chgBusyQueueWorker(db database.Database) worker {
-	return func() error {
-		if moved, err := db.MoveBusyToTimeout(); err != nil {
-			return fmt.Errorf("error moving crawl host groups from busy queue to timeout queue: %w", err)
-		} else if moved > 0 {
-			log.Debug().Msgf("%d crawl host group(s) timed out", moved)
+func chgBusyQueueWorker(db database.Database) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		moved, err := db.MoveBusyToTimeout(ctx)
+		if err != nil {
+			return moved, fmt.Errorf("error moving crawl host groups from busy queue to timeout queue: %w", err)
 		}
-		return nil
+		if moved > 0 {
+			log.Ctx(ctx).Debug().Msgf("%d crawl host group(s) timed out", moved)
+		}
+		return moved, nil
 	}
 }
 
-// removeUriQueueWorker returns a worker that removes queued URIs.
-func removeUriQueueWorker(db database.Database) worker {
-	return func() error {
-		if removed, err := db.RemoveFromUriQueue(context.Background()); err != nil {
-			return err
-		} else if removed > 0 {
-			log.Debug().Msgf("Removed %d queued uris", removed)
+// removeUriQueueWorker returns a worker that removes the queued URIs of its partition.
+func removeUriQueueWorker(db database.Database, burst *worker.Burst, batchSize func() int, burstBatchSize func() int) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		index, count := worker.Partition(ctx)
+		ctx = database.WithPartition(ctx, index, count)
+		if burst.Active() {
+			ctx = database.WithBatchSize(ctx, burstBatchSize())
+		} else {
+			ctx = database.WithBatchSize(ctx, batchSize())
 		}
-		return nil
+		removed, err := db.RemoveFromUriQueue(ctx)
+		if err != nil {
+			return removed, err
+		}
+		if removed > 0 {
+			log.Ctx(ctx).Debug().Msgf("Removed %d queued uris", removed)
+		}
+		return removed, nil
 	}
 }
 
 // crawlExecutionRunningQueueWorker returns a worker that moves crawl executions from running to timeout queue.
-func crawlExecutionRunningQueueWorker(db database.Database) worker {
-	return func() error {
-		if moved, err := db.MoveRunningToTimeout(); err != nil {
-			return fmt.Errorf("error moving crawl executions from running to timeout queue: %w", err)
-		} else if moved > 0 {
-			log.Debug().Msgf("%d crawl execution(s) timed out", moved)
+func crawlExecutionRunningQueueWorker(db database.Database) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		moved, err := db.MoveRunningToTimeout(ctx)
+		if err != nil {
+			return moved, fmt.Errorf("error moving crawl executions from running to timeout queue: %w", err)
 		}
-		return nil
+		if moved > 0 {
+			log.Ctx(ctx).Debug().Msgf("%d crawl execution(s) timed out", moved)
+		}
+		return moved, nil
 	}
 }
 
 // crawlExecutionTimeoutQueueWorker returns a worker that sets desired state to ABORTED_TIMOUT on crawl executions in timeout queue.
-func crawlExecutionTimeoutQueueWorker(db database.Database) worker {
-	return func() error {
-		if timeouts, err := db.TimeoutCrawlExecutions(context.Background()); err != nil {
-			return fmt.Errorf("time out crawl executions: %w", err)
-		} else if timeouts > 0 {
-			log.Debug().Msgf("%d crawl execution(s) timed out", timeouts)
+func crawlExecutionTimeoutQueueWorker(db database.Database) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		timeouts, err := db.TimeoutCrawlExecutions(ctx)
+		if err != nil {
+			return timeouts, fmt.Errorf("time out crawl executions: %w", err)
 		}
-		return nil
+		if timeouts > 0 {
+			log.Ctx(ctx).Debug().Msgf("%d crawl execution(s) timed out", timeouts)
+		}
+		return timeouts, nil
 	}
 }
 
 // updateJobExecutions returns a worker that updates stats on job executions.
-func updateJobExecutions(db database.Database) worker {
-	return func() error {
-		if count, err := db.UpdateJobExecutions(context.Background()); err != nil {
-			return fmt.Errorf("failed to update job executions: %w", err)
-		} else if count > 0 {
-			log.Debug().Msgf("Updated %d job execution(s)", count)
+func updateJobExecutions(db database.Database) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		count, err := db.UpdateJobExecutions(ctx)
+		if err != nil {
+			return count, fmt.Errorf("failed to update job executions: %w", err)
+		}
+		if count > 0 {
+			log.Ctx(ctx).Debug().Msgf("Updated %d job execution(s)", count)
 		}
+		return count, nil
+	}
+}
+
+// expireJobExecutionsWorker returns a worker that expires the stats of job executions that have ended.
+func expireJobExecutionsWorker(db database.Database, ttl time.Duration) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		count, err := db.ExpireJobExecutions(ctx, ttl)
+		if err != nil {
+			return count, err
+		}
+		if count > 0 {
+			log.Ctx(ctx).Debug().Msgf("Expired stats of %d ended job execution(s)", count)
+		}
+		return count, nil
+	}
+}
+
+// watchCrawlExecutionsWorker returns a worker that follows the desiredState transitions of crawl
+// executions for the duration of listen and removes those that have ended from the running queue.
+func watchCrawlExecutionsWorker(db database.Database, listen time.Duration) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		count, err := db.WatchCrawlExecutions(ctx, listen)
+		if err != nil {
+			return count, err
+		}
+		if count > 0 {
+			log.Ctx(ctx).Debug().Msgf("Removed %d ended crawl execution(s) from the running queue", count)
+		}
+		return count, nil
+	}
+}
+
+// syncTablesWorker returns a worker that flushes the soft durability writes of the workers to disk.
+func syncTablesWorker(db database.Database) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		return db.SyncTables(ctx)
+	}
+}
+
+// readyQueueMetricsWorker returns a worker that samples the length of the ready queue.
+func readyQueueMetricsWorker(db database.Database) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		length, err := db.ReadyQueueLength(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get length of ready queue: %w", err)
+		}
+		metrics.ObserveReadyQueue(length, time.Now())
+		return 0, nil
+	}
+}
+
+// reconcileWorker returns a worker that does a full pass of a reconciler.
+func reconcileWorker(runner *reconciler.Runner) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		repaired, err := runner.Run(ctx)
+		if err != nil {
+			return repaired, err
+		}
+		if repaired > 0 {
+			log.Ctx(ctx).Debug().Msgf("%s repaired %d candidate(s)", runner.Name(), repaired)
+		}
+		return repaired, nil
+	}
+}
+
+// startupDrainWorkers are the workers draining the removal and timeout queues, which are run
+// before the queue movers start generating new ready work when startup drain is enabled
+var startupDrainWorkers = map[string]bool{
+	"remuri-queue":       true,
+	"ceid-timeout-queue": true,
+}
+
+// iterationReporter reports the iterations of the scheduler to a report.Reporter
+type iterationReporter struct {
+	reporter report.Reporter
+}
+
+func (r iterationReporter) Report(ctx context.Context, summary worker.Summary) {
+	r.reporter.Report(ctx, database.IterationSummary(summary))
+}
+
+// drainBacklog runs workers with the scheduler options opts in one-shot mode until their queues
+// are empty, ctx is done or timeout has passed.
+func drainBacklog(ctx context.Context, opts worker.Options, workers []worker.Worker, timeout time.Duration) error {
+	if len(workers) == 0 {
 		return nil
 	}
+	opts.OneShot = true
+	opts.MaxIterations = 0
+	opts.Schedules = nil
+	opts.Hooks = worker.Hooks{}
+	s := worker.NewScheduler(opts)
+	for _, w := range workers {
+		if err := s.Register(w); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	log.Info().Dur("timeout", timeout).Msg("Draining backlog before starting workers")
+	if err := s.Run(ctx); err != nil {
+		return err
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log.Warn().Dur("timeout", timeout).Msg("Startup drain timed out before the queues were empty")
+	} else {
+		log.Info().Dur("duration", time.Since(start)).Msg("Drained backlog")
+	}
+	return nil
+}
+
+// enabledWorkers returns the set of worker names to run given the names of all workers and lists of
+// workers to enable (all if empty) and disable.
+func enabledWorkers(all []string, enable []string, disable []string) (map[string]bool, error) {
+	known := make(map[string]bool)
+	for _, name := range all {
+		known[name] = true
+	}
+	for _, name := range append(append([]string{}, enable...), disable...) {
+		if !known[name] {
+			return nil, fmt.Errorf("unknown worker: %s", name)
+		}
+	}
+
+	enabled := make(map[string]bool)
+	if len(enable) == 0 {
+		for _, name := range all {
+			enabled[name] = true
+		}
+	} else {
+		for _, name := range enable {
+			enabled[name] = true
+		}
+	}
+	for _, name := range disable {
+		delete(enabled, name)
+	}
+	return enabled, nil
+}
+
+// checkWorkerNames returns an error if any of the worker names given in setting isn't one of all
+func checkWorkerNames(all []string, setting string, names []string) error {
+	known := make(map[string]bool)
+	for _, name := range all {
+		known[name] = true
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !known[name] {
+			return fmt.Errorf("unknown worker in %s: %s", setting, name)
+		}
+	}
+	return nil
+}
+
+// workerNames returns the worker names of a setting by worker name
+func workerNames[V any](settings map[string]V) []string {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	return names
+}
+
+// versionGated returns a worker that only runs fn while this instance runs the newest version
+// of the queue workers, so that instances of different versions don't process the same
+// correctness-critical queues during a rolling upgrade.
+func versionGated(gate *database.VersionGate, fn worker.Func) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		active, err := gate.Active(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to check rollout version: %w", err)
+		}
+		if !active {
+			log.Ctx(ctx).Debug().Msg("Newer version is running, skipping iteration")
+			return 0, nil
+		}
+		return fn(ctx)
+	}
+}
+
+// pauseGated returns a worker that only runs fn while the crawler is not paused by the frontier's
+// global pause flag
+func pauseGated(flag *database.PauseFlag, fn worker.Func) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		paused, err := flag.Paused(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to check pause flag: %w", err)
+		}
+		if paused {
+			log.Ctx(ctx).Debug().Msg("Crawler is paused, skipping iteration")
+			return 0, nil
+		}
+		return fn(ctx)
+	}
+}
+
+// workerTables are the RethinkDB tables used by the workers that write to RethinkDB
+var workerTables = map[string][]string{
+	"update-job-executions":              {"job_executions"},
+	"expire-job-executions":              {"job_executions"},
+	"ceid-timeout-queue":                 {"executions"},
+	"watch-crawl-executions":             {"executions"},
+	"reconcile-running-crawl-executions": {"executions"},
+	"remuri-queue":                       {"uri_queue"},
+	"sync-tables":                        {"uri_queue", "executions", "job_executions"},
+}
+
+// tableGated returns a worker that skips iterations of fn while any of tables is unavailable
+func tableGated(conn *database.RethinkDbConnection, tables []string, fn worker.Func) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		for _, table := range tables {
+			available, err := conn.TableAvailable(ctx, table)
+			if err != nil {
+				return 0, fmt.Errorf("failed to check availability of table %s: %w", table, err)
+			}
+			if !available {
+				log.Ctx(ctx).Debug().Str("table", table).Msg("Table is unavailable, skipping iteration")
+				return 0, nil
+			}
+		}
+		return fn(ctx)
+	}
+}
+
+// loadShed returns a worker that skips iterations of the named non-critical worker fn while
+// the RethinkDB query latency exceeds threshold, leaving database capacity to critical workers
+func loadShed(conn *database.RethinkDbConnection, threshold time.Duration, name string, fn worker.Func) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		if latency := conn.Latency(); latency > threshold {
+			metrics.WorkerShedIterations.WithLabelValues(name).Inc()
+			log.Ctx(ctx).Debug().Dur("latency", latency).Dur("threshold", threshold).Msg("RethinkDB is under pressure, skipping iteration")
+			return 0, nil
+		}
+		return fn(ctx)
+	}
+}
+
+// memoryWorker returns a worker that checks whether Redis is approaching its memory limit
+func memoryWorker(monitor *database.MemoryMonitor) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		if _, err := monitor.Check(ctx); err != nil {
+			return 0, fmt.Errorf("failed to check redis memory usage: %w", err)
+		}
+		return 0, nil
+	}
+}
+
+// memoryYield returns a worker that skips iterations of the named worker fn, which doesn't drain
+// any queue, while Redis is approaching its memory limit, leaving Redis to the draining workers
+func memoryYield(monitor *database.MemoryMonitor, name string, fn worker.Func) worker.Func {
+	return func(ctx context.Context) (int, error) {
+		if monitor.UnderPressure() {
+			metrics.WorkerYieldedIterations.WithLabelValues(name).Inc()
+			log.Ctx(ctx).Debug().Msg("Redis is under memory pressure, skipping iteration")
+			return 0, nil
+		}
+		return fn(ctx)
+	}
+}
+
+// parseWorkerConcurrency parses worker concurrency on the form "name=n,name2=n2"
+func parseWorkerConcurrency(s string) (map[string]int, error) {
+	concurrency := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid worker concurrency: %s", pair)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid worker concurrency: %s", pair)
+		}
+		concurrency[name] = n
+	}
+	return concurrency, nil
+}
+
+// parseWorkerSchedules parses worker cron schedules on the form "name=expr;name2=expr2"
+func parseWorkerSchedules(s string) (map[string]*worker.Schedule, error) {
+	schedules := make(map[string]*worker.Schedule)
+	for _, pair := range strings.Split(s, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, expr, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid worker schedule: %s", pair)
+		}
+		schedule, err := worker.ParseSchedule(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule of worker %s: %w", name, err)
+		}
+		schedules[name] = schedule
+	}
+	return schedules, nil
 }